@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/observatorium/observable-demo/pkg/conntrack"
+)
+
+var connsTemplate = template.Must(template.New("conns").Funcs(template.FuncMap{
+	"age": func(start time.Time) string { return time.Since(start).Truncate(time.Millisecond).String() },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><title>Live connections</title></head>
+<body>
+<h1>Live connections ({{ len . }})</h1>
+<table border="1" cellpadding="4">
+<tr><th>Name</th><th>Direction</th><th>Local address</th><th>Remote address</th><th>Age</th><th>Read bytes</th><th>Written bytes</th><th>State</th><th>RTT</th></tr>
+{{- range . }}
+<tr><td>{{ .Name }}</td><td>{{ .Direction }}</td><td>{{ .LocalAddr }}</td><td>{{ .RemoteAddr }}</td><td>{{ age .Start }}</td><td>{{ .ReadBytes }}</td><td>{{ .WrittenBytes }}</td><td>{{ .State }}</td><td>{{ if .RTT }}{{ .RTT }}{{ end }}</td></tr>
+{{- end }}
+</table>
+</body>
+</html>
+`))
+
+// connsHandler serves live connections of the given registry as HTML table, or as JSON if requested with
+// `?format=json` or JSON Accept header.
+func connsHandler(registry *conntrack.ConnRegistry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conns := registry.Conns()
+		if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(conns); err != nil {
+				log.Printf("error: failed to encode connections; err: %v\n", err)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := connsTemplate.Execute(w, conns); err != nil {
+			log.Printf("error: failed to render connections; err: %v\n", err)
+		}
+	})
+}
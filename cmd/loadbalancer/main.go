@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
@@ -16,8 +18,11 @@ import (
 	"time"
 
 	"github.com/observatorium/observable-demo/pkg/conntrack"
+	"github.com/observatorium/observable-demo/pkg/dnscache"
 	"github.com/observatorium/observable-demo/pkg/exthttp"
+	"github.com/observatorium/observable-demo/pkg/exttls"
 	"github.com/observatorium/observable-demo/pkg/lbtransport"
+	"github.com/observatorium/observable-demo/pkg/lbtransport/lbadmin"
 	"github.com/observatorium/observable-demo/pkg/lbtransport/lbutils"
 	"github.com/oklog/run"
 	"github.com/prometheus/client_golang/prometheus"
@@ -28,8 +33,64 @@ import (
 func main() {
 	var (
 		addr             = flag.String("listen-address", ":8080", "The address to listen on for HTTP requests.")
-		targets          = flag.String("targets", "", "Comma-separated URLs for target to load balance to.")
+		targets          = flag.String("targets", "", "Comma-separated URLs for target to load balance to. Each URL can be followed by |-separated labels e.g 'http://a:8081|zone=eu|canary=true'.")
+		secondaryTargets = flag.String("secondary-targets", "", "Comma-separated URLs for secondary targets, e.g. used side by side with --targets during migrations. Same format as --targets.")
+		discoveryMode    = flag.String("discovery-mode", "union", "How to combine --targets and --secondary-targets. One of: union, precedence.")
 		blacklistBackoff = flag.Duration("failed_target_backoff_duration", 5*time.Second, "Backoff duration in case of dial error for given backend.")
+		routeLabels      = flag.String("route-target-labels", "", "Comma-separated name=value labels. If specified, only targets with all matching labels are load balanced to.")
+		accessLog        = flag.Bool("access-log", false, "If true, each proxied request is logged together with picked target and its labels.")
+		debugConns       = flag.Bool("debug-conns", false, "If true, live connections of all listeners and connections to targets are shown on /debug/conns of --admin-listen-address.")
+		flushInterval    = flag.Duration("flush-interval", 0, "How often proxied response body is flushed to the client. 0 disables periodic flushing, negative value flushes after each write. Server-sent events and responses of unknown length (chunked) are always flushed after each write.")
+
+		targetDialTimeout           = flag.Duration("target-dial-timeout", 10*time.Second, "Maximum time for dialing a target.")
+		targetKeepAlive             = flag.Duration("target-keep-alive", 30*time.Second, "TCP keep-alive period for connections to targets.")
+		targetMaxIdleConns          = flag.Int("target-max-idle-conns", 4, "Maximum number of idle connections across all targets. 0 means no limit.")
+		targetMaxIdleConnsPerHost   = flag.Int("target-max-idle-conns-per-host", http.DefaultMaxIdleConnsPerHost, "Maximum number of idle connections per target.")
+		targetMaxConnsPerHost       = flag.Int("target-max-conns-per-host", 0, "Maximum number of connections per target, including active and idle ones. 0 means no limit.")
+		targetIdleConnTimeout       = flag.Duration("target-idle-conn-timeout", 90*time.Second, "How long idle connection to target stays in the pool. 0 means no limit.")
+		targetResponseHeaderTimeout = flag.Duration("target-response-header-timeout", 0, "Maximum time to wait for target's response headers. 0 means no timeout.")
+		targetTLSHandshakeTimeout   = flag.Duration("target-tls-handshake-timeout", 10*time.Second, "Maximum time for TLS handshake with a target.")
+		targetTLSCAFile             = flag.String("target-tls-ca-file", "", "Path to CA bundle used to verify HTTPS targets. System roots are used if empty. Reloaded on change.")
+		targetTLSCertFile           = flag.String("target-tls-cert-file", "", "Path to client certificate for mTLS with HTTPS targets. Reloaded on change.")
+		targetTLSKeyFile            = flag.String("target-tls-key-file", "", "Path to client key for mTLS with HTTPS targets. Reloaded on change.")
+		targetTLSServerName         = flag.String("target-tls-server-name", "", "Server name used for SNI and verification of HTTPS targets. Target host is used if empty.")
+		targetTLSMinVersion         = flag.String("target-tls-min-version", "1.2", "Minimum TLS version for HTTPS targets. One of: 1.0, 1.1, 1.2, 1.3.")
+		targetTLSInsecure           = flag.Bool("target-tls-insecure-skip-verify", false, "If true, certificates of HTTPS targets are not verified.")
+		targetDrainTimeout          = flag.Duration("target-drain-timeout", 30*time.Second, "Maximum time for in-flight requests of target that is drained or disappeared from discovery.")
+		targetHTTP2                 = flag.Bool("target-http2", false, "If true, HTTP/2 is negotiated with HTTPS targets. gRPC calls always use HTTP/2.")
+		targetH2C                   = flag.Bool("target-h2c", false, "If true, cleartext HTTP/2 with prior knowledge (h2c) is used for all HTTP targets. Otherwise only for targets with protocol=h2c label.")
+		targetDialerMetrics         = flag.Bool("target-dialer-metrics", false, "If true, connection metrics of targets have target label with the dialed address.")
+		targetMetricsLimit          = flag.Int("target-metrics-limit", 0, "Maximum number of distinct targets in target-labeled metrics. Targets over the limit are observed as 'other'. 0 means no limit.")
+		targetWarmConns             = flag.Int("target-warm-conns", 0, "Number of pre-dialed connections kept to each target, so new targets do not pay connection setup latency (including TLS handshake) on their first requests. 0 disables pre-dialing.")
+		targetMaxConnAge            = flag.Duration("target-max-conn-age", 0, "Age after which connection to target is closed once idle, so keep-alive connections rebalance e.g to new targets. 0 means no limit.")
+		targetDNSCache              = flag.Bool("target-dns-cache", false, "If true, host names of targets and TCP targets are resolved with in-process DNS cache, instead of on every new connection.")
+		targetDNSCacheMinTTL        = flag.Duration("target-dns-cache-min-ttl", 5*time.Second, "Minimum time answers are cached for. Also used for all answers of the system resolver, which does not expose TTLs.")
+		targetDNSCacheMaxTTL        = flag.Duration("target-dns-cache-max-ttl", 5*time.Minute, "Maximum time answers are cached for.")
+		targetDNSServer             = flag.String("target-dns-server", "", "DNS server (host:port) queried directly by the DNS cache, so answers are cached for TTLs of their records. Search domains and hosts file are not used. If empty, the system resolver is used.")
+		targetDNSCacheMaxStale      = flag.Duration("target-dns-cache-max-stale", 5*time.Minute, "How long after expiry cached answer is used if resolving fails. 0 means expired answers are never used.")
+
+		tlsCertFiles        = flag.String("tls-cert-files", "", "Comma-separated paths to certificates served on --listen-address. If specified, TLS is terminated. Certificate is chosen by SNI. Reloaded on change.")
+		tlsKeyFiles         = flag.String("tls-key-files", "", "Comma-separated paths to keys of --tls-cert-files, in the same order. Reloaded on change.")
+		tlsClientCAFile     = flag.String("tls-client-ca-file", "", "Path to CA bundle used to verify client certificates. Client certificates are not verified if empty. Reloaded on change.")
+		tlsRequireClientCrt = flag.Bool("tls-require-client-cert", false, "If true, clients have to present certificate signed by --tls-client-ca-file, which is then required.")
+		tlsMinVersion       = flag.String("tls-min-version", "1.2", "Minimum TLS version for --listen-address. One of: 1.0, 1.1, 1.2, 1.3.")
+		tlsHandshakeTimeout = flag.Duration("tls-handshake-timeout", 10*time.Second, "Maximum time for TLS handshake with a client.")
+		tlsMaxHandshakes    = flag.Int("tls-max-concurrent-handshakes", conntrack.DefaultMaxTLSHandshakes, "Maximum number of concurrent TLS handshakes with clients. Once reached, no connections are accepted until some handshake finishes.")
+
+		proxyProtocol              = flag.Bool("proxy-protocol", false, "If true, connections to --listen-address and --tcp-listen-address have to start with PROXY protocol (v1 or v2) header, e.g when behind another L4 load balancer.")
+		proxyProtocolHeaderTimeout = flag.Duration("proxy-protocol-header-timeout", 5*time.Second, "Maximum time to receive PROXY protocol header.")
+
+		maxConns         = flag.Int("max-connections", 0, "Maximum number of concurrent connections to --listen-address and --tcp-listen-address, each. 0 means no limit.")
+		maxConnsBehavior = flag.String("max-connections-behavior", "block", "What to do with connections over --max-connections. One of: block (wait in the kernel backlog), reject (accept and close).")
+		acceptRate       = flag.Float64("accept-rate-limit", 0, "Maximum number of connections accepted per second on --listen-address and --tcp-listen-address, each. 0 means no limit.")
+		acceptBurst      = flag.Int("accept-rate-burst", 1, "Maximum number of connections accepted at once above --accept-rate-limit.")
+
+		tcpAddr              = flag.String("tcp-listen-address", "", "The address to listen on for raw TCP connections load balanced between --tcp-targets. TCP proxy is disabled if empty.")
+		tcpTargets           = flag.String("tcp-targets", "", "Comma-separated targets for TCP proxy e.g 'tcp://db-1:5432,tcp://db-2:5432'. Same format as --targets.")
+		tcpSendProxyProtocol = flag.Int("tcp-send-proxy-protocol", 0, "PROXY protocol version (1 or 2) of header with client address sent to --tcp-targets. Header is not sent if 0.")
+
+		adminAddr      = flag.String("admin-listen-address", "", "The address to listen on for admin API requests. Admin API is disabled if empty.")
+		adminTokenFile = flag.String("admin-token-file", "", "Path to file with bearer token required by admin API.")
 
 		demo1Addr = flag.String("listen-demo1-address", ":8081", "The demo1 address to listen on for HTTP requests.")
 		demo2Addr = flag.String("listen-demo2-address", ":8082", "The demo2 address to listen on for HTTP requests.")
@@ -50,10 +111,6 @@ func main() {
 		version.NewCollector(""),
 		prometheus.NewGoCollector(),
 		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
-		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
-			Name: "configured_failed_target_backoff_duration_seconds",
-			Help: "Configured backoff time for unavailable target.",
-		}, func() float64 { return blacklistBackoff.Seconds() }), // nolint: gocritic
 	)
 
 	// Listen for termination signals.
@@ -66,44 +123,274 @@ func main() {
 		})
 	}
 
-	var targetURLs []url.URL
-	for _, addr := range strings.Split(*targets, ",") {
-		u, err := url.Parse(addr)
-		if err != nil {
-			log.Fatalf("failed to parse target %v; err: %v", addr, err)
+	primary, err := parseTargets(*targets)
+	if err != nil {
+		log.Fatalf("failed to parse targets; err: %v", err)
+	}
+	secondary, err := parseTargets(*secondaryTargets)
+	if err != nil {
+		log.Fatalf("failed to parse secondary targets; err: %v", err)
+	}
+	routeMatchers, err := parseLabels(strings.Split(*routeLabels, ","))
+	if err != nil {
+		log.Fatalf("failed to parse route target labels; err: %v", err)
+	}
+
+	var mode lbtransport.CompositeMode
+	switch *discoveryMode {
+	case "union":
+		mode = lbtransport.CompositeUnion
+	case "precedence":
+		mode = lbtransport.CompositePrecedence
+	default:
+		log.Fatalf("unknown discovery mode %v", *discoveryMode)
+	}
+
+	// Targets added or removed via admin API are the primary ones.
+	primaryDiscovery := lbtransport.NewMutableStaticDiscoveryFromTargets(primary, prometheus.WrapRegistererWith(prometheus.Labels{"discovery": "primary"}, reg))
+	discovery := lbtransport.NewCompositeDiscovery(reg, mode,
+		lbtransport.DiscoverySource{Name: "primary", Discovery: primaryDiscovery},
+		lbtransport.DiscoverySource{
+			Name:      "secondary",
+			Discovery: lbtransport.NewStaticDiscoveryFromTargets(secondary, prometheus.WrapRegistererWith(prometheus.Labels{"discovery": "secondary"}, reg)),
+		},
+	)
+	rrPicker := lbtransport.NewRoundRobinPicker(ctx, reg, *blacklistBackoff)
+	reg.MustRegister(
+		lbtransport.NewTargetInfoCollector(discovery),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "configured_failed_target_backoff_duration_seconds",
+			Help: "Configured backoff time for unavailable target.",
+		}, func() float64 { return rrPicker.BlacklistBackoff().Seconds() }),
+	)
+
+	var picker lbtransport.TargetPicker = rrPicker
+	if len(routeMatchers) > 0 {
+		picker = lbtransport.NewLabelMatchingPicker(routeMatchers, picker)
+	}
+	minVersion, err := exttls.ParseVersion(*targetTLSMinVersion)
+	if err != nil {
+		log.Fatalf("failed to parse target TLS min version; err: %v", err)
+	}
+	// Targets can override TLS configuration with TLS labels e.g 'https://a:8443|tls_server_name=a.example.com'.
+	targetTLS, err := exttls.NewClientTLS(exttls.ClientConfig{
+		CAFile:             *targetTLSCAFile,
+		CertFile:           *targetTLSCertFile,
+		KeyFile:            *targetTLSKeyFile,
+		ServerName:         *targetTLSServerName,
+		MinVersion:         minVersion,
+		InsecureSkipVerify: *targetTLSInsecure,
+	})
+	if err != nil {
+		log.Fatalf("failed to configure target TLS; err: %v", err)
+	}
+	// Live connections are kept only if debug page is enabled.
+	var connRegistry *conntrack.ConnRegistry
+	if *debugConns {
+		if *adminAddr == "" {
+			log.Fatalf("--debug-conns requires --admin-listen-address")
 		}
-		targetURLs = append(targetURLs, *u)
+		connRegistry = conntrack.NewConnRegistry()
 	}
+
+	var resolver *dnscache.Resolver
+	if *targetDNSCache {
+		lookup := dnscache.NewNetLookupFunc(nil)
+		if *targetDNSServer != "" {
+			lookup = dnscache.NewDNSLookupFunc(*targetDNSServer)
+		}
+		resolver = dnscache.NewResolver(
+			lookup,
+			dnscache.NewMetrics(reg),
+			dnscache.WithMinTTL(*targetDNSCacheMinTTL),
+			dnscache.WithMaxTTL(*targetDNSCacheMaxTTL),
+			dnscache.WithMaxStale(*targetDNSCacheMaxStale),
+		)
+	}
+
+	transportOpts := []lbtransport.Option{
+		lbtransport.WithDialTimeout(*targetDialTimeout),
+		lbtransport.WithKeepAlive(*targetKeepAlive),
+		lbtransport.WithMaxIdleConns(*targetMaxIdleConns),
+		lbtransport.WithMaxIdleConnsPerHost(*targetMaxIdleConnsPerHost),
+		lbtransport.WithMaxConnsPerHost(*targetMaxConnsPerHost),
+		lbtransport.WithIdleConnTimeout(*targetIdleConnTimeout),
+		lbtransport.WithResponseHeaderTimeout(*targetResponseHeaderTimeout),
+		lbtransport.WithTLSHandshakeTimeout(*targetTLSHandshakeTimeout),
+		lbtransport.WithTLSConfigFunc(lbtransport.NewLabelsTLSConfigFunc(targetTLS)),
+		lbtransport.WithDrainTimeout(*targetDrainTimeout),
+		lbtransport.WithDialerOptions(conntrack.WithDialerConnRegistry(connRegistry, "transport")),
+		lbtransport.WithResolver(resolver),
+		lbtransport.WithWarmConnsPerTarget(*targetWarmConns),
+		lbtransport.WithMaxConnAge(*targetMaxConnAge),
+	}
+	if *targetHTTP2 {
+		transportOpts = append(transportOpts, lbtransport.WithHTTP2())
+	}
+	if *targetH2C {
+		transportOpts = append(transportOpts, lbtransport.WithH2C())
+	}
+	metricsOpts := []lbtransport.MetricsOption{lbtransport.WithMaxTargetLabelValues(*targetMetricsLimit)}
+	if *targetDialerMetrics {
+		metricsOpts = append(metricsOpts, lbtransport.WithDialerTargetLabel())
+	}
+	transport := lbtransport.NewLoadBalancingTransportWithContext(ctx, discovery, picker, lbtransport.NewMetrics(reg, metricsOpts...), transportOpts...)
+
+	var listenerOpts []conntrack.ListenerOption
+	if *proxyProtocol {
+		listenerOpts = append(listenerOpts, conntrack.WithProxyProtocol(*proxyProtocolHeaderTimeout))
+	}
+	if *maxConns > 0 {
+		var behavior conntrack.LimitBehavior
+		switch *maxConnsBehavior {
+		case "block":
+			behavior = conntrack.BlockOnLimit
+		case "reject":
+			behavior = conntrack.RejectOnLimit
+		default:
+			log.Fatalf("unknown max connections behavior %v", *maxConnsBehavior)
+		}
+		listenerOpts = append(listenerOpts, conntrack.WithMaxConnections(*maxConns, behavior))
+	}
+	if *acceptRate > 0 {
+		listenerOpts = append(listenerOpts, conntrack.WithAcceptRateLimit(*acceptRate, *acceptBurst))
+	}
+
 	// Server listen for loadbalancer.
 	{
 		mux := http.NewServeMux()
 
-		static := lbtransport.NewStaticDiscovery(targetURLs, reg)
-		picker := lbtransport.NewRoundRobinPicker(ctx, reg, *blacklistBackoff)
 		l7LoadBalancer := &httputil.ReverseProxy{
-			Director:       func(request *http.Request) {},
-			ModifyResponse: func(response *http.Response) error { return nil },
-			Transport:      lbtransport.NewLoadBalancingTransport(static, picker, lbtransport.NewMetrics(reg)),
+			Director: func(request *http.Request) {},
+			ModifyResponse: func(response *http.Response) error {
+				if *accessLog {
+					logAccess(response)
+				}
+				return nil
+			},
+			Transport:     transport,
+			FlushInterval: *flushInterval,
 		}
 
 		mux.Handle("/metrics", exthttp.NewMetricsMiddlewareHandler(
 			reg, "/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}),
 		))
 		mux.Handle("/lb", exthttp.NewMetricsMiddlewareHandler(reg, "/lb", l7LoadBalancer))
+		// gRPC calls use service method as a path (e.g /pkg.Service/Method), so they are load balanced on any path
+		// not handled above.
+		grpcLoadBalancer := exthttp.NewMetricsMiddlewareHandler(reg, "/grpc", l7LoadBalancer)
+		mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			if !exthttp.IsGRPCRequest(r) {
+				http.NotFound(w, r)
+				return
+			}
+			grpcLoadBalancer(w, r)
+		})
 
 		srv := &http.Server{Handler: mux}
+		// Accept HTTP/2 both over TLS and as cleartext h2c with prior knowledge, as used by gRPC clients.
+		srv.Protocols = &http.Protocols{}
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetHTTP2(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
 
 		l, err := net.Listen("tcp", *addr)
 		if err != nil {
 			log.Fatalf("new listener failed %v; exiting\n", err)
 		}
+		lm := conntrack.NewListenerMetrics(prometheus.WrapRegistererWith(prometheus.Labels{"listener": "lb"}, reg))
+		l = conntrack.NewInstrumentedListener(l, lm, append([]conntrack.ListenerOption{conntrack.WithListenerConnRegistry(connRegistry, "lb")}, listenerOpts...)...)
+		if *tlsRequireClientCrt && *tlsCertFiles == "" {
+			log.Fatalf("--tls-require-client-cert requires TLS to be terminated with --tls-cert-files")
+		}
+		if *tlsCertFiles != "" {
+			tlsConfig, err := newServerTLSConfig(*tlsCertFiles, *tlsKeyFiles, *tlsClientCAFile, *tlsRequireClientCrt, *tlsMinVersion)
+			if err != nil {
+				log.Fatalf("failed to configure TLS; err: %v", err)
+			}
+			l = conntrack.NewInstrumentedTLSListener(l, tlsConfig, *tlsHandshakeTimeout, lm, conntrack.WithMaxTLSHandshakes(*tlsMaxHandshakes))
+		}
+		g.Add(func() error {
+			return srv.Serve(l)
+		}, func(error) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Println("error: server shutdown failed")
+			}
+		})
+	}
+	// TCP proxy, if enabled.
+	if *tcpAddr != "" {
+		parsed, err := parseTargets(*tcpTargets)
+		if err != nil {
+			log.Fatalf("failed to parse TCP targets; err: %v", err)
+		}
+		if v := *tcpSendProxyProtocol; v != 0 && v != conntrack.ProxyProtocolV1 && v != conntrack.ProxyProtocolV2 {
+			log.Fatalf("unsupported PROXY protocol version %v", v)
+		}
+		// Round robin picker is shared with HTTP load balancer, so blacklist backoff and its metrics are the same. Admin
+		// API manages only HTTP targets, so TCP targets are drained only via drain label.
+		proxy := lbtransport.NewTCPProxy(
+			lbtransport.NewStaticDiscoveryFromTargets(parsed, prometheus.WrapRegistererWith(prometheus.Labels{"discovery": "tcp"}, reg)),
+			rrPicker,
+			lbtransport.NewTCPProxyMetrics(reg),
+			lbtransport.WithTCPDialTimeout(*targetDialTimeout),
+			lbtransport.WithTCPKeepAlive(*targetKeepAlive),
+			lbtransport.WithSendProxyProtocol(*tcpSendProxyProtocol),
+			lbtransport.WithTCPDialerOptions(conntrack.WithDialerConnRegistry(connRegistry, "tcp_proxy")),
+			lbtransport.WithTCPResolver(resolver),
+		)
+
+		l, err := net.Listen("tcp", *tcpAddr)
+		if err != nil {
+			log.Fatalf("new TCP listener failed %v; exiting\n", err)
+		}
+		g.Add(func() error {
+			return proxy.Serve(
+				conntrack.NewInstrumentedListener(
+					l,
+					conntrack.NewListenerMetrics(
+						prometheus.WrapRegistererWith(prometheus.Labels{"listener": "tcp"}, reg),
+					),
+					append([]conntrack.ListenerOption{conntrack.WithListenerConnRegistry(connRegistry, "tcp")}, listenerOpts...)...,
+				),
+			)
+		}, func(error) {
+			_ = l.Close()
+			_ = proxy.Close()
+		})
+	}
+	// Server listen for admin API, if enabled.
+	if *adminAddr != "" {
+		token, err := os.ReadFile(*adminTokenFile)
+		if err != nil {
+			log.Fatalf("failed to read admin token file %v; err: %v", *adminTokenFile, err)
+		}
+		if len(strings.TrimSpace(string(token))) == 0 {
+			log.Fatalf("admin token file %v is empty", *adminTokenFile)
+		}
+
+		api := lbadmin.New(reg, strings.TrimSpace(string(token)), discovery, primaryDiscovery, rrPicker, transport)
+		if connRegistry != nil {
+			// Live connections reveal client addresses, so they are shown only with admin token.
+			api.Handle("/debug/conns", connsHandler(connRegistry))
+		}
+		srv := &http.Server{Handler: exthttp.NewMetricsMiddlewareHandler(reg, "/admin", api)}
+
+		l, err := net.Listen("tcp", *adminAddr)
+		if err != nil {
+			log.Fatalf("new admin listener failed %v; exiting\n", err)
+		}
 		g.Add(func() error {
 			return srv.Serve(
 				conntrack.NewInstrumentedListener(
 					l,
 					conntrack.NewListenerMetrics(
-						prometheus.WrapRegistererWith(prometheus.Labels{"listener": "lb"}, reg),
+						prometheus.WrapRegistererWith(prometheus.Labels{"listener": "admin"}, reg),
 					),
+					conntrack.WithListenerConnRegistry(connRegistry, "admin"),
 				),
 			)
 		}, func(error) {
@@ -111,14 +398,14 @@ func main() {
 			defer cancel()
 
 			if err := srv.Shutdown(ctx); err != nil {
-				log.Println("error: server shutdown failed")
+				log.Println("error: admin server shutdown failed")
 			}
 		})
 	}
 	// For demo purposes.
 	lbutils.CreateDemoEndpoints(reg, g, *demo1Addr, *demo2Addr, *demo3Addr)
 
-	log.Printf("Starting loadbalancer for targets: %v/n", targetURLs)
+	log.Printf("Starting loadbalancer for targets: %v, secondary targets: %v\n", *targets, *secondaryTargets)
 	if err := g.Run(); err != nil {
 		log.Fatalf("running command failed %v; exiting\n", err)
 	}
@@ -126,6 +413,76 @@ func main() {
 	log.Println("exiting")
 }
 
+// parseTargets parses comma-separated targets in form of `<URL>[|<name>=<value>...]`.
+func parseTargets(targets string) ([]*lbtransport.Target, error) {
+	var parsed []*lbtransport.Target
+	for _, target := range strings.Split(targets, ",") {
+		if target == "" {
+			continue
+		}
+		parts := strings.Split(target, "|")
+		u, err := url.Parse(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("parse target %v: %w", target, err)
+		}
+		lset, err := parseLabels(parts[1:])
+		if err != nil {
+			return nil, fmt.Errorf("parse target %v: %w", target, err)
+		}
+		parsed = append(parsed, &lbtransport.Target{DialAddr: *u, Labels: lset})
+	}
+	return parsed, nil
+}
+
+func parseLabels(pairs []string) (lbtransport.Labels, error) {
+	var lset lbtransport.Labels
+	for _, p := range pairs {
+		if p == "" {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("label %q is not in name=value form", p)
+		}
+		if lset == nil {
+			lset = lbtransport.Labels{}
+		}
+		lset[kv[0]] = kv[1]
+	}
+	return lset, nil
+}
+
+func newServerTLSConfig(certFiles, keyFiles, clientCAFile string, requireClientCert bool, minVersion string) (*tls.Config, error) {
+	certs, keys := strings.Split(certFiles, ","), strings.Split(keyFiles, ",")
+	if len(certs) != len(keys) {
+		return nil, fmt.Errorf("got %d certificates, but %d keys", len(certs), len(keys))
+	}
+
+	v, err := exttls.ParseVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	c := exttls.ServerConfig{
+		ClientCAFile:      clientCAFile,
+		RequireClientCert: requireClientCert,
+		MinVersion:        v,
+	}
+	for i := range certs {
+		c.KeyPairs = append(c.KeyPairs, exttls.KeyPairFiles{CertFile: certs[i], KeyFile: keys[i]})
+	}
+	return exttls.NewServerTLSConfig(c)
+}
+
+func logAccess(response *http.Response) {
+	target, ok := lbtransport.TargetFromContext(response.Request.Context())
+	if !ok {
+		return
+	}
+	log.Printf("access: method=%s target=%s labels=%s code=%d\n",
+		response.Request.Method, target.DialAddr.String(), target.Labels.String(), response.StatusCode)
+}
+
 func interrupt(cancel <-chan struct{}) error {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
@@ -1,14 +1,34 @@
 module github.com/observatorium/observable-demo
 
-go 1.13
+go 1.24
 
 require (
 	github.com/fortytw2/leaktest v1.3.0
 	github.com/oklog/run v1.1.0
 	github.com/pkg/errors v0.8.1
 	github.com/prometheus/client_golang v1.3.1-0.20200109115308-803ef2a759d7 // master above v1.13.
+	github.com/prometheus/client_model v0.1.0
 	github.com/prometheus/common v0.7.0
 	github.com/prometheus/prometheus v1.8.2-0.20200107122003-4708915ac6ef
 	github.com/stretchr/testify v1.4.0
 	github.com/thanos-io/thanos v0.10.0
+	golang.org/x/net v0.35.0
+	golang.org/x/sync v0.0.0-20190911185100-cd5d95a43a6e
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash v1.1.0 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/go-kit/kit v0.9.0 // indirect
+	github.com/go-logfmt/logfmt v0.4.0 // indirect
+	github.com/golang/protobuf v1.3.2 // indirect
+	github.com/golang/snappy v0.0.1 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/oklog/ulid v1.3.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/prometheus/procfs v0.0.8 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+	gopkg.in/yaml.v2 v2.2.5 // indirect
 )
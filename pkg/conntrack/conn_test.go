@@ -0,0 +1,127 @@
+package conntrack
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/observatorium/observable-demo/pkg/memnet"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestConnTrackers_OpenLifetimeAndBytes(t *testing.T) {
+	n := memnet.New()
+	inner, err := n.Listen("tcp", "server:80")
+	testutil.Ok(t, err)
+
+	listenerMetrics := NewListenerMetrics(prometheus.NewRegistry())
+	l := NewInstrumentedListener(inner, listenerMetrics)
+	defer func() { _ = l.Close() }()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+
+	dialerMetrics := NewDialerMetrics(prometheus.NewRegistry())
+	client, err := NewInstrumentedDialContextFunc(n.DialContext, dialerMetrics)(context.Background(), "tcp", l.Addr().String())
+	testutil.Ok(t, err)
+	server := <-accepted
+
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(dialerMetrics.connOpen))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(listenerMetrics.open))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(listenerMetrics.closedTotal))
+
+	_, err = client.Write([]byte("hello"))
+	testutil.Ok(t, err)
+	_, err = io.ReadFull(server, make([]byte, 5))
+	testutil.Ok(t, err)
+	_, err = server.Write([]byte("hi"))
+	testutil.Ok(t, err)
+	_, err = io.ReadFull(client, make([]byte, 2))
+	testutil.Ok(t, err)
+
+	testutil.Equals(t, 5.0, promtestutil.ToFloat64(dialerMetrics.writtenBytesTotal))
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(dialerMetrics.readBytesTotal))
+	testutil.Equals(t, 5.0, promtestutil.ToFloat64(listenerMetrics.readBytesTotal))
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(listenerMetrics.writtenBytesTotal))
+
+	// Repeated close must be counted once.
+	for i := 0; i < 2; i++ {
+		_ = client.Close()
+		_ = server.Close()
+	}
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(dialerMetrics.connOpen))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(dialerMetrics.connClosedTotal))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(listenerMetrics.open))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(listenerMetrics.closedTotal))
+
+	// Histograms are collected as a single metric, check that lifetime was observed through the registry.
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(dialerMetrics.connLifetime, listenerMetrics.lifetime)
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(mfs))
+	for _, mf := range mfs {
+		testutil.Equals(t, uint64(1), mf.GetMetric()[0].GetHistogram().GetSampleCount())
+	}
+}
+
+func TestConnRegistry(t *testing.T) {
+	n := memnet.New()
+	inner, err := n.Listen("tcp", "server:80")
+	testutil.Ok(t, err)
+
+	registry := NewConnRegistry()
+	l := NewInstrumentedListener(inner, NewListenerMetrics(nil), WithListenerConnRegistry(registry, "lb"))
+	defer func() { _ = l.Close() }()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- conn
+	}()
+
+	dial := NewInstrumentedDialContextFunc(n.DialContext, NewDialerMetrics(nil), WithDialerConnRegistry(registry, "transport"))
+	client, err := dial(context.Background(), "tcp", l.Addr().String())
+	testutil.Ok(t, err)
+	server := <-accepted
+
+	_, err = client.Write([]byte("hello"))
+	testutil.Ok(t, err)
+	_, err = io.ReadFull(server, make([]byte, 5))
+	testutil.Ok(t, err)
+
+	conns := registry.Conns()
+	testutil.Equals(t, 2, len(conns))
+	for _, c := range conns {
+		switch c.Direction {
+		case DirectionOutbound:
+			testutil.Equals(t, "transport", c.Name)
+			testutil.Equals(t, client.LocalAddr().String(), c.LocalAddr)
+			testutil.Equals(t, l.Addr().String(), c.RemoteAddr)
+			testutil.Equals(t, uint64(5), c.WrittenBytes)
+		case DirectionInbound:
+			testutil.Equals(t, "lb", c.Name)
+			testutil.Equals(t, client.LocalAddr().String(), c.RemoteAddr)
+			testutil.Equals(t, uint64(5), c.ReadBytes)
+		default:
+			t.Fatalf("unexpected direction %v", c.Direction)
+		}
+		testutil.Assert(t, c.State != "", "state should be set")
+	}
+
+	testutil.Ok(t, client.Close())
+	testutil.Ok(t, server.Close())
+	testutil.Equals(t, 0, len(registry.Conns()))
+}
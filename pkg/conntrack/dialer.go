@@ -2,130 +2,557 @@ package conntrack
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"net"
-	"os"
+	"net/http/httptrace"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/observatorium/observable-demo/pkg/extprom"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
-	failedResolution  = "resolution"
-	failedConnRefused = "refused"
-	failedTimeout     = "timeout"
-	failedUnknown     = "unknown"
+	failedResolution       = "resolution"
+	failedConnRefused      = "refused"
+	failedConnReset        = "reset"
+	failedHostUnreachable  = "host_unreachable"
+	failedNetUnreachable   = "network_unreachable"
+	failedAddrNotAvailable = "address_not_available"
+	failedTooManyOpenFiles = "too_many_open_files"
+	failedTimeout          = "timeout"
+	failedCanceled         = "canceled"
+	failedTLSHandshake     = "tls_handshake"
+	failedUnknown          = "unknown"
 )
 
+// ErrorReasons are all reasons returned by ErrorReason.
+var ErrorReasons = []string{
+	failedResolution,
+	failedConnRefused,
+	failedConnReset,
+	failedHostUnreachable,
+	failedNetUnreachable,
+	failedAddrNotAvailable,
+	failedTooManyOpenFiles,
+	failedTimeout,
+	failedCanceled,
+	failedTLSHandshake,
+	failedUnknown,
+}
+
+// connLifetimeBuckets cover both short-lived request connections and long-lived pooled or streaming ones.
+var connLifetimeBuckets = []float64{0.01, 0.1, 1, 10, 60, 300, 900, 3600, 3 * 3600, 12 * 3600}
+
 type dialerContextFunc func(context.Context, string, string) (net.Conn, error)
 
 type DialerMetrics struct {
-	attemptedTotal       prometheus.Counter
-	connEstablishedTotal prometheus.Counter
+	attemptedTotal       *prometheus.CounterVec
+	connEstablishedTotal *prometheus.CounterVec
 	connFailedTotal      *prometheus.CounterVec
-	connClosedTotal      prometheus.Counter
+	connClosedTotal      *prometheus.CounterVec
+	connOpen             *prometheus.GaugeVec
+	connLifetime         *prometheus.HistogramVec
+	readBytesTotal       *prometheus.CounterVec
+	writtenBytesTotal    *prometheus.CounterVec
+
+	tcpInfo *tcpInfoMetrics
+
+	targetLabel   bool
+	targetLimiter *extprom.LabelLimiter
+
+	mu      sync.Mutex
+	targets map[string]*dialerTargetMetrics
+}
+
+type dialerMetricsOptions struct {
+	targetLabel   bool
+	targetLimiter *extprom.LabelLimiter
+}
+
+// DialerMetricsOption configures DialerMetrics.
+type DialerMetricsOption func(*dialerMetricsOptions)
+
+// WithTargetLabel adds `target` label with the dialed address (host:port) to dialer metrics, except TCP statistics.
+// Number of distinct targets is limited by the given limiter, targets over the limit are observed as `other`. Nil
+// limiter means no limit. Use DialerMetrics.DeleteTarget once target is gone.
+func WithTargetLabel(limiter *extprom.LabelLimiter) DialerMetricsOption {
+	return func(o *dialerMetricsOptions) {
+		o.targetLabel = true
+		o.targetLimiter = limiter
+	}
 }
 
-func NewDialerMetrics(reg prometheus.Registerer) *DialerMetrics {
+func NewDialerMetrics(reg prometheus.Registerer, opts ...DialerMetricsOption) *DialerMetrics {
+	o := dialerMetricsOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	var labels []string
+	if o.targetLabel {
+		labels = []string{"target"}
+	}
+
 	m := &DialerMetrics{
-		attemptedTotal: prometheus.NewCounter(
+		attemptedTotal: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Subsystem: "conntrack",
 				Name:      "dialer_conn_attempted_total",
 				Help:      "Total number of connections attempted by the dialer.",
-			}),
+			}, labels),
 
-		connEstablishedTotal: prometheus.NewCounter(
+		connEstablishedTotal: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Subsystem: "conntrack",
 				Name:      "dialer_conn_established_total",
 				Help:      "Total number of connections successfully established by the dialer.",
-			}),
+			}, labels),
 
 		connFailedTotal: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Subsystem: "conntrack",
 				Name:      "dialer_conn_failed_total",
 				Help:      "Total number of connections failed to dial by the dialer.",
-			}, []string{"reason"}),
+			}, append(labels, "reason")),
 
-		connClosedTotal: prometheus.NewCounter(
+		connClosedTotal: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Subsystem: "conntrack",
 				Name:      "dialer_conn_closed_total",
 				Help:      "Total number of connections closed which originated from dialer.",
-			}),
+			}, labels),
+
+		connOpen: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Subsystem: "conntrack",
+				Name:      "dialer_conn_open",
+				Help:      "Number of currently open connections which originated from dialer.",
+			}, labels),
+
+		connLifetime: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Subsystem: "conntrack",
+				Name:      "dialer_conn_lifetime_seconds",
+				Help:      "Lifetime of closed connections which originated from dialer, from established to closed.",
+				Buckets:   connLifetimeBuckets,
+			}, labels),
+
+		readBytesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem: "conntrack",
+				Name:      "dialer_conn_read_bytes_total",
+				Help:      "Total number of bytes read from connections which originated from dialer.",
+			}, labels),
+
+		writtenBytesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem: "conntrack",
+				Name:      "dialer_conn_written_bytes_total",
+				Help:      "Total number of bytes written to connections which originated from dialer.",
+			}, labels),
+
+		tcpInfo: newTCPInfoMetrics("dialer"),
+
+		targetLabel:   o.targetLabel,
+		targetLimiter: o.targetLimiter,
+		targets:       map[string]*dialerTargetMetrics{},
 	}
 
 	if reg != nil {
 		reg.MustRegister(m.attemptedTotal, m.connClosedTotal, m.connEstablishedTotal, m.connFailedTotal)
+		reg.MustRegister(m.connOpen, m.connLifetime, m.readBytesTotal, m.writtenBytesTotal)
+		reg.MustRegister(m.tcpInfo.collectors()...)
 	}
 
-	m.connFailedTotal.WithLabelValues(failedResolution)
-	m.connFailedTotal.WithLabelValues(failedConnRefused)
-	m.connFailedTotal.WithLabelValues(failedTimeout)
-	m.connFailedTotal.WithLabelValues(failedUnknown)
-
+	if !m.targetLabel {
+		// Initialise the only series.
+		m.forTarget("")
+	}
 	return m
 }
 
+// dialerTargetMetrics are dialer metrics of a single target, or of all targets if target label is disabled.
+type dialerTargetMetrics struct {
+	attemptedTotal       prometheus.Counter
+	connEstablishedTotal prometheus.Counter
+	connFailedTotal      *prometheus.CounterVec
+	connClosedTotal      prometheus.Counter
+	connOpen             prometheus.Gauge
+	connLifetime         prometheus.Observer
+	readBytesTotal       prometheus.Counter
+	writtenBytesTotal    prometheus.Counter
+
+	// Guarded by DialerMetrics.mu.
+	addr    string
+	open    int
+	deleted bool
+	// removed is set once series of the target are deleted, so connections dialed before that recreate them.
+	removed bool
+}
+
+func (m *DialerMetrics) forTarget(addr string) *dialerTargetMetrics {
+	if m.targetLabel {
+		addr = m.targetLimiter.Value(addr)
+	} else {
+		addr = ""
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.forLimitedTargetLocked(addr)
+}
+
+// forLimitedTargetLocked returns metrics of the given target, already limited by the target limiter. It has to be
+// called with mu locked.
+func (m *DialerMetrics) forLimitedTargetLocked(addr string) *dialerTargetMetrics {
+	if tm, ok := m.targets[addr]; ok {
+		// Target is back before its series were deleted.
+		tm.deleted = false
+		return tm
+	}
+
+	labels := prometheus.Labels{}
+	if m.targetLabel {
+		labels["target"] = addr
+	}
+	tm := &dialerTargetMetrics{
+		addr:                 addr,
+		attemptedTotal:       m.attemptedTotal.With(labels),
+		connEstablishedTotal: m.connEstablishedTotal.With(labels),
+		connFailedTotal:      m.connFailedTotal.MustCurryWith(labels),
+		connClosedTotal:      m.connClosedTotal.With(labels),
+		connOpen:             m.connOpen.With(labels),
+		connLifetime:         m.connLifetime.With(labels),
+		readBytesTotal:       m.readBytesTotal.With(labels),
+		writtenBytesTotal:    m.writtenBytesTotal.With(labels),
+	}
+	for _, reason := range ErrorReasons {
+		tm.connFailedTotal.WithLabelValues(reason)
+	}
+	m.targets[addr] = tm
+	return tm
+}
+
+// DeleteTarget removes all series of the given dialed address, if target label is enabled. Useful to avoid unbounded
+// cardinality when targets come and go. Series of target with open connections are removed once the last one is
+// closed, so the connections do not bring them back (e.g open connections gauge with negative value).
+func (m *DialerMetrics) DeleteTarget(addr string) {
+	if !m.targetLabel {
+		return
+	}
+
+	// Connections are counted as open under the same lock, so none can open between the check and the delete.
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if tm, ok := m.targets[addr]; ok && tm.open > 0 {
+		tm.deleted = true
+		return
+	}
+	m.deleteTargetLocked(addr)
+}
+
+// deleteTargetLocked has to be called with mu locked.
+func (m *DialerMetrics) deleteTargetLocked(addr string) {
+	if !m.targetLimiter.Forget(addr) {
+		return
+	}
+
+	if tm, ok := m.targets[addr]; ok {
+		tm.removed = true
+		delete(m.targets, addr)
+	}
+
+	m.attemptedTotal.DeleteLabelValues(addr)
+	m.connEstablishedTotal.DeleteLabelValues(addr)
+	extprom.DeleteMatching(m.connFailedTotal, m.connFailedTotal.Delete, "target", addr)
+	m.connClosedTotal.DeleteLabelValues(addr)
+	m.connOpen.DeleteLabelValues(addr)
+	m.connLifetime.DeleteLabelValues(addr)
+	m.readBytesTotal.DeleteLabelValues(addr)
+	m.writtenBytesTotal.DeleteLabelValues(addr)
+}
+
+// connOpened marks connection to the given target as open. It returns metrics the connection has to be tracked with
+// from now on, which differ from the given ones if target's series were deleted since the connection was dialed.
+func (m *DialerMetrics) connOpened(tm *dialerTargetMetrics) *dialerTargetMetrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if tm.removed {
+		tm = m.forLimitedTargetLocked(m.targetLimiter.Value(tm.addr))
+	}
+	tm.open++
+	tm.connEstablishedTotal.Inc()
+	tm.connOpen.Inc()
+	return tm
+}
+
+// connClosed marks connection to the given target as closed, deleting target's series if it was deleted meanwhile.
+func (m *DialerMetrics) connClosed(tm *dialerTargetMetrics, lifetime time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tm.connClosedTotal.Inc()
+	tm.connOpen.Dec()
+	tm.connLifetime.Observe(lifetime.Seconds())
+	tm.open--
+	if tm.open == 0 && tm.deleted {
+		m.deleteTargetLocked(tm.addr)
+	}
+}
+
+type dialerOptions struct {
+	connRegistry     *ConnRegistry
+	connRegistryName string
+}
+
+// DialerOption configures instrumented dialer.
+type DialerOption func(*dialerOptions)
+
 // NewDialContextFunc returns a `DialContext` function that tracks outbound connections.
 // The signature is compatible with `http.Tranport.DialContext` and is meant to be used there.
-func NewInstrumentedDialContextFunc(parentDialContextFunc dialerContextFunc, metrics *DialerMetrics) func(context.Context, string, string) (net.Conn, error) {
+func NewInstrumentedDialContextFunc(parentDialContextFunc dialerContextFunc, metrics *DialerMetrics, opts ...DialerOption) func(context.Context, string, string) (net.Conn, error) {
+	o := dialerOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
 	return func(ctx context.Context, ntk string, addr string) (net.Conn, error) {
-		return dialClientConnTracker(ctx, ntk, addr, metrics, parentDialContextFunc)
+		return dialClientConnTracker(ctx, ntk, addr, metrics, o, parentDialContextFunc)
 	}
 }
 
 type clientConnTracker struct {
 	net.Conn
-	connClosedTotal prometheus.Counter
+	dialerMetrics  *DialerMetrics
+	metrics        *dialerTargetMetrics
+	tcpInfoMetrics *tcpInfoMetrics
+	registry       *ConnRegistry
+
+	stats     connStats
+	tcpInfo   *tcpInfoConn
+	closeOnce sync.Once
+	// isEstablished is set once connection is counted as open. TLS handshake can close the connection (e.g on timeout)
+	// before that, and such connection must not be counted as closed.
+	isEstablished bool
 }
 
-func dialClientConnTracker(ctx context.Context, ntk string, addr string, metrics *DialerMetrics, parentDialContextFunc dialerContextFunc) (net.Conn, error) {
-	metrics.attemptedTotal.Inc()
+func newClientConnTracker(conn net.Conn, metrics *DialerMetrics, targetMetrics *dialerTargetMetrics, o dialerOptions) *clientConnTracker {
+	return &clientConnTracker{
+		Conn:           conn,
+		dialerMetrics:  metrics,
+		metrics:        targetMetrics,
+		tcpInfoMetrics: metrics.tcpInfo,
+		registry:       o.connRegistry,
+		stats:          connStats{name: o.connRegistryName, direction: DirectionOutbound, conn: conn},
+	}
+}
+
+// established marks connection as open.
+func (ct *clientConnTracker) established() {
+	ct.metrics = ct.dialerMetrics.connOpened(ct.metrics)
+	ct.stats.start = time.Now()
+	ct.tcpInfo = ct.tcpInfoMetrics.track(ct.Conn)
+	ct.registry.add(&ct.stats)
+	ct.isEstablished = true
+}
+
+func dialClientConnTracker(ctx context.Context, ntk string, addr string, metrics *DialerMetrics, o dialerOptions, parentDialContextFunc dialerContextFunc) (net.Conn, error) {
+	targetMetrics := metrics.forTarget(addr)
+	targetMetrics.attemptedTotal.Inc()
 
 	conn, err := parentDialContextFunc(ctx, ntk, addr)
 	if err != nil {
-		metrics.connFailedTotal.WithLabelValues(dialErrToReason(err)).Inc()
+		targetMetrics.connFailedTotal.WithLabelValues(ErrorReason(err)).Inc()
 		return conn, err
 	}
 
-	metrics.connEstablishedTotal.Inc()
+	tracker := newClientConnTracker(conn, metrics, targetMetrics, o)
+	tracker.established()
+	return tracker, nil
+}
 
-	return &clientConnTracker{
-		Conn:            conn,
-		connClosedTotal: metrics.connClosedTotal,
-	}, nil
-}
-
-func dialErrToReason(err error) string {
-	var e *net.OpError
-	if errors.As(err, &e) {
-		switch nestErr := e.Err.(type) {
-		case *net.DNSError:
-			return failedResolution
-		case *os.SyscallError:
-			if nestErr.Err == syscall.ECONNREFUSED {
-				return failedConnRefused
-			}
-
-			return failedUnknown
+// TLSHandshakeError is returned (wrapped in net.OpError) by instrumented TLS dialer when TLS handshake fails.
+type TLSHandshakeError struct {
+	Err error
+}
+
+func (e *TLSHandshakeError) Error() string { return "tls handshake: " + e.Err.Error() }
+
+func (e *TLSHandshakeError) Unwrap() error { return e.Err }
+
+// Timeout returns true if handshake timed out, so net.OpError wrapping the error reports it as timeout too.
+func (e *TLSHandshakeError) Timeout() bool {
+	var netErr net.Error
+	return errors.As(e.Err, &netErr) && netErr.Timeout()
+}
+
+// NewInstrumentedTLSDialContextFunc returns a `DialTLSContext` function that tracks outbound TLS connections.
+// Connection is established only once TLS handshake succeeds, handshake failures are tracked with separate reason.
+// The signature is compatible with `http.Transport.DialTLSContext` and is meant to be used there.
+func NewInstrumentedTLSDialContextFunc(
+	parentDialContextFunc dialerContextFunc,
+	tlsConfigFunc func(ctx context.Context, addr string) (*tls.Config, error),
+	handshakeTimeout time.Duration,
+	metrics *DialerMetrics,
+	opts ...DialerOption,
+) func(context.Context, string, string) (net.Conn, error) {
+	o := dialerOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return func(ctx context.Context, ntk string, addr string) (net.Conn, error) {
+		cfg, err := tlsConfigFunc(ctx, addr)
+		if err != nil {
+			return nil, err
 		}
+		return dialTLSClientConnTracker(ctx, ntk, addr, cfg, handshakeTimeout, metrics, o, parentDialContextFunc)
+	}
+}
+
+func dialTLSClientConnTracker(
+	ctx context.Context,
+	ntk string,
+	addr string,
+	cfg *tls.Config,
+	handshakeTimeout time.Duration,
+	metrics *DialerMetrics,
+	o dialerOptions,
+	parentDialContextFunc dialerContextFunc,
+) (net.Conn, error) {
+	targetMetrics := metrics.forTarget(addr)
+	targetMetrics.attemptedTotal.Inc()
+
+	conn, err := parentDialContextFunc(ctx, ntk, addr)
+	if err != nil {
+		targetMetrics.connFailedTotal.WithLabelValues(ErrorReason(err)).Inc()
+		return conn, err
+	}
 
-		if e.Timeout() {
-			return failedTimeout
+	if cfg.ServerName == "" && !cfg.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
 		}
-	} else if err == context.Canceled || err == context.DeadlineExceeded {
-		return failedTimeout
+		cfg = cfg.Clone()
+		cfg.ServerName = host
+	}
+
+	tracker := newClientConnTracker(conn, metrics, targetMetrics, o)
+	tlsConn := tls.Client(tracker, cfg)
+
+	if handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, handshakeTimeout)
+		defer cancel()
+	}
+	// http.Transport reports handshakes to client trace only if it does them on its own.
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	err = tlsConn.HandshakeContext(ctx)
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(tlsConn.ConnectionState(), err)
+	}
+	if err != nil {
+		// Close underlying connection, as from tracker perspective it was never established.
+		_ = conn.Close()
+
+		err = &net.OpError{Op: "dial", Net: ntk, Source: conn.LocalAddr(), Addr: conn.RemoteAddr(), Err: &TLSHandshakeError{Err: err}}
+		targetMetrics.connFailedTotal.WithLabelValues(ErrorReason(err)).Inc()
+		return nil, err
 	}
 
+	tracker.established()
+	return tlsConn, nil
+}
+
+// ErrorReason classifies dial or connection error to a short reason, e.g `refused` or `tls_handshake`, meant to be used as
+// a metric label. Cancellation of the context is reported as `canceled`, separately from deadlines and I/O timeouts.
+// Errors that are not recognized are reported as `unknown`.
+func ErrorReason(err error) string {
+	var (
+		dnsErr *net.DNSError
+		tlsErr *TLSHandshakeError
+		netErr net.Error
+	)
+	switch {
+	case err == nil:
+		return failedUnknown
+	case errors.As(err, &dnsErr):
+		return failedResolution
+	// Handshakes that are canceled or time out are reported as such, not as TLS handshake failures.
+	case errors.Is(err, context.Canceled):
+		return failedCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return failedTimeout
+	case errors.As(err, &tlsErr), isTLSError(err):
+		return failedTLSHandshake
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return failedConnRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED), errors.Is(err, syscall.EPIPE):
+		return failedConnReset
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return failedHostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH):
+		return failedNetUnreachable
+	case errors.Is(err, syscall.EADDRNOTAVAIL):
+		// Usually ephemeral port exhaustion.
+		return failedAddrNotAvailable
+	case errors.Is(err, syscall.EMFILE), errors.Is(err, syscall.ENFILE):
+		return failedTooManyOpenFiles
+	}
 	return failedUnknown
 }
 
+// isTLSError returns true for errors of TLS handshakes done outside of instrumented TLS dialer, e.g by http.Transport.
+func isTLSError(err error) bool {
+	var (
+		recordErr tls.RecordHeaderError
+		alertErr  tls.AlertError
+		verifyErr *tls.CertificateVerificationError
+		authErr   x509.UnknownAuthorityError
+		hostErr   x509.HostnameError
+		certErr   x509.CertificateInvalidError
+	)
+	return errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &authErr) || errors.As(err, &hostErr) || errors.As(err, &certErr)
+}
+
+func (ct *clientConnTracker) Read(b []byte) (int, error) {
+	n, err := ct.Conn.Read(b)
+	ct.metrics.readBytesTotal.Add(float64(n))
+	ct.stats.readBytes.Add(uint64(n))
+	return n, err
+}
+
+func (ct *clientConnTracker) Write(b []byte) (int, error) {
+	n, err := ct.Conn.Write(b)
+	ct.metrics.writtenBytesTotal.Add(float64(n))
+	ct.stats.writtenBytes.Add(uint64(n))
+	return n, err
+}
+
+// NetConn returns the underlying connection, so wrapped connections can be inspected by users of the dialer.
+func (ct *clientConnTracker) NetConn() net.Conn {
+	return ct.Conn
+}
+
+// Close closes the connection. Connection is counted as closed only once, no matter how many times Close is called.
 func (ct *clientConnTracker) Close() error {
+	// TCP statistics are sampled for the last time while socket is still open.
+	ct.tcpInfo.close()
 	err := ct.Conn.Close()
-	ct.connClosedTotal.Inc()
-
+	ct.closeOnce.Do(func() {
+		if !ct.isEstablished {
+			return
+		}
+		ct.registry.remove(&ct.stats)
+		ct.dialerMetrics.connClosed(ct.metrics, time.Since(ct.stats.start))
+	})
 	return err
 }
@@ -0,0 +1,248 @@
+package conntrack
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/observatorium/observable-demo/pkg/extprom"
+	"github.com/observatorium/observable-demo/pkg/faultnet"
+	"github.com/observatorium/observable-demo/pkg/memnet"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestErrorReason(t *testing.T) {
+	dialErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+
+	for _, tcase := range []struct {
+		err      error
+		expected string
+	}{
+		{err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}, expected: "resolution"},
+		{err: dialErr(syscall.ECONNREFUSED), expected: "refused"},
+		{err: &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, expected: "reset"},
+		{err: dialErr(syscall.EHOSTUNREACH), expected: "host_unreachable"},
+		{err: dialErr(syscall.ENETUNREACH), expected: "network_unreachable"},
+		{err: dialErr(syscall.EADDRNOTAVAIL), expected: "address_not_available"},
+		{err: &net.OpError{Op: "dial", Err: os.NewSyscallError("socket", syscall.EMFILE)}, expected: "too_many_open_files"},
+		{err: &net.OpError{Op: "dial", Err: &TLSHandshakeError{Err: errors.New("bad certificate")}}, expected: "tls_handshake"},
+		{err: &url.Error{Op: "Get", Err: &tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}}, expected: "tls_handshake"},
+		{err: &net.OpError{Op: "dial", Err: &TLSHandshakeError{Err: context.DeadlineExceeded}}, expected: "timeout"},
+		{err: &net.OpError{Op: "dial", Err: &TLSHandshakeError{Err: &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}}}, expected: "timeout"},
+		{err: &net.OpError{Op: "dial", Err: &TLSHandshakeError{Err: context.Canceled}}, expected: "canceled"},
+		{err: context.DeadlineExceeded, expected: "timeout"},
+		{err: &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, expected: "timeout"},
+		{err: context.Canceled, expected: "canceled"},
+		{err: &net.OpError{Op: "dial", Err: context.Canceled}, expected: "canceled"},
+		{err: errors.New("test"), expected: "unknown"},
+	} {
+		t.Run(tcase.err.Error(), func(t *testing.T) {
+			reason := ErrorReason(tcase.err)
+			testutil.Equals(t, tcase.expected, reason)
+			testutil.Assert(t, contains(ErrorReasons, reason), "reason %v should be listed in ErrorReasons", reason)
+		})
+	}
+}
+
+func TestErrorReason_CanceledDial(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := (&net.Dialer{}).DialContext(ctx, "tcp", "127.0.0.1:1")
+	testutil.NotOk(t, err)
+	testutil.Equals(t, "canceled", ErrorReason(err))
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDialerMetrics_TargetLabel(t *testing.T) {
+	n := memnet.New()
+	l, err := n.Listen("tcp", "a:80")
+	testutil.Ok(t, err)
+	defer func() { _ = l.Close() }()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	reg := prometheus.NewRegistry()
+	metrics := NewDialerMetrics(reg, WithTargetLabel(extprom.NewLabelLimiter(reg, "dialer_target", 1)))
+	dial := NewInstrumentedDialContextFunc(n.DialContext, metrics)
+
+	conn, err := dial(context.Background(), "tcp", l.Addr().String())
+	testutil.Ok(t, err)
+	testutil.Ok(t, conn.Close())
+
+	// Second target is over the limit.
+	_, err = dial(context.Background(), "tcp", "b:80")
+	testutil.NotOk(t, err)
+
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.connEstablishedTotal.WithLabelValues(l.Addr().String())))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.connFailedTotal.WithLabelValues(extprom.OtherValue, "refused")))
+	// Every reason is initialised per target.
+	testutil.Equals(t, 2*len(ErrorReasons), promtestutil.CollectAndCount(metrics.connFailedTotal))
+
+	metrics.DeleteTarget(l.Addr().String())
+	testutil.Equals(t, 1, promtestutil.CollectAndCount(metrics.connEstablishedTotal))
+	testutil.Equals(t, len(ErrorReasons), promtestutil.CollectAndCount(metrics.connFailedTotal))
+}
+
+func TestDialerMetrics_DeleteTargetWithOpenConns(t *testing.T) {
+	n := memnet.New()
+	l, err := n.Listen("tcp", "a:80")
+	testutil.Ok(t, err)
+	defer func() { _ = l.Close() }()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+
+	metrics := NewDialerMetrics(nil, WithTargetLabel(nil))
+	dial := NewInstrumentedDialContextFunc(n.DialContext, metrics)
+
+	conn, err := dial(context.Background(), "tcp", l.Addr().String())
+	testutil.Ok(t, err)
+
+	// Series are kept while connection is open, so its close is not lost.
+	metrics.DeleteTarget(l.Addr().String())
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.connOpen.WithLabelValues(l.Addr().String())))
+
+	testutil.Ok(t, conn.Close())
+	testutil.Equals(t, 0, promtestutil.CollectAndCount(metrics.connOpen))
+	testutil.Equals(t, 0, promtestutil.CollectAndCount(metrics.connClosedTotal))
+}
+
+func TestDialerMetrics_DeleteTargetWhileDialing(t *testing.T) {
+	n := memnet.New()
+	l, err := n.Listen("tcp", "a:80")
+	testutil.Ok(t, err)
+	defer func() { _ = l.Close() }()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+
+	metrics := NewDialerMetrics(nil, WithTargetLabel(nil))
+	// Target is deleted after the dial started, but before the connection is established.
+	dial := NewInstrumentedDialContextFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		metrics.DeleteTarget(addr)
+		return n.DialContext(ctx, network, addr)
+	}, metrics)
+
+	conn, err := dial(context.Background(), "tcp", l.Addr().String())
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.connOpen.WithLabelValues(l.Addr().String())))
+
+	testutil.Ok(t, conn.Close())
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.connOpen.WithLabelValues(l.Addr().String())))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.connClosedTotal.WithLabelValues(l.Addr().String())))
+}
+
+func TestInstrumentedDialer_InjectedFaults(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	defer func() { _ = l.Close() }()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+
+	metrics := NewDialerMetrics(nil)
+	// Every second dial is refused and every read resets the connection.
+	faults := faultnet.New(faultnet.WithRefuseEvery(2), faultnet.WithReset(1))
+	dial := NewInstrumentedDialContextFunc(faults.DialContextFunc((&net.Dialer{}).DialContext), metrics)
+
+	conn, err := dial(context.Background(), "tcp", l.Addr().String())
+	testutil.Ok(t, err)
+	_, err = dial(context.Background(), "tcp", l.Addr().String())
+	testutil.Equals(t, "refused", ErrorReason(err))
+
+	_, err = conn.Read(make([]byte, 1))
+	testutil.Equals(t, "reset", ErrorReason(err))
+	// Connection is already closed by the reset, but tracker counts it as closed only once closed by the user.
+	_ = conn.Close()
+
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.connEstablishedTotal.WithLabelValues()))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.connFailedTotal.WithLabelValues("refused")))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.connClosedTotal.WithLabelValues()))
+}
+
+func TestInstrumentedTLSDialer_HandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	defer func() { _ = l.Close() }()
+	// Server accepts connections, but never answers TLS handshake.
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer func() { _ = conn.Close() }()
+		}
+	}()
+
+	metrics := NewDialerMetrics(nil)
+	dial := NewInstrumentedTLSDialContextFunc(
+		(&net.Dialer{}).DialContext,
+		func(context.Context, string) (*tls.Config, error) { return &tls.Config{InsecureSkipVerify: true}, nil },
+		50*time.Millisecond,
+		metrics,
+	)
+
+	_, err = dial(context.Background(), "tcp", l.Addr().String())
+	testutil.NotOk(t, err)
+	// Timed out handshake is reported as timeout, not as TLS failure e.g bad certificate.
+	testutil.Equals(t, "timeout", ErrorReason(err))
+
+	// Connection closed by timed out handshake was never established, so it is not counted as open or closed.
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.connFailedTotal.WithLabelValues("timeout")))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.connEstablishedTotal.WithLabelValues()))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.connOpen.WithLabelValues()))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.connClosedTotal.WithLabelValues()))
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(metrics.connLifetime)
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(mfs))
+	testutil.Equals(t, uint64(0), mfs[0].GetMetric()[0].GetHistogram().GetSampleCount())
+}
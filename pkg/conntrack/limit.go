@@ -0,0 +1,146 @@
+package conntrack
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	queuedLimit = "limit"
+	queuedRate  = "rate"
+)
+
+// LimitBehavior defines what listener does once the maximum number of concurrent connections is reached.
+type LimitBehavior int
+
+const (
+	// BlockOnLimit makes Accept wait until any connection is closed. New connections wait in the kernel backlog.
+	BlockOnLimit LimitBehavior = iota
+	// RejectOnLimit makes listener accept new connections and close them immediately.
+	RejectOnLimit
+)
+
+// WithMaxConnections limits number of concurrent connections of the listener to n. Zero means no limit. Connections
+// over the limit are handled according to the given behavior.
+func WithMaxConnections(n int, behavior LimitBehavior) ListenerOption {
+	return func(o *listenerOptions) {
+		o.maxConns = n
+		o.limitBehavior = behavior
+	}
+}
+
+// WithAcceptRateLimit limits rate of accepted connections to the given number per second, with bursts of up to burst
+// connections. Accept waits once the rate is exceeded. Zero rate means no limit.
+func WithAcceptRateLimit(perSecond float64, burst int) ListenerOption {
+	return func(o *listenerOptions) {
+		o.acceptRate = perSecond
+		o.acceptBurst = burst
+	}
+}
+
+// connLimiter limits number of concurrent connections.
+type connLimiter struct {
+	slots   chan struct{}
+	used    int64
+	metrics *ListenerMetrics
+}
+
+func newConnLimiter(max int, metrics *ListenerMetrics) *connLimiter {
+	metrics.connLimit.Set(float64(max))
+	return &connLimiter{slots: make(chan struct{}, max), metrics: metrics}
+}
+
+// acquire waits for free slot until done is closed. It returns false if done was closed first.
+func (l *connLimiter) acquire(done <-chan struct{}) bool {
+	if l.tryAcquire() {
+		return true
+	}
+
+	l.metrics.queuedTotal.WithLabelValues(queuedLimit).Inc()
+	select {
+	case l.slots <- struct{}{}:
+		l.update(1)
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (l *connLimiter) tryAcquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		l.update(1)
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *connLimiter) release() {
+	<-l.slots
+	l.update(-1)
+}
+
+func (l *connLimiter) update(delta int64) {
+	used := atomic.AddInt64(&l.used, delta)
+	l.metrics.connLimitUtilization.Set(float64(used) / float64(cap(l.slots)))
+}
+
+// acceptRateLimiter is a token bucket limiting rate of accepts, implemented as generic cell rate algorithm.
+type acceptRateLimiter struct {
+	interval time.Duration
+	burst    int
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func newAcceptRateLimiter(perSecond float64, burst int) *acceptRateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &acceptRateLimiter{interval: time.Duration(float64(time.Second) / perSecond), burst: burst}
+}
+
+// reserve reserves the next accept and returns how long to wait before it is allowed.
+func (r *acceptRateLimiter) reserve(now time.Time) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.next.Before(now) {
+		r.next = now
+	}
+	wait := r.next.Sub(now) - time.Duration(r.burst-1)*r.interval
+	r.next = r.next.Add(r.interval)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// waitForAccept waits until the next accept is allowed by rate and connection limit. It returns release function of
+// acquired connection slot (nil if connections are not limited in blocking mode), or error if listener was closed.
+func (ct *connTrackListener) waitForAccept() (release func(), err error) {
+	if ct.rate != nil {
+		if wait := ct.rate.reserve(time.Now()); wait > 0 {
+			ct.metrics.queuedTotal.WithLabelValues(queuedRate).Inc()
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-ct.done:
+				t.Stop()
+				return nil, net.ErrClosed
+			}
+		}
+	}
+
+	if ct.limiter == nil || ct.opts.limitBehavior != BlockOnLimit {
+		return nil, nil
+	}
+	if !ct.limiter.acquire(ct.done) {
+		return nil, net.ErrClosed
+	}
+	return ct.limiter.release, nil
+}
@@ -0,0 +1,135 @@
+package conntrack
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestListener_MaxConnections(t *testing.T) {
+	t.Run("block", func(t *testing.T) {
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		testutil.Ok(t, err)
+
+		metrics := NewListenerMetrics(nil)
+		l := NewInstrumentedListener(inner, metrics, WithMaxConnections(1, BlockOnLimit))
+
+		c1, err := net.Dial("tcp", l.Addr().String())
+		testutil.Ok(t, err)
+		defer func() { _ = c1.Close() }()
+		c2, err := net.Dial("tcp", l.Addr().String())
+		testutil.Ok(t, err)
+		defer func() { _ = c2.Close() }()
+
+		s1, err := l.Accept()
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.connLimit))
+		testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.connLimitUtilization))
+
+		accepted := make(chan net.Conn)
+		go func() {
+			s2, err := l.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- s2
+		}()
+
+		select {
+		case <-accepted:
+			t.Fatal("second connection should wait for free slot")
+		case <-time.After(100 * time.Millisecond):
+		}
+		testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.queuedTotal.WithLabelValues(queuedLimit)))
+
+		testutil.Ok(t, s1.Close())
+		s2 := <-accepted
+		testutil.Assert(t, s2 != nil, "second connection should be accepted once slot is free")
+		testutil.Ok(t, s2.Close())
+		testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.connLimitUtilization))
+
+		// Accept waiting for slot is unblocked by Close.
+		s3, err := net.Dial("tcp", l.Addr().String())
+		testutil.Ok(t, err)
+		defer func() { _ = s3.Close() }()
+		s4, err := l.Accept()
+		testutil.Ok(t, err)
+		defer func() { _ = s4.Close() }()
+
+		errs := make(chan error)
+		go func() {
+			_, err := l.Accept()
+			errs <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		testutil.Ok(t, l.Close())
+		testutil.Assert(t, errors.Is(<-errs, net.ErrClosed), "expected closed listener error")
+	})
+	t.Run("reject", func(t *testing.T) {
+		inner, err := net.Listen("tcp", "127.0.0.1:0")
+		testutil.Ok(t, err)
+
+		metrics := NewListenerMetrics(nil)
+		l := NewInstrumentedListener(inner, metrics, WithMaxConnections(1, RejectOnLimit))
+		defer func() { _ = l.Close() }()
+
+		c1, err := net.Dial("tcp", l.Addr().String())
+		testutil.Ok(t, err)
+		defer func() { _ = c1.Close() }()
+		s1, err := l.Accept()
+		testutil.Ok(t, err)
+
+		c2, err := net.Dial("tcp", l.Addr().String())
+		testutil.Ok(t, err)
+		defer func() { _ = c2.Close() }()
+		c3, err := net.Dial("tcp", l.Addr().String())
+		testutil.Ok(t, err)
+		defer func() { _ = c3.Close() }()
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			s, err := l.Accept()
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- s
+		}()
+
+		// Second connection is closed by listener.
+		testutil.Ok(t, c2.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, err = c2.Read(make([]byte, 1))
+		testutil.Equals(t, io.EOF, err)
+		testutil.Ok(t, s1.Close())
+
+		// Third connection may be rejected as well if it was accepted before the first one was closed.
+		select {
+		case s := <-accepted:
+			testutil.Ok(t, s.Close())
+		case <-time.After(100 * time.Millisecond):
+		}
+		testutil.Assert(t, promtestutil.ToFloat64(metrics.rejectedTotal) >= 1, "expected rejected connections")
+	})
+}
+
+func TestAcceptRateLimiter(t *testing.T) {
+	r := newAcceptRateLimiter(10, 2)
+	now := time.Unix(0, 0)
+
+	testutil.Equals(t, time.Duration(0), r.reserve(now))
+	testutil.Equals(t, time.Duration(0), r.reserve(now))
+	testutil.Equals(t, 100*time.Millisecond, r.reserve(now))
+	testutil.Equals(t, 200*time.Millisecond, r.reserve(now))
+
+	// Tokens refill over time up to the burst.
+	now = now.Add(time.Second)
+	testutil.Equals(t, time.Duration(0), r.reserve(now))
+	testutil.Equals(t, time.Duration(0), r.reserve(now))
+	testutil.Equals(t, 100*time.Millisecond, r.reserve(now))
+}
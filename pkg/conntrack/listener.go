@@ -3,7 +3,12 @@
 package conntrack
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -13,6 +18,23 @@ type ListenerMetrics struct {
 	acceptedTotal      prometheus.Counter
 	failedAcceptsTotal prometheus.Counter
 	closedTotal        prometheus.Counter
+	open               prometheus.Gauge
+	lifetime           prometheus.Histogram
+	readBytesTotal     prometheus.Counter
+	writtenBytesTotal  prometheus.Counter
+
+	tlsHandshakesTotal      prometheus.Counter
+	tlsHandshakeFailedTotal *prometheus.CounterVec
+
+	proxyProtocolHeadersTotal *prometheus.CounterVec
+	proxyProtocolFailedTotal  *prometheus.CounterVec
+
+	rejectedTotal        prometheus.Counter
+	queuedTotal          *prometheus.CounterVec
+	connLimit            prometheus.Gauge
+	connLimitUtilization prometheus.Gauge
+
+	tcpInfo *tcpInfoMetrics
 }
 
 func NewListenerMetrics(reg prometheus.Registerer) *ListenerMetrics {
@@ -36,74 +58,446 @@ func NewListenerMetrics(reg prometheus.Registerer) *ListenerMetrics {
 				Name:      "listener_conn_closed_total",
 				Help:      "Total number of connections closed that were made to the listener.",
 			}),
+		open: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Subsystem: "conntrack",
+				Name:      "listener_conn_open",
+				Help:      "Number of currently open connections made to the listener.",
+			}),
+		lifetime: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Subsystem: "conntrack",
+				Name:      "listener_conn_lifetime_seconds",
+				Help:      "Lifetime of closed connections made to the listener, from accepted to closed.",
+				Buckets:   connLifetimeBuckets,
+			}),
+		readBytesTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Subsystem: "conntrack",
+				Name:      "listener_conn_read_bytes_total",
+				Help:      "Total number of bytes read from connections made to the listener.",
+			}),
+		writtenBytesTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Subsystem: "conntrack",
+				Name:      "listener_conn_written_bytes_total",
+				Help:      "Total number of bytes written to connections made to the listener.",
+			}),
+
+		tlsHandshakesTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Subsystem: "conntrack",
+				Name:      "listener_tls_handshakes_total",
+				Help:      "Total number of successful TLS handshakes of connections made to the listener.",
+			}),
+		tlsHandshakeFailedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem: "conntrack",
+				Name:      "listener_tls_handshake_failed_total",
+				Help:      "Total number of failed TLS handshakes of connections made to the listener, by reason (timeout or other e.g bad certificate).",
+			}, []string{"reason"}),
+
+		proxyProtocolHeadersTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem: "conntrack",
+				Name:      "listener_proxy_protocol_headers_total",
+				Help:      "Total number of successfully parsed PROXY protocol headers of connections made to the listener.",
+			}, []string{"version"}),
+		proxyProtocolFailedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem: "conntrack",
+				Name:      "listener_proxy_protocol_failed_total",
+				Help:      "Total number of connections made to the listener which PROXY protocol header could not be parsed.",
+			}, []string{"reason"}),
+
+		rejectedTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Subsystem: "conntrack",
+				Name:      "listener_conn_rejected_total",
+				Help:      "Total number of connections closed right after accept, because the listener connection limit was reached.",
+			}),
+		queuedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem: "conntrack",
+				Name:      "listener_accept_queued_total",
+				Help:      "Total number of accepts delayed, because the listener connection limit (reason=limit) or accept rate limit (reason=rate) was reached.",
+			}, []string{"reason"}),
+		connLimit: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Subsystem: "conntrack",
+				Name:      "listener_conn_limit",
+				Help:      "Maximum number of concurrent connections of the listener. Zero means no limit.",
+			}),
+		connLimitUtilization: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Subsystem: "conntrack",
+				Name:      "listener_conn_limit_utilization",
+				Help:      "Ratio of open connections to the maximum number of concurrent connections of the listener.",
+			}),
+
+		tcpInfo: newTCPInfoMetrics("listener"),
 	}
 
 	if reg != nil {
-		reg.MustRegister(m.acceptedTotal, m.closedTotal)
+		reg.MustRegister(m.acceptedTotal, m.failedAcceptsTotal, m.closedTotal, m.open, m.lifetime, m.readBytesTotal, m.writtenBytesTotal)
+		reg.MustRegister(m.tlsHandshakesTotal, m.tlsHandshakeFailedTotal, m.proxyProtocolHeadersTotal, m.proxyProtocolFailedTotal)
+		reg.MustRegister(m.rejectedTotal, m.queuedTotal, m.connLimit, m.connLimitUtilization)
+		reg.MustRegister(m.tcpInfo.collectors()...)
 	}
 
+	m.proxyProtocolHeadersTotal.WithLabelValues(strconv.Itoa(ProxyProtocolV1))
+	m.proxyProtocolHeadersTotal.WithLabelValues(strconv.Itoa(ProxyProtocolV2))
+	m.proxyProtocolFailedTotal.WithLabelValues(failedProxyProtocolInvalid)
+	m.proxyProtocolFailedTotal.WithLabelValues(failedProxyProtocolTimeout)
+	m.tlsHandshakeFailedTotal.WithLabelValues(failedTLSHandshakeTimeout)
+	m.tlsHandshakeFailedTotal.WithLabelValues(failedTLSHandshakeOther)
+	m.queuedTotal.WithLabelValues(queuedLimit)
+	m.queuedTotal.WithLabelValues(queuedRate)
+
 	return m
 }
 
 type connTrackListener struct {
 	net.Listener
 	metrics *ListenerMetrics
+	opts    listenerOptions
+
+	limiter *connLimiter
+	rate    *acceptRateLimiter
+
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+type listenerOptions struct {
+	proxyProtocol              bool
+	proxyProtocolHeaderTimeout time.Duration
+
+	connRegistry     *ConnRegistry
+	connRegistryName string
+
+	maxConns      int
+	limitBehavior LimitBehavior
+	acceptRate    float64
+	acceptBurst   int
+}
+
+// ListenerOption configures instrumented listener.
+type ListenerOption func(*listenerOptions)
+
+// WithProxyProtocol makes listener require PROXY protocol (v1 or v2) header on every connection, so the real client
+// address is known when listener is behind another L4 load balancer. Connection RemoteAddr and LocalAddr return
+// addresses from the header. Header is read on first read or address lookup; reads of connections with invalid
+// header or header not received within the given timeout (zero means no timeout) fail with ProxyProtocolError.
+func WithProxyProtocol(headerTimeout time.Duration) ListenerOption {
+	return func(o *listenerOptions) {
+		o.proxyProtocol = true
+		o.proxyProtocolHeaderTimeout = headerTimeout
+	}
 }
 
 // NewInstrumentedListener returns the given listener wrapped in connection listener exposing Prometheus metric.
-func NewInstrumentedListener(inner net.Listener, metrics *ListenerMetrics) net.Listener {
-	return &connTrackListener{
+func NewInstrumentedListener(inner net.Listener, metrics *ListenerMetrics, opts ...ListenerOption) net.Listener {
+	l := &connTrackListener{
 		Listener: inner,
 		metrics:  metrics,
+		done:     make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(&l.opts)
+	}
+	if l.opts.maxConns > 0 {
+		l.limiter = newConnLimiter(l.opts.maxConns, metrics)
+	}
+	if l.opts.acceptRate > 0 {
+		l.rate = newAcceptRateLimiter(l.opts.acceptRate, l.opts.acceptBurst)
 	}
+	return l
 }
 
 func (ct *connTrackListener) Accept() (net.Conn, error) {
-	var (
-		conn net.Conn
-		err  error
-	)
+	for {
+		release, err := ct.waitForAccept()
+		if err != nil {
+			return nil, err
+		}
 
-	conn, err = ct.Listener.Accept()
-	if err != nil {
-		ct.metrics.failedAcceptsTotal.Inc()
-		return nil, err
+		conn, err := ct.Listener.Accept()
+		if err != nil {
+			if release != nil {
+				release()
+			}
+			ct.metrics.failedAcceptsTotal.Inc()
+			return nil, err
+		}
+
+		if ct.limiter != nil && release == nil {
+			if !ct.limiter.tryAcquire() {
+				ct.metrics.rejectedTotal.Inc()
+				_ = conn.Close()
+				continue
+			}
+			release = ct.limiter.release
+		}
+		return ct.track(conn, release)
 	}
+}
 
+func (ct *connTrackListener) track(conn net.Conn, release func()) (net.Conn, error) {
 	if tcpConn, ok := conn.(*net.TCPConn); ok {
 		if err := tcpConn.SetKeepAlive(true); err != nil {
+			if release != nil {
+				release()
+			}
 			return nil, err
 		}
 
 		if err := tcpConn.SetKeepAlivePeriod(5 * time.Minute); err != nil {
+			if release != nil {
+				release()
+			}
 			return nil, err
 		}
 	}
 
 	ct.metrics.acceptedTotal.Inc()
 
-	return newServerConnTracker(conn, ct.metrics.closedTotal), nil
+	st := newServerConnTracker(conn, ct.metrics, ct.opts, release)
+	if !ct.opts.proxyProtocol {
+		return st, nil
+	}
+	pc := newProxyProtocolConn(st, ct.opts.proxyProtocolHeaderTimeout, ct.metrics)
+	st.stats.proxied.Store(pc)
+	return pc, nil
+}
+
+// Close closes the listener. Accept waiting for connection slot or accept rate limit returns net.ErrClosed.
+func (ct *connTrackListener) Close() error {
+	ct.doneOnce.Do(func() { close(ct.done) })
+	return ct.Listener.Close()
 }
 
 type serverConnTracker struct {
 	net.Conn
-	closedTotal prometheus.Counter
+	metrics  *ListenerMetrics
+	registry *ConnRegistry
+
+	stats     connStats
+	tcpInfo   *tcpInfoConn
+	release   func()
+	closeOnce sync.Once
 }
 
-func newServerConnTracker(inner net.Conn, closedTotal prometheus.Counter) net.Conn {
-	tracker := &serverConnTracker{
-		Conn:        inner,
-		closedTotal: closedTotal,
+// newServerConnTracker returns tracked connection. Release function, if any, is called once connection is closed.
+func newServerConnTracker(inner net.Conn, metrics *ListenerMetrics, o listenerOptions, release func()) *serverConnTracker {
+	metrics.open.Inc()
+	st := &serverConnTracker{
+		Conn:     inner,
+		metrics:  metrics,
+		registry: o.connRegistry,
+		stats:    connStats{name: o.connRegistryName, direction: DirectionInbound, conn: inner, start: time.Now()},
+		tcpInfo:  metrics.tcpInfo.track(inner),
+		release:  release,
 	}
+	st.registry.add(&st.stats)
+	return st
+}
+
+func (st *serverConnTracker) Read(b []byte) (int, error) {
+	n, err := st.Conn.Read(b)
+	st.metrics.readBytesTotal.Add(float64(n))
+	st.stats.readBytes.Add(uint64(n))
+	return n, err
+}
 
-	closedTotal.Inc()
+func (st *serverConnTracker) Write(b []byte) (int, error) {
+	n, err := st.Conn.Write(b)
+	st.metrics.writtenBytesTotal.Add(float64(n))
+	st.stats.writtenBytes.Add(uint64(n))
+	return n, err
+}
 
-	return tracker
+// NetConn returns the underlying connection, e.g so it can be half-closed.
+func (st *serverConnTracker) NetConn() net.Conn {
+	return st.Conn
 }
 
+// Close closes the connection. Connection is counted as closed only once, no matter how many times Close is called.
 func (st *serverConnTracker) Close() error {
+	// TCP statistics are sampled for the last time while socket is still open.
+	st.tcpInfo.close()
 	err := st.Conn.Close()
-	st.closedTotal.Inc()
-
+	st.closeOnce.Do(func() {
+		st.registry.remove(&st.stats)
+		st.metrics.closedTotal.Inc()
+		st.metrics.open.Dec()
+		st.metrics.lifetime.Observe(time.Since(st.stats.start).Seconds())
+		if st.release != nil {
+			st.release()
+		}
+	})
 	return err
 }
+
+// Reasons of failed TLS handshakes of listener connections.
+const (
+	failedTLSHandshakeTimeout = "timeout"
+	failedTLSHandshakeOther   = "other"
+)
+
+// DefaultMaxTLSHandshakes is the default maximum number of concurrent TLS handshakes of instrumented TLS listener.
+const DefaultMaxTLSHandshakes = 256
+
+type tlsListener struct {
+	inner            net.Listener
+	config           *tls.Config
+	handshakeTimeout time.Duration
+	metrics          *ListenerMetrics
+
+	// handshakeSlots limits number of concurrent handshakes.
+	handshakeSlots chan struct{}
+
+	ready    chan net.Conn
+	errs     chan error
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+type tlsListenerOptions struct {
+	maxHandshakes int
+}
+
+// TLSListenerOption configures instrumented TLS listener.
+type TLSListenerOption func(*tlsListenerOptions)
+
+// WithMaxTLSHandshakes limits number of concurrent TLS handshakes to n. Once reached, no connections are accepted until
+// some handshake finishes, so a burst of slow or malicious clients waits in the listen backlog instead of piling up
+// goroutines. Zero or less means DefaultMaxTLSHandshakes. Default: DefaultMaxTLSHandshakes.
+func WithMaxTLSHandshakes(n int) TLSListenerOption {
+	return func(o *tlsListenerOptions) {
+		if n <= 0 {
+			n = DefaultMaxTLSHandshakes
+		}
+		o.maxHandshakes = n
+	}
+}
+
+// NewInstrumentedTLSListener returns the given listener wrapped in listener that terminates TLS and exposes TLS handshake
+// metrics. Accept returns only connections with finished TLS handshake. Handshakes are done concurrently (up to the
+// limit, see WithMaxTLSHandshakes), so slow clients do not block accepting others. Inner listener is meant to be the
+// one returned by NewInstrumentedListener with the same metrics.
+func NewInstrumentedTLSListener(inner net.Listener, config *tls.Config, handshakeTimeout time.Duration, metrics *ListenerMetrics, opts ...TLSListenerOption) net.Listener {
+	o := tlsListenerOptions{maxHandshakes: DefaultMaxTLSHandshakes}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	l := &tlsListener{
+		inner:            inner,
+		config:           config,
+		handshakeTimeout: handshakeTimeout,
+		metrics:          metrics,
+		handshakeSlots:   make(chan struct{}, o.maxHandshakes),
+		ready:            make(chan net.Conn),
+		errs:             make(chan error),
+		done:             make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+// maxAcceptErrBackoff limits backoff of accept loop on repeated errors of inner listener.
+const maxAcceptErrBackoff = 1 * time.Second
+
+func (l *tlsListener) acceptLoop() {
+	var backoff time.Duration
+	for {
+		select {
+		case l.handshakeSlots <- struct{}{}:
+		case <-l.done:
+			return
+		}
+		conn, err := l.inner.Accept()
+		if err != nil {
+			<-l.handshakeSlots
+			if errors.Is(err, net.ErrClosed) {
+				// Inner listener can be closed directly, not with Close. Accept must not block forever then.
+				l.doneOnce.Do(func() { close(l.done) })
+				return
+			}
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+
+			// Just like http.Server.Serve, back off on errors, so permanent ones do not make the loop spin.
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else {
+				backoff *= 2
+			}
+			if backoff > maxAcceptErrBackoff {
+				backoff = maxAcceptErrBackoff
+			}
+			select {
+			case <-time.After(backoff):
+			case <-l.done:
+				return
+			}
+			continue
+		}
+		backoff = 0
+		go l.handshake(conn)
+	}
+}
+
+func (l *tlsListener) handshake(conn net.Conn) {
+	tlsConn := tls.Server(conn, l.config)
+
+	ctx := context.Background()
+	if l.handshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.handshakeTimeout)
+		defer cancel()
+	}
+	err := tlsConn.HandshakeContext(ctx)
+	<-l.handshakeSlots
+	if err != nil {
+		reason := failedTLSHandshakeOther
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout() {
+			reason = failedTLSHandshakeTimeout
+		}
+		l.metrics.tlsHandshakeFailedTotal.WithLabelValues(reason).Inc()
+		_ = conn.Close()
+		return
+	}
+	l.metrics.tlsHandshakesTotal.Inc()
+
+	select {
+	case l.ready <- tlsConn:
+	case <-l.done:
+		_ = tlsConn.Close()
+	}
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.ready:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *tlsListener) Close() error {
+	l.doneOnce.Do(func() { close(l.done) })
+	return l.inner.Close()
+}
+
+func (l *tlsListener) Addr() net.Addr {
+	return l.inner.Addr()
+}
@@ -0,0 +1,114 @@
+package conntrack
+
+import (
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/observatorium/observable-demo/pkg/internal/testtls"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+// failingListener fails every Accept with the given error.
+type failingListener struct {
+	net.Listener
+
+	err     error
+	accepts int64
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	atomic.AddInt64(&l.accepts, 1)
+	return nil, l.err
+}
+
+func TestTLSListener_InnerClosed(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	l := NewInstrumentedTLSListener(inner, &tls.Config{}, time.Second, NewListenerMetrics(nil))
+
+	// Inner listener closed directly makes every Accept fail, not only the first one.
+	testutil.Ok(t, inner.Close())
+	for i := 0; i < 2; i++ {
+		errc := make(chan error, 1)
+		go func() {
+			_, err := l.Accept()
+			errc <- err
+		}()
+		select {
+		case err := <-errc:
+			testutil.Assert(t, errors.Is(err, net.ErrClosed), "expected net.ErrClosed, got %v", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("accept blocked after inner listener was closed")
+		}
+	}
+}
+
+func TestTLSListener_AcceptErrorBackoff(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	failing := &failingListener{Listener: inner, err: errors.New("permanent")}
+	l := NewInstrumentedTLSListener(failing, &tls.Config{}, time.Second, NewListenerMetrics(nil))
+
+	// Errors are returned by Accept, and inner listener is not retried in a busy loop meanwhile.
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		_, err := l.Accept()
+		testutil.NotOk(t, err)
+	}
+	testutil.Ok(t, l.Close())
+	accepts := atomic.LoadInt64(&failing.accepts)
+	testutil.Assert(t, accepts < 10, "expected backoff between accepts, got %d accepts", accepts)
+}
+
+func TestTLSListener_MaxHandshakes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls-listener")
+	testutil.Ok(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	testtls.WriteKeyPair(t, certFile, keyFile, "test", time.Now())
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	testutil.Ok(t, err)
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	metrics := NewListenerMetrics(nil)
+	l := NewInstrumentedTLSListener(inner, &tls.Config{Certificates: []tls.Certificate{cert}}, 300*time.Millisecond, metrics, WithMaxTLSHandshakes(1))
+	defer func() { _ = l.Close() }()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	// Client that never starts handshake takes the only handshake slot until it times out.
+	stalled, err := net.Dial("tcp", l.Addr().String())
+	testutil.Ok(t, err)
+	defer func() { _ = stalled.Close() }()
+	time.Sleep(50 * time.Millisecond)
+
+	start := time.Now()
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true}) // nolint: gosec
+	testutil.Ok(t, err)
+	testutil.Ok(t, conn.Close())
+	testutil.Assert(t, time.Since(start) >= 200*time.Millisecond, "handshake should wait for free slot, took %v", time.Since(start))
+
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.tlsHandshakeFailedTotal.WithLabelValues(failedTLSHandshakeTimeout)))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.tlsHandshakeFailedTotal.WithLabelValues(failedTLSHandshakeOther)))
+	// Server may finish handshake after the client.
+	for i := 0; promtestutil.ToFloat64(metrics.tlsHandshakesTotal) != 1; i++ {
+		testutil.Assert(t, i < 100, "handshake was not counted")
+		time.Sleep(10 * time.Millisecond)
+	}
+}
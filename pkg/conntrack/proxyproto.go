@@ -0,0 +1,330 @@
+package conntrack
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PROXY protocol versions, see https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt.
+const (
+	ProxyProtocolV1 = 1
+	ProxyProtocolV2 = 2
+)
+
+const (
+	failedProxyProtocolInvalid = "invalid"
+	failedProxyProtocolTimeout = "timeout"
+
+	// proxyV1MaxLen is the maximum length of v1 header including CRLF.
+	proxyV1MaxLen = 107
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ProxyProtocolError is returned by reads from connection which PROXY protocol header could not be parsed.
+type ProxyProtocolError struct {
+	Err error
+}
+
+func (e *ProxyProtocolError) Error() string { return "proxy protocol: " + e.Err.Error() }
+
+func (e *ProxyProtocolError) Unwrap() error { return e.Err }
+
+// proxyProtocolConn reads PROXY protocol header lazily on first read or address lookup, so slow clients do not
+// block the accept loop.
+type proxyProtocolConn struct {
+	net.Conn
+
+	headerTimeout time.Duration
+	metrics       *ListenerMetrics
+
+	once       sync.Once
+	headerRead atomic.Bool
+	br         *bufio.Reader
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	err        error
+}
+
+func newProxyProtocolConn(inner net.Conn, headerTimeout time.Duration, metrics *ListenerMetrics) *proxyProtocolConn {
+	return &proxyProtocolConn{Conn: inner, headerTimeout: headerTimeout, metrics: metrics}
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		defer c.headerRead.Store(true)
+
+		c.br = bufio.NewReader(c.Conn)
+		c.remoteAddr, c.localAddr = c.Conn.RemoteAddr(), c.Conn.LocalAddr()
+
+		if c.headerTimeout > 0 {
+			if err := c.Conn.SetReadDeadline(time.Now().Add(c.headerTimeout)); err != nil {
+				c.err = err
+				return
+			}
+		}
+
+		version, src, dst, err := readProxyHeader(c.br)
+		if err != nil {
+			reason := failedProxyProtocolInvalid
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				reason = failedProxyProtocolTimeout
+			}
+			c.metrics.proxyProtocolFailedTotal.WithLabelValues(reason).Inc()
+			c.err = &ProxyProtocolError{Err: err}
+			return
+		}
+		c.metrics.proxyProtocolHeadersTotal.WithLabelValues(strconv.Itoa(version)).Inc()
+
+		if c.headerTimeout > 0 {
+			if err := c.Conn.SetReadDeadline(time.Time{}); err != nil {
+				c.err = err
+				return
+			}
+		}
+		if src != nil {
+			c.remoteAddr, c.localAddr = src, dst
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(b)
+}
+
+// NetConn returns the underlying connection. Reads from it skip data buffered while reading the header.
+func (c *proxyProtocolConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// RemoteAddr returns client address from PROXY header, or the address of connection peer if header carries none
+// (e.g health checks of the upstream balancer).
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.remoteAddr
+}
+
+// LocalAddr returns destination address from PROXY header, or the local address of connection if header carries none.
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	c.readHeader()
+	return c.localAddr
+}
+
+// headerAddrs returns addresses from PROXY header without waiting for it. It returns false if header was not read yet.
+func (c *proxyProtocolConn) headerAddrs() (local, remote net.Addr, ok bool) {
+	if !c.headerRead.Load() {
+		return nil, nil, false
+	}
+	return c.localAddr, c.remoteAddr, true
+}
+
+// readProxyHeader reads v1 or v2 PROXY protocol header. Addresses are nil for UNKNOWN (v1) or LOCAL (v2) headers, or
+// for v2 headers with address family other than TCP over IPv4 or IPv6.
+func readProxyHeader(br *bufio.Reader) (version int, src, dst net.Addr, err error) {
+	b, err := br.Peek(1)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if b[0] == proxyV2Signature[0] {
+		src, dst, err = readProxyHeaderV2(br)
+		return ProxyProtocolV2, src, dst, err
+	}
+	src, dst, err = readProxyHeaderV1(br)
+	return ProxyProtocolV1, src, dst, err
+}
+
+func readProxyHeaderV1(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLen {
+			return nil, nil, fmt.Errorf("v1 header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("v1 header does not end with CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, nil, fmt.Errorf("not a PROXY header")
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, fmt.Errorf("unsupported v1 protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, nil, fmt.Errorf("invalid v1 header %q", line)
+	}
+
+	src, err := parseTCPAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseTCPAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseTCPAddr(ip, port string) (*net.TCPAddr, error) {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return nil, fmt.Errorf("invalid IP %q", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", port)
+	}
+	return &net.TCPAddr{IP: parsedIP, Port: int(p)}, nil
+}
+
+func readProxyHeaderV2(br *bufio.Reader) (net.Addr, net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Signature) {
+		return nil, nil, fmt.Errorf("invalid v2 signature")
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported v2 version %d", hdr[12]>>4)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, nil, err
+	}
+
+	switch hdr[12] & 0x0f {
+	case 0x0:
+		// LOCAL command e.g health check of the upstream balancer.
+		return nil, nil, nil
+	case 0x1:
+	default:
+		return nil, nil, fmt.Errorf("unsupported v2 command %d", hdr[12]&0x0f)
+	}
+
+	var ipLen int
+	switch hdr[13] {
+	case 0x11: // TCP over IPv4.
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6.
+		ipLen = net.IPv6len
+	default:
+		// Other families (UDP, UNIX) carry no usable address, but header is still valid.
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, fmt.Errorf("v2 address block too short")
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+	return src, dst, nil
+}
+
+// WriteProxyHeader writes PROXY protocol header of the given version with the given addresses. If any of addresses is
+// not a TCP address, header without addresses is written (UNKNOWN in v1, LOCAL in v2).
+func WriteProxyHeader(w io.Writer, version int, src, dst net.Addr) error {
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+	known := srcOK && dstOK
+
+	switch version {
+	case ProxyProtocolV1:
+		if !known {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		proto := "TCP4"
+		if srcTCP.IP.To4() == nil || dstTCP.IP.To4() == nil {
+			proto = "TCP6"
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", proto, srcTCP.IP, dstTCP.IP, srcTCP.Port, dstTCP.Port)
+		return err
+	case ProxyProtocolV2:
+		buf := bytes.NewBuffer(append([]byte{}, proxyV2Signature...))
+		if !known {
+			buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+			_, err := w.Write(buf.Bytes())
+			return err
+		}
+
+		srcIP, dstIP, fam := srcTCP.IP.To4(), dstTCP.IP.To4(), byte(0x11)
+		if srcIP == nil || dstIP == nil {
+			srcIP, dstIP, fam = srcTCP.IP.To16(), dstTCP.IP.To16(), 0x21
+		}
+		buf.Write([]byte{0x21, fam})
+		_ = binary.Write(buf, binary.BigEndian, uint16(2*len(srcIP)+4))
+		buf.Write(srcIP)
+		buf.Write(dstIP)
+		_ = binary.Write(buf, binary.BigEndian, uint16(srcTCP.Port))
+		_ = binary.Write(buf, binary.BigEndian, uint16(dstTCP.Port))
+		_, err := w.Write(buf.Bytes())
+		return err
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+}
+
+type proxyAddrsCtxKey struct{}
+
+type proxyAddrs struct {
+	src, dst net.Addr
+}
+
+// ContextWithProxyAddrs returns context carrying addresses sent in PROXY header by dial function returned by
+// NewProxyProtocolDialContextFunc, usually the address of proxied client and the address it connected to.
+func ContextWithProxyAddrs(ctx context.Context, src, dst net.Addr) context.Context {
+	return context.WithValue(ctx, proxyAddrsCtxKey{}, proxyAddrs{src: src, dst: dst})
+}
+
+// NewProxyProtocolDialContextFunc returns a `DialContext` function that sends PROXY protocol header of the given version
+// right after connection is established. Addresses are taken from context (see ContextWithProxyAddrs). If context has
+// none, header without addresses is sent. Header write failure is returned as dial error.
+func NewProxyProtocolDialContextFunc(parentDialContextFunc dialerContextFunc, version int) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, ntk string, addr string) (net.Conn, error) {
+		conn, err := parentDialContextFunc(ctx, ntk, addr)
+		if err != nil {
+			return conn, err
+		}
+
+		addrs, _ := ctx.Value(proxyAddrsCtxKey{}).(proxyAddrs)
+		if err := WriteProxyHeader(conn, version, addrs.src, addrs.dst); err != nil {
+			_ = conn.Close()
+			return nil, &net.OpError{Op: "dial", Net: ntk, Source: conn.LocalAddr(), Addr: conn.RemoteAddr(), Err: err}
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,129 @@
+package conntrack
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestProxyHeader_WriteRead(t *testing.T) {
+	for _, tcase := range []struct {
+		name     string
+		version  int
+		src, dst net.Addr
+	}{
+		{
+			name:    "v1 IPv4",
+			version: ProxyProtocolV1,
+			src:     &net.TCPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 51234},
+			dst:     &net.TCPAddr{IP: net.ParseIP("10.0.0.2").To4(), Port: 443},
+		},
+		{
+			name:    "v1 IPv6",
+			version: ProxyProtocolV1,
+			src:     &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51234},
+			dst:     &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		},
+		{
+			name:    "v1 unknown",
+			version: ProxyProtocolV1,
+		},
+		{
+			name:    "v2 IPv4",
+			version: ProxyProtocolV2,
+			src:     &net.TCPAddr{IP: net.ParseIP("10.0.0.1").To4(), Port: 51234},
+			dst:     &net.TCPAddr{IP: net.ParseIP("10.0.0.2").To4(), Port: 443},
+		},
+		{
+			name:    "v2 IPv6",
+			version: ProxyProtocolV2,
+			src:     &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51234},
+			dst:     &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+		},
+		{
+			name:    "v2 local",
+			version: ProxyProtocolV2,
+		},
+	} {
+		if ok := t.Run(tcase.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			testutil.Ok(t, WriteProxyHeader(buf, tcase.version, tcase.src, tcase.dst))
+			buf.WriteString("payload")
+
+			br := bufio.NewReader(buf)
+			version, src, dst, err := readProxyHeader(br)
+			testutil.Ok(t, err)
+			testutil.Equals(t, tcase.version, version)
+			if tcase.src == nil {
+				testutil.Assert(t, src == nil && dst == nil, "expected no addresses, got %v %v", src, dst)
+			} else {
+				testutil.Equals(t, tcase.src.String(), src.String())
+				testutil.Equals(t, tcase.dst.String(), dst.String())
+			}
+
+			rest, err := ioutil.ReadAll(br)
+			testutil.Ok(t, err)
+			testutil.Equals(t, "payload", string(rest))
+		}); !ok {
+			return
+		}
+	}
+}
+
+func TestInstrumentedListener_ProxyProtocol(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	metrics := NewListenerMetrics(nil)
+	registry := NewConnRegistry()
+	l := NewInstrumentedListener(inner, metrics, WithProxyProtocol(1*time.Second), WithListenerConnRegistry(registry, "lb"))
+	defer l.Close()
+
+	src := &net.TCPAddr{IP: net.ParseIP("192.0.2.10").To4(), Port: 40000}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.0.2.20").To4(), Port: 80}
+
+	// Valid header.
+	client, err := net.Dial("tcp", l.Addr().String())
+	testutil.Ok(t, err)
+	defer client.Close()
+	testutil.Ok(t, WriteProxyHeader(client, ProxyProtocolV2, src, dst))
+	_, err = client.Write([]byte("hello"))
+	testutil.Ok(t, err)
+
+	conn, err := l.Accept()
+	testutil.Ok(t, err)
+	testutil.Equals(t, src.String(), conn.RemoteAddr().String())
+	testutil.Equals(t, dst.String(), conn.LocalAddr().String())
+	b := make([]byte, 5)
+	_, err = io.ReadFull(conn, b)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "hello", string(b))
+	// Registry shows client addresses from the header too.
+	conns := registry.Conns()
+	testutil.Equals(t, 1, len(conns))
+	testutil.Equals(t, src.String(), conns[0].RemoteAddr)
+	testutil.Equals(t, dst.String(), conns[0].LocalAddr)
+	testutil.Ok(t, conn.Close())
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.proxyProtocolHeadersTotal.WithLabelValues("2")))
+
+	// No header.
+	client2, err := net.Dial("tcp", l.Addr().String())
+	testutil.Ok(t, err)
+	defer client2.Close()
+	_, err = client2.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	testutil.Ok(t, err)
+
+	conn, err = l.Accept()
+	testutil.Ok(t, err)
+	_, err = conn.Read(b)
+	_, isProxyErr := err.(*ProxyProtocolError)
+	testutil.Assert(t, isProxyErr, "expected PROXY protocol error, got %v", err)
+	testutil.Ok(t, conn.Close())
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.proxyProtocolFailedTotal.WithLabelValues(failedProxyProtocolInvalid)))
+}
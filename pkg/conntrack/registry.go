@@ -0,0 +1,137 @@
+package conntrack
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Directions of tracked connections.
+const (
+	DirectionInbound  = "inbound"
+	DirectionOutbound = "outbound"
+)
+
+// ConnRegistry keeps every live connection tracked by instrumented dialers and listeners configured with it, so they
+// can be inspected e.g on a debug page. See WithListenerConnRegistry and WithDialerConnRegistry.
+type ConnRegistry struct {
+	mu    sync.Mutex
+	conns map[*connStats]struct{}
+}
+
+// NewConnRegistry returns empty ConnRegistry.
+func NewConnRegistry() *ConnRegistry {
+	return &ConnRegistry{conns: map[*connStats]struct{}{}}
+}
+
+// ConnInfo describes a live connection.
+type ConnInfo struct {
+	// Name of the listener or dialer the connection belongs to.
+	Name         string    `json:"name"`
+	Direction    string    `json:"direction"`
+	LocalAddr    string    `json:"local_addr"`
+	RemoteAddr   string    `json:"remote_addr"`
+	Start        time.Time `json:"start"`
+	ReadBytes    uint64    `json:"read_bytes"`
+	WrittenBytes uint64    `json:"written_bytes"`
+	// State is TCP state as reported by the kernel (Linux only), e.g ESTABLISHED or CLOSE_WAIT, "open" otherwise.
+	State string `json:"state"`
+	// RTT is smoothed round trip time as reported by the kernel (Linux only).
+	RTT time.Duration `json:"rtt_ns,omitempty"`
+}
+
+// Conns returns live connections, the oldest first.
+func (r *ConnRegistry) Conns() []ConnInfo {
+	r.mu.Lock()
+	stats := make([]*connStats, 0, len(r.conns))
+	for s := range r.conns {
+		stats = append(stats, s)
+	}
+	r.mu.Unlock()
+
+	infos := make([]ConnInfo, 0, len(stats))
+	for _, s := range stats {
+		infos = append(infos, s.info())
+	}
+	sort.SliceStable(infos, func(i, j int) bool { return infos[i].Start.Before(infos[j].Start) })
+	return infos
+}
+
+func (r *ConnRegistry) add(s *connStats) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.conns[s] = struct{}{}
+}
+
+func (r *ConnRegistry) remove(s *connStats) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.conns, s)
+}
+
+// connStats are per connection statistics kept by connection trackers.
+type connStats struct {
+	name      string
+	direction string
+	conn      net.Conn
+	start     time.Time
+
+	readBytes    atomic.Uint64
+	writtenBytes atomic.Uint64
+	// proxied is set for connections accepted with PROXY protocol, so the client addresses from its header are shown
+	// instead of the upstream balancer ones.
+	proxied atomic.Pointer[proxyProtocolConn]
+}
+
+func (s *connStats) info() ConnInfo {
+	local, remote := s.conn.LocalAddr(), s.conn.RemoteAddr()
+	if pc := s.proxied.Load(); pc != nil {
+		if l, r, ok := pc.headerAddrs(); ok {
+			local, remote = l, r
+		}
+	}
+
+	i := ConnInfo{
+		Name:         s.name,
+		Direction:    s.direction,
+		LocalAddr:    local.String(),
+		RemoteAddr:   remote.String(),
+		Start:        s.start,
+		ReadBytes:    s.readBytes.Load(),
+		WrittenBytes: s.writtenBytes.Load(),
+		State:        "open",
+	}
+	if info, ok := readTCPInfo(s.conn); ok {
+		i.State = tcpStateName(info.state)
+		i.RTT = info.rtt
+	}
+	return i
+}
+
+// WithListenerConnRegistry makes listener keep its live connections in the given registry under the given name.
+// Nil registry keeps no connections.
+func WithListenerConnRegistry(r *ConnRegistry, name string) ListenerOption {
+	return func(o *listenerOptions) {
+		o.connRegistry = r
+		o.connRegistryName = name
+	}
+}
+
+// WithDialerConnRegistry makes dialer keep its live connections in the given registry under the given name.
+// Nil registry keeps no connections.
+func WithDialerConnRegistry(r *ConnRegistry, name string) DialerOption {
+	return func(o *dialerOptions) {
+		o.connRegistry = r
+		o.connRegistryName = name
+	}
+}
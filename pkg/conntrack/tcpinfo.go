@@ -0,0 +1,216 @@
+package conntrack
+
+import (
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	tcpInfoSampleInterval = 15 * time.Second
+
+	directionSent     = "sent"
+	directionReceived = "received"
+)
+
+// tcpInfo is a sample of kernel TCP statistics of the connection.
+type tcpInfo struct {
+	state        uint8
+	rtt          time.Duration
+	totalRetrans uint32
+	sndCwnd      uint32
+
+	// Byte counters are available only on newer kernels (Linux 4.1+).
+	hasBytes      bool
+	bytesAcked    uint64
+	bytesReceived uint64
+}
+
+// tcpStates are names of Linux TCP states indexed by tcpi_state.
+var tcpStates = []string{
+	"UNKNOWN", "ESTABLISHED", "SYN_SENT", "SYN_RECV", "FIN_WAIT1", "FIN_WAIT2", "TIME_WAIT", "CLOSE", "CLOSE_WAIT",
+	"LAST_ACK", "LISTEN", "CLOSING", "NEW_SYN_RECV",
+}
+
+func tcpStateName(state uint8) string {
+	if int(state) >= len(tcpStates) {
+		return tcpStates[0]
+	}
+	return tcpStates[state]
+}
+
+// syscallConn unwraps connection wrappers implementing `NetConn() net.Conn` (like *tls.Conn), until connection
+// with access to the underlying socket is found.
+func syscallConn(conn net.Conn) (syscall.Conn, bool) {
+	for {
+		if sc, ok := conn.(syscall.Conn); ok {
+			return sc, true
+		}
+		w, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil, false
+		}
+		conn = w.NetConn()
+	}
+}
+
+// tcpInfoMetrics are metrics of TCP statistics sampled from the kernel (Linux TCP_INFO) periodically and on close
+// of each tracked connection.
+type tcpInfoMetrics struct {
+	rtt         prometheus.Histogram
+	retransmits prometheus.Histogram
+	cwnd        prometheus.Histogram
+	bytesTotal  *prometheus.CounterVec
+
+	mu    sync.Mutex
+	conns map[*tcpInfoConn]struct{}
+	stop  chan struct{}
+}
+
+// newTCPInfoMetrics returns tcpInfoMetrics with the given metric name prefix e.g `dialer`.
+func newTCPInfoMetrics(prefix string) *tcpInfoMetrics {
+	m := &tcpInfoMetrics{
+		rtt: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Subsystem: "conntrack",
+				Name:      prefix + "_tcp_rtt_seconds",
+				Help:      "Smoothed round trip time of TCP connections, sampled from the kernel periodically and on close.",
+				Buckets:   []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.3, 1, 3},
+			}),
+		retransmits: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Subsystem: "conntrack",
+				Name:      prefix + "_tcp_retransmits",
+				Help:      "Number of TCP segments retransmitted since previous sample of the connection, sampled from the kernel periodically and on close.",
+				Buckets:   []float64{0, 1, 2, 5, 10, 50, 100, 1000},
+			}),
+		cwnd: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Subsystem: "conntrack",
+				Name:      prefix + "_tcp_congestion_window_segments",
+				Help:      "Sending congestion window of TCP connections in segments, sampled from the kernel periodically and on close.",
+				Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+			}),
+		bytesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Subsystem: "conntrack",
+				Name:      prefix + "_tcp_bytes_total",
+				Help:      "Total number of bytes acknowledged by peer (direction=sent) or received (direction=received) as reported by the kernel.",
+			}, []string{"direction"}),
+		conns: map[*tcpInfoConn]struct{}{},
+	}
+	m.bytesTotal.WithLabelValues(directionSent)
+	m.bytesTotal.WithLabelValues(directionReceived)
+	return m
+}
+
+func (m *tcpInfoMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.rtt, m.retransmits, m.cwnd, m.bytesTotal}
+}
+
+// tcpInfoConn tracks TCP statistics of a single connection.
+type tcpInfoConn struct {
+	conn    net.Conn
+	metrics *tcpInfoMetrics
+
+	mu     sync.Mutex
+	last   tcpInfo
+	closed bool
+}
+
+// track starts periodic sampling of the given connection. Sampling is stopped by tcpInfoConn.close.
+func (m *tcpInfoMetrics) track(conn net.Conn) *tcpInfoConn {
+	c := &tcpInfoConn{conn: conn, metrics: m}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.conns[c] = struct{}{}
+	if m.stop == nil {
+		// Sample only while there are connections, so idle metrics do not leak goroutines.
+		m.stop = make(chan struct{})
+		go m.sampleLoop(m.stop)
+	}
+	return c
+}
+
+func (m *tcpInfoMetrics) sampleLoop(stop <-chan struct{}) {
+	t := time.NewTicker(tcpInfoSampleInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+
+		m.mu.Lock()
+		conns := make([]*tcpInfoConn, 0, len(m.conns))
+		for c := range m.conns {
+			conns = append(conns, c)
+		}
+		m.mu.Unlock()
+
+		for _, c := range conns {
+			c.sample()
+		}
+	}
+}
+
+func (c *tcpInfoConn) sample() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.sampleLocked()
+}
+
+func (c *tcpInfoConn) sampleLocked() {
+	info, ok := readTCPInfo(c.conn)
+	if !ok {
+		return
+	}
+
+	m := c.metrics
+	m.rtt.Observe(info.rtt.Seconds())
+	m.cwnd.Observe(float64(info.sndCwnd))
+	m.retransmits.Observe(float64(info.totalRetrans - c.last.totalRetrans))
+	if info.hasBytes {
+		m.bytesTotal.WithLabelValues(directionSent).Add(float64(info.bytesAcked - c.last.bytesAcked))
+		m.bytesTotal.WithLabelValues(directionReceived).Add(float64(info.bytesReceived - c.last.bytesReceived))
+	}
+	c.last = info
+}
+
+// close takes the final sample and stops tracking the connection. It has to be called before the connection is
+// closed. It is safe to call it multiple times.
+func (c *tcpInfoConn) close() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.sampleLocked()
+	c.closed = true
+	c.mu.Unlock()
+
+	m := c.metrics
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.conns, c)
+	if len(m.conns) == 0 && m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+}
@@ -0,0 +1,62 @@
+//go:build linux
+// +build linux
+
+package conntrack
+
+import (
+	"net"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// linuxTCPInfo mirrors the beginning of `struct tcp_info` from linux/tcp.h, up to tcpi_bytes_received.
+type linuxTCPInfo struct {
+	state, caState, retransmits, probes, backoff, options, wscale, flags uint8
+
+	rto, ato, sndMss, rcvMss                             uint32
+	unacked, sacked, lost, retrans, fackets              uint32
+	lastDataSent, lastAckSent, lastDataRecv, lastAckRecv uint32
+	pmtu, rcvSsthresh, rtt, rttvar, sndSsthresh, sndCwnd uint32
+	advmss, reordering, rcvRtt, rcvSpace, totalRetrans   uint32
+	pacingRate, maxPacingRate, bytesAcked, bytesReceived uint64
+}
+
+// bytesFieldsEnd is the length of tcp_info kernel has to return for byte counters to be present.
+const bytesFieldsEnd = uint32(unsafe.Sizeof(linuxTCPInfo{}))
+
+// readTCPInfo reads TCP_INFO of the given connection, if it is (or wraps) a TCP connection.
+func readTCPInfo(conn net.Conn) (tcpInfo, bool) {
+	sc, ok := syscallConn(conn)
+	if !ok {
+		return tcpInfo{}, false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return tcpInfo{}, false
+	}
+
+	var (
+		raw     linuxTCPInfo
+		size    = bytesFieldsEnd
+		sockErr syscall.Errno
+	)
+	if err := rc.Control(func(fd uintptr) {
+		_, _, sockErr = syscall.Syscall6(
+			syscall.SYS_GETSOCKOPT, fd, syscall.SOL_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&raw)), uintptr(unsafe.Pointer(&size)), 0,
+		)
+	}); err != nil || sockErr != 0 {
+		return tcpInfo{}, false
+	}
+
+	return tcpInfo{
+		state:         raw.state,
+		rtt:           time.Duration(raw.rtt) * time.Microsecond,
+		totalRetrans:  raw.totalRetrans,
+		sndCwnd:       raw.sndCwnd,
+		hasBytes:      size >= bytesFieldsEnd,
+		bytesAcked:    raw.bytesAcked,
+		bytesReceived: raw.bytesReceived,
+	}, true
+}
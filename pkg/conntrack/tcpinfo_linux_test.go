@@ -0,0 +1,57 @@
+package conntrack
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestTCPInfo_SampledOnClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	defer func() { _ = l.Close() }()
+
+	listenerMetrics := NewListenerMetrics(prometheus.NewRegistry())
+	l = NewInstrumentedListener(l, listenerMetrics)
+
+	payload := make([]byte, 64*1024)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+
+		// Echo until client finishes writing.
+		_, _ = io.Copy(conn, io.LimitReader(conn, int64(len(payload))))
+	}()
+
+	dialerMetrics := NewDialerMetrics(prometheus.NewRegistry())
+	conn, err := NewInstrumentedDialContextFunc((&net.Dialer{}).DialContext, dialerMetrics)(context.Background(), "tcp", l.Addr().String())
+	testutil.Ok(t, err)
+
+	_, err = conn.Write(payload)
+	testutil.Ok(t, err)
+	_, err = io.ReadFull(conn, payload)
+	testutil.Ok(t, err)
+	testutil.Ok(t, conn.Close())
+	// Second close must not sample again.
+	_ = conn.Close()
+
+	testutil.Equals(t, 1, promtestutil.CollectAndCount(dialerMetrics.tcpInfo.rtt))
+	// Kernel counts sequence numbers, so control segments (SYN, FIN) may add a byte.
+	sent := promtestutil.ToFloat64(dialerMetrics.tcpInfo.bytesTotal.WithLabelValues(directionSent))
+	testutil.Assert(t, sent >= float64(len(payload)) && sent <= float64(len(payload)+2), "unexpected sent bytes %v", sent)
+	received := promtestutil.ToFloat64(dialerMetrics.tcpInfo.bytesTotal.WithLabelValues(directionReceived))
+	testutil.Assert(t, received >= float64(len(payload)) && received <= float64(len(payload)+2), "unexpected received bytes %v", received)
+
+	dialerMetrics.tcpInfo.mu.Lock()
+	defer dialerMetrics.tcpInfo.mu.Unlock()
+	testutil.Equals(t, 0, len(dialerMetrics.tcpInfo.conns))
+	testutil.Assert(t, dialerMetrics.tcpInfo.stop == nil, "sampling loop should be stopped once no connection is tracked")
+}
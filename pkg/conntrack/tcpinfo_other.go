@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package conntrack
+
+import "net"
+
+// readTCPInfo is supported only on Linux.
+func readTCPInfo(net.Conn) (tcpInfo, bool) {
+	return tcpInfo{}, false
+}
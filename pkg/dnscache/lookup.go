@@ -0,0 +1,212 @@
+package dnscache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxUDPSize is the maximum size of DNS message over UDP without EDNS. Longer answers are truncated and retried over TCP.
+const maxUDPSize = 512
+
+// NewDNSLookupFunc returns LookupFunc querying the given DNS server (host:port) for A and AAAA records, so answers are
+// cached for TTLs of the records. TTL of the answer is the shortest TTL of its records, including CNAMEs. Unlike the
+// system resolver, it does not use search domains nor hosts file, so host names are always treated as fully qualified.
+func NewDNSLookupFunc(server string) LookupFunc {
+	c := &dnsClient{server: server}
+	return c.lookup
+}
+
+type dnsClient struct {
+	server string
+	dialer net.Dialer
+}
+
+func (c *dnsClient) lookup(ctx context.Context, host string) ([]string, time.Duration, error) {
+	fqdn := host
+	if !strings.HasSuffix(fqdn, ".") {
+		fqdn += "."
+	}
+	name, err := dnsmessage.NewName(fqdn)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host}
+	}
+
+	var (
+		addrs []string
+		ttl   time.Duration
+	)
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		a, t, err := c.query(ctx, name, qtype)
+		if err != nil {
+			if dnsErr, ok := err.(*net.DNSError); ok {
+				dnsErr.Name = host
+				return nil, 0, dnsErr
+			}
+			return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: c.server, IsTimeout: isTimeout(err), IsTemporary: true}
+		}
+		if len(a) == 0 {
+			continue
+		}
+		if len(addrs) == 0 || t < ttl {
+			ttl = t
+		}
+		addrs = append(addrs, a...)
+	}
+	if len(addrs) == 0 {
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, Server: c.server, IsNotFound: true}
+	}
+	return addrs, ttl, nil
+}
+
+// query sends a single question to the server, over UDP first and over TCP if the answer is truncated. It returns
+// addresses in the answer and the shortest TTL of the answer records.
+func (c *dnsClient) query(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) ([]string, time.Duration, error) {
+	id := uint16(rand.Uint32())
+	// First two bytes are reserved for message length used over TCP.
+	b := dnsmessage.NewBuilder(make([]byte, 2, maxUDPSize), dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, 0, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, err
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		return nil, 0, err
+	}
+	binary.BigEndian.PutUint16(msg, uint16(len(msg)-2))
+
+	var (
+		p dnsmessage.Parser
+		h dnsmessage.Header
+	)
+	for _, network := range []string{"udp", "tcp"} {
+		h, err = c.exchange(ctx, network, msg, &p)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !h.Truncated {
+			break
+		}
+	}
+
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Server: c.server, IsNotFound: true}
+	default:
+		return nil, 0, &net.DNSError{Err: "server misbehaving: " + h.RCode.String(), Server: c.server, IsTemporary: true}
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+	var (
+		addrs   []string
+		ttl     time.Duration
+		records int
+	)
+	for {
+		rh, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch rh.Type {
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			addrs = append(addrs, net.IP(r.A[:]).String())
+		case dnsmessage.TypeAAAA:
+			r, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+			addrs = append(addrs, net.IP(r.AAAA[:]).String())
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+		}
+		if t := time.Duration(rh.TTL) * time.Second; records == 0 || t < ttl {
+			ttl = t
+		}
+		records++
+	}
+	return addrs, ttl, nil
+}
+
+// exchange sends the query (prefixed by its length) over the given network and starts parsing the response.
+func (c *dnsClient) exchange(ctx context.Context, network string, query []byte, p *dnsmessage.Parser) (dnsmessage.Header, error) {
+	conn, err := c.dialer.DialContext(ctx, network, c.server)
+	if err != nil {
+		return dnsmessage.Header{}, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	id := binary.BigEndian.Uint16(query[2:])
+
+	if network == "tcp" {
+		if _, err := conn.Write(query); err != nil {
+			return dnsmessage.Header{}, err
+		}
+		l := make([]byte, 2)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return dnsmessage.Header{}, err
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(l))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return dnsmessage.Header{}, err
+		}
+		h, err := p.Start(resp)
+		if err != nil {
+			return dnsmessage.Header{}, err
+		}
+		if !h.Response || h.ID != id {
+			return dnsmessage.Header{}, errors.New("unexpected DNS response")
+		}
+		return h, nil
+	}
+
+	if _, err := conn.Write(query[2:]); err != nil {
+		return dnsmessage.Header{}, err
+	}
+	resp := make([]byte, maxUDPSize)
+	for {
+		n, err := conn.Read(resp)
+		if err != nil {
+			return dnsmessage.Header{}, err
+		}
+		h, err := p.Start(resp[:n])
+		if err != nil || !h.Response || h.ID != id {
+			// Ignore malformed or unrelated packets, e.g. late answers to earlier queries.
+			continue
+		}
+		return h, nil
+	}
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,137 @@
+package dnscache
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/util/testutil"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNSServer answers queries over UDP and TCP on the same port with the given records. Names without records
+// are answered with NXDOMAIN. If truncateUDP is true, UDP answers are truncated and empty.
+type fakeDNSServer struct {
+	records     map[string][]dnsmessage.Resource
+	truncateUDP bool
+}
+
+func (s *fakeDNSServer) start(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	t.Cleanup(func() { _ = pc.Close() })
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	testutil.Ok(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	go func() {
+		buf := make([]byte, maxUDPSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp, err := s.answer(buf[:n], s.truncateUDP); err == nil {
+				_, _ = pc.WriteTo(resp, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			l := make([]byte, 2)
+			if _, err := io.ReadFull(conn, l); err == nil {
+				q := make([]byte, binary.BigEndian.Uint16(l))
+				if _, err := io.ReadFull(conn, q); err == nil {
+					resp, _ := s.answer(q, false)
+					binary.BigEndian.PutUint16(l, uint16(len(resp)))
+					_, _ = conn.Write(append(l, resp...))
+				}
+			}
+			_ = conn.Close()
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func (s *fakeDNSServer) answer(query []byte, truncate bool) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: h.ID, Response: true, Truncated: truncate},
+		Questions: []dnsmessage.Question{q},
+	}
+	records, ok := s.records[q.Name.String()]
+	if !ok {
+		resp.Header.RCode = dnsmessage.RCodeNameError
+	}
+	if !truncate {
+		for _, r := range records {
+			if r.Header.Type == q.Type || r.Header.Type == dnsmessage.TypeCNAME {
+				resp.Answers = append(resp.Answers, r)
+			}
+		}
+	}
+	return resp.Pack()
+}
+
+func resource(name string, typ dnsmessage.Type, ttl uint32, body dnsmessage.ResourceBody) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   body,
+	}
+}
+
+func TestDNSLookupFunc(t *testing.T) {
+	records := map[string][]dnsmessage.Resource{
+		"a.example.": {
+			resource("a.example.", dnsmessage.TypeCNAME, 60, &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("b.example.")}),
+			resource("b.example.", dnsmessage.TypeA, 300, &dnsmessage.AResource{A: [4]byte{10, 0, 0, 1}}),
+			resource("b.example.", dnsmessage.TypeA, 300, &dnsmessage.AResource{A: [4]byte{10, 0, 0, 2}}),
+			resource("b.example.", dnsmessage.TypeAAAA, 30, &dnsmessage.AAAAResource{AAAA: [16]byte{15: 1}}),
+		},
+		"v4.example.": {
+			resource("v4.example.", dnsmessage.TypeA, 120, &dnsmessage.AResource{A: [4]byte{10, 0, 0, 3}}),
+		},
+		"empty.example.": {},
+	}
+
+	for _, truncateUDP := range []bool{false, true} {
+		lookup := NewDNSLookupFunc((&fakeDNSServer{records: records, truncateUDP: truncateUDP}).start(t))
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		// TTL of the answer is the shortest TTL of its records.
+		addrs, ttl, err := lookup(ctx, "a.example")
+		testutil.Ok(t, err)
+		testutil.Equals(t, []string{"10.0.0.1", "10.0.0.2", "::1"}, addrs)
+		testutil.Equals(t, 30*time.Second, ttl)
+
+		addrs, ttl, err = lookup(ctx, "v4.example.")
+		testutil.Ok(t, err)
+		testutil.Equals(t, []string{"10.0.0.3"}, addrs)
+		testutil.Equals(t, 2*time.Minute, ttl)
+
+		for _, host := range []string{"missing.example", "empty.example"} {
+			_, _, err = lookup(ctx, host)
+			dnsErr, ok := err.(*net.DNSError)
+			testutil.Assert(t, ok, "expected DNS error, got %v", err)
+			testutil.Assert(t, dnsErr.IsNotFound, "expected not found error, got %v", err)
+			testutil.Equals(t, host, dnsErr.Name)
+		}
+	}
+}
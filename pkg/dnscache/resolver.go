@@ -0,0 +1,286 @@
+// Package dnscache contains caching DNS resolver, so dialers do not look up the same host on every new connection.
+package dnscache
+
+import (
+	"context"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	resultHit   = "hit"
+	resultMiss  = "miss"
+	resultStale = "stale"
+)
+
+// LookupFunc resolves host to addresses. Returned TTL is the time the answer is valid for, zero if unknown.
+type LookupFunc func(ctx context.Context, host string) (addrs []string, ttl time.Duration, err error)
+
+// NewNetLookupFunc returns LookupFunc using the given resolver, or net.DefaultResolver if nil. Go resolver does not
+// expose TTLs of records, so answers are cached for the minimum TTL of the Resolver.
+func NewNetLookupFunc(r *net.Resolver) LookupFunc {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	return func(ctx context.Context, host string) ([]string, time.Duration, error) {
+		addrs, err := r.LookupHost(ctx, host)
+		return addrs, 0, err
+	}
+}
+
+type Metrics struct {
+	lookupsTotal        *prometheus.CounterVec
+	lookupFailuresTotal prometheus.Counter
+	entries             prometheus.Gauge
+}
+
+// NewMetrics provides Metrics.
+func NewMetrics(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		lookupsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dns_cache_lookups_total",
+			Help: "Total number of host lookups by result: hit (served from cache), miss (resolved) or stale (served from expired cache entry, because resolving failed).",
+		}, []string{"result"}),
+		lookupFailuresTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "dns_cache_resolve_failures_total",
+			Help: "Total number of failed resolves of cache misses, including ones served from stale entries.",
+		}),
+		entries: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dns_cache_entries",
+			Help: "Number of cached hosts, including expired ones kept to be served on failures.",
+		}),
+	}
+	for _, r := range []string{resultHit, resultMiss, resultStale} {
+		m.lookupsTotal.WithLabelValues(r)
+	}
+	if reg != nil {
+		reg.MustRegister(m.lookupsTotal, m.lookupFailuresTotal, m.entries)
+	}
+	return m
+}
+
+type options struct {
+	minTTL        time.Duration
+	maxTTL        time.Duration
+	maxStale      time.Duration
+	lookupTimeout time.Duration
+}
+
+// Option configures Resolver.
+type Option func(*options)
+
+// WithMinTTL sets minimum time answers are cached for, also used for answers with unknown TTL. Default: 5s.
+func WithMinTTL(d time.Duration) Option {
+	return func(o *options) { o.minTTL = d }
+}
+
+// WithMaxTTL sets maximum time answers are cached for. Default: 5m.
+func WithMaxTTL(d time.Duration) Option {
+	return func(o *options) { o.maxTTL = d }
+}
+
+// WithMaxStale sets how long after expiry cached answer is served if resolving fails. Zero disables serving stale
+// answers. Default: 5m.
+func WithMaxStale(d time.Duration) Option {
+	return func(o *options) { o.maxStale = d }
+}
+
+// WithLookupTimeout sets maximum time of a single lookup. Lookups are shared by concurrent callers, so they are not
+// canceled with context of the caller. Default: 5s.
+func WithLookupTimeout(d time.Duration) Option {
+	return func(o *options) { o.lookupTimeout = d }
+}
+
+// Resolver caches answers of LookupFunc for their TTL, bounded by minimum and maximum TTL. Concurrent lookups of the
+// same host are deduplicated. If resolving fails, expired answer is served for a while instead.
+type Resolver struct {
+	lookup  LookupFunc
+	metrics *Metrics
+	opts    options
+	now     func() time.Time
+
+	group singleflight.Group
+
+	mu      sync.Mutex
+	entries map[string]entry
+}
+
+type entry struct {
+	addrs   []string
+	expires time.Time
+}
+
+type lookupResult struct {
+	addrs []string
+	stale bool
+}
+
+// NewResolver returns Resolver caching answers of the given lookup function.
+func NewResolver(lookup LookupFunc, metrics *Metrics, opts ...Option) *Resolver {
+	o := options{
+		minTTL:        5 * time.Second,
+		maxTTL:        5 * time.Minute,
+		maxStale:      5 * time.Minute,
+		lookupTimeout: 5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Resolver{
+		lookup:  lookup,
+		metrics: metrics,
+		opts:    o,
+		now:     time.Now,
+		entries: map[string]entry{},
+	}
+}
+
+// LookupHost returns addresses of the given host, from cache if possible. IP addresses are returned as they are.
+func (r *Resolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	r.mu.Lock()
+	e, ok := r.entries[host]
+	r.mu.Unlock()
+	if ok && r.now().Before(e.expires) {
+		r.metrics.lookupsTotal.WithLabelValues(resultHit).Inc()
+		return e.addrs, nil
+	}
+
+	ch := r.group.DoChan(host, func() (interface{}, error) { return r.resolve(host) })
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		lr := res.Val.(lookupResult)
+		if lr.stale {
+			r.metrics.lookupsTotal.WithLabelValues(resultStale).Inc()
+		} else {
+			r.metrics.lookupsTotal.WithLabelValues(resultMiss).Inc()
+		}
+		return lr.addrs, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// resolve looks up the host and caches the answer. If lookup fails, not too old cached answer is returned instead.
+func (r *Resolver) resolve(host string) (lookupResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.lookupTimeout)
+	defer cancel()
+
+	addrs, ttl, err := r.lookup(ctx, host)
+	now := r.now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer func() { r.metrics.entries.Set(float64(len(r.entries))) }()
+
+	if err != nil {
+		r.metrics.lookupFailuresTotal.Inc()
+		if e, ok := r.entries[host]; ok && now.Before(e.expires.Add(r.opts.maxStale)) {
+			return lookupResult{addrs: e.addrs, stale: true}, nil
+		}
+		delete(r.entries, host)
+		return lookupResult{}, err
+	}
+
+	if ttl < r.opts.minTTL {
+		ttl = r.opts.minTTL
+	}
+	if ttl > r.opts.maxTTL {
+		ttl = r.opts.maxTTL
+	}
+	r.entries[host] = entry{addrs: addrs, expires: now.Add(ttl)}
+
+	// Forget hosts that are not dialed anymore.
+	for h, e := range r.entries {
+		if !now.Before(e.expires.Add(r.opts.maxStale)) {
+			delete(r.entries, h)
+		}
+	}
+	return lookupResult{addrs: addrs}, nil
+}
+
+// DialContextFunc is the signature of net.Dialer.DialContext.
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// DialContextFunc returns dial function resolving host of the dialed address with the Resolver. Resolved addresses are
+// dialed with parent one by one, until the connection is established. Error of the last address is returned otherwise.
+// Just like net.Dialer, each attempt gets a share of the remaining time until the deadline, so a single unresponsive
+// address does not take all of it. Lookups are reported to client trace of the context as DNS lookups, as parent dials
+// resolved addresses only.
+func (r *Resolver) DialContextFunc(parent DialContextFunc) DialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return parent(ctx, network, addr)
+		}
+
+		trace := httptrace.ContextClientTrace(ctx)
+		if trace != nil && trace.DNSStart != nil {
+			trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+		}
+		addrs, err := r.LookupHost(ctx, host)
+		if trace != nil && trace.DNSDone != nil {
+			trace.DNSDone(httptrace.DNSDoneInfo{Addrs: ipAddrs(addrs), Err: err})
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for i, a := range addrs {
+			dialCtx, cancel := ctx, func() {}
+			if deadline, ok := ctx.Deadline(); ok {
+				dialCtx, cancel = context.WithDeadline(ctx, partialDeadline(time.Now(), deadline, len(addrs)-i))
+			}
+
+			var conn net.Conn
+			conn, err = parent(dialCtx, network, net.JoinHostPort(a, port))
+			cancel()
+			if err == nil {
+				return conn, nil
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, err
+	}
+}
+
+// minDialAttemptTimeout is the minimum time of a single dial attempt, unless there is less time left. Same as the one
+// of net.Dialer.
+const minDialAttemptTimeout = 2 * time.Second
+
+// partialDeadline returns deadline of dial attempt of the first of remaining addresses, splitting the time until the
+// deadline evenly between them.
+func partialDeadline(now, deadline time.Time, addrsRemaining int) time.Time {
+	timeRemaining := deadline.Sub(now)
+	timeout := timeRemaining / time.Duration(addrsRemaining)
+	if timeout < minDialAttemptTimeout {
+		timeout = minDialAttemptTimeout
+		if timeRemaining < minDialAttemptTimeout {
+			timeout = timeRemaining
+		}
+	}
+	return now.Add(timeout)
+}
+
+func ipAddrs(addrs []string) []net.IPAddr {
+	ips := make([]net.IPAddr, 0, len(addrs))
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil {
+			ips = append(ips, net.IPAddr{IP: ip})
+		}
+	}
+	return ips
+}
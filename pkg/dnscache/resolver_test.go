@@ -0,0 +1,202 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+type fakeLookup struct {
+	calls int64
+	addrs []string
+	ttl   time.Duration
+	err   error
+	wait  chan struct{}
+}
+
+func (f *fakeLookup) lookup(ctx context.Context, host string) ([]string, time.Duration, error) {
+	atomic.AddInt64(&f.calls, 1)
+	if f.wait != nil {
+		<-f.wait
+	}
+	return f.addrs, f.ttl, f.err
+}
+
+func TestResolver_LookupHost(t *testing.T) {
+	lookup := &fakeLookup{addrs: []string{"10.0.0.1"}, ttl: 30 * time.Second}
+	metrics := NewMetrics(nil)
+	r := NewResolver(lookup.lookup, metrics, WithMinTTL(10*time.Second), WithMaxTTL(time.Minute), WithMaxStale(time.Minute))
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	expectLookup := func(expectedAddrs []string, expectedCalls int64) {
+		t.Helper()
+		addrs, err := r.LookupHost(context.Background(), "a")
+		testutil.Ok(t, err)
+		testutil.Equals(t, expectedAddrs, addrs)
+		testutil.Equals(t, expectedCalls, atomic.LoadInt64(&lookup.calls))
+	}
+
+	expectLookup([]string{"10.0.0.1"}, 1)
+	now = now.Add(29 * time.Second)
+	expectLookup([]string{"10.0.0.1"}, 1)
+
+	// Expired.
+	lookup.addrs = []string{"10.0.0.2"}
+	now = now.Add(time.Second)
+	expectLookup([]string{"10.0.0.2"}, 2)
+
+	// Resolving fails, stale answer is served until max stale.
+	lookup.err = errors.New("resolver down")
+	now = now.Add(80 * time.Second)
+	expectLookup([]string{"10.0.0.2"}, 3)
+	now = now.Add(10 * time.Second)
+	_, err := r.LookupHost(context.Background(), "a")
+	testutil.NotOk(t, err)
+
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.lookupsTotal.WithLabelValues(resultHit)))
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(metrics.lookupsTotal.WithLabelValues(resultMiss)))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.lookupsTotal.WithLabelValues(resultStale)))
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(metrics.lookupFailuresTotal))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.entries))
+
+	// IP addresses are not looked up.
+	addrs, err := r.LookupHost(context.Background(), "127.0.0.1")
+	testutil.Ok(t, err)
+	testutil.Equals(t, []string{"127.0.0.1"}, addrs)
+	testutil.Equals(t, int64(4), atomic.LoadInt64(&lookup.calls))
+}
+
+func TestResolver_TTLBounds(t *testing.T) {
+	for _, tcase := range []struct{ ttl, expected time.Duration }{
+		{ttl: 0, expected: 10 * time.Second},
+		{ttl: time.Second, expected: 10 * time.Second},
+		{ttl: 30 * time.Second, expected: 30 * time.Second},
+		{ttl: time.Hour, expected: time.Minute},
+	} {
+		lookup := &fakeLookup{addrs: []string{"10.0.0.1"}, ttl: tcase.ttl}
+		r := NewResolver(lookup.lookup, NewMetrics(nil), WithMinTTL(10*time.Second), WithMaxTTL(time.Minute))
+		now := time.Now()
+		r.now = func() time.Time { return now }
+
+		_, err := r.LookupHost(context.Background(), "a")
+		testutil.Ok(t, err)
+		testutil.Equals(t, now.Add(tcase.expected), r.entries["a"].expires)
+	}
+}
+
+func TestResolver_DeduplicatesLookups(t *testing.T) {
+	lookup := &fakeLookup{addrs: []string{"10.0.0.1"}, wait: make(chan struct{})}
+	metrics := NewMetrics(nil)
+	r := NewResolver(lookup.lookup, metrics)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs, err := r.LookupHost(context.Background(), "a")
+			testutil.Ok(t, err)
+			testutil.Equals(t, []string{"10.0.0.1"}, addrs)
+		}()
+	}
+	// Let all callers wait for the lookup.
+	time.Sleep(100 * time.Millisecond)
+	close(lookup.wait)
+	wg.Wait()
+
+	testutil.Equals(t, int64(1), atomic.LoadInt64(&lookup.calls))
+	testutil.Equals(t, 10.0, promtestutil.ToFloat64(metrics.lookupsTotal.WithLabelValues(resultMiss))+
+		promtestutil.ToFloat64(metrics.lookupsTotal.WithLabelValues(resultHit)))
+
+	// Caller is not blocked by the lookup after its context is done.
+	lookup.wait = make(chan struct{})
+	defer close(lookup.wait)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := r.LookupHost(ctx, "b")
+	testutil.Equals(t, context.Canceled, err)
+}
+
+func TestResolver_DialContextFunc(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, l.Close()) }()
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	testutil.Ok(t, err)
+
+	lookup := &fakeLookup{addrs: []string{"10.0.0.1", "127.0.0.1"}}
+	r := NewResolver(lookup.lookup, NewMetrics(nil))
+
+	var dialed []string
+	dial := r.DialContextFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if addr == net.JoinHostPort("10.0.0.1", port) {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	})
+
+	// Lookups are reported as DNS lookups of the client trace, e.g so HTTP client observes them.
+	var lookedUp []string
+	ctx := httptrace.WithClientTrace(context.Background(), &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) { lookedUp = append(lookedUp, info.Host) },
+	})
+	conn, err := dial(ctx, "tcp", net.JoinHostPort("a", port))
+	testutil.Ok(t, err)
+	testutil.Ok(t, conn.Close())
+	testutil.Equals(t, []string{net.JoinHostPort("10.0.0.1", port), net.JoinHostPort("127.0.0.1", port)}, dialed)
+	testutil.Equals(t, []string{"a"}, lookedUp)
+
+	// DNS errors are returned as they are, so they are classified as resolution failures.
+	lookup.err = &net.DNSError{Err: "no such host", Name: "b", IsNotFound: true}
+	_, err = dial(context.Background(), "tcp", net.JoinHostPort("b", port))
+	testutil.Equals(t, lookup.err, err)
+}
+
+func TestResolver_DialContextFunc_PartialDeadline(t *testing.T) {
+	lookup := &fakeLookup{addrs: []string{"10.0.0.1", "10.0.0.2"}}
+	r := NewResolver(lookup.lookup, NewMetrics(nil))
+
+	var deadlines []time.Time
+	dial := r.DialContextFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		deadline, _ := ctx.Deadline()
+		deadlines = append(deadlines, deadline)
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	_, err := dial(ctx, "tcp", "a:80")
+	testutil.NotOk(t, err)
+
+	// First address gets half of the time, the last one the rest.
+	testutil.Equals(t, 2, len(deadlines))
+	testutil.Assert(t, deadlines[0].Before(deadline.Add(-4*time.Second)), "first attempt should get half of the time, got deadline %v of %v", deadlines[0], deadline)
+	testutil.Assert(t, deadlines[1].Sub(deadline).Abs() < time.Millisecond, "last attempt should get the rest of the time, got deadline %v of %v", deadlines[1], deadline)
+}
+
+func TestPartialDeadline(t *testing.T) {
+	now := time.Now()
+	for _, tcase := range []struct {
+		remaining time.Duration
+		addrs     int
+		expected  time.Duration
+	}{
+		{remaining: 10 * time.Second, addrs: 1, expected: 10 * time.Second},
+		{remaining: 10 * time.Second, addrs: 2, expected: 5 * time.Second},
+		{remaining: 10 * time.Second, addrs: 10, expected: 2 * time.Second},
+		{remaining: time.Second, addrs: 2, expected: time.Second},
+	} {
+		testutil.Equals(t, now.Add(tcase.expected), partialDeadline(now, now.Add(tcase.remaining), tcase.addrs))
+	}
+}
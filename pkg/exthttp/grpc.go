@@ -0,0 +1,140 @@
+package exthttp
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	grpcStatusHeader = "Grpc-Status"
+
+	// gRPC status codes used when status is not known.
+	grpcCodeCancelled = "1"
+	grpcCodeUnknown   = "2"
+)
+
+// IsGRPCRequest returns true if the given request is a gRPC call, based on its content type.
+func IsGRPCRequest(r *http.Request) bool {
+	ct := r.Header.Get("Content-Type")
+	if !strings.HasPrefix(ct, "application/grpc") {
+		return false
+	}
+	return len(ct) == len("application/grpc") || ct[len("application/grpc")] == '+' || ct[len("application/grpc")] == ';'
+}
+
+// GRPCStatus returns gRPC status code of the finished gRPC response with the given headers and trailers, as a decimal
+// string e.g "14" for Unavailable. Trailers-only responses (e.g errors returned before any message) carry the status
+// in headers. If status is missing, HTTP status code is returned for non-200 responses, and Unknown code otherwise.
+func GRPCStatus(statusCode int, header, trailer http.Header) string {
+	if s := trailer.Get(grpcStatusHeader); s != "" {
+		return s
+	}
+	if s := header.Get(grpcStatusHeader); s != "" {
+		return s
+	}
+	if statusCode != http.StatusOK {
+		return strconv.Itoa(statusCode)
+	}
+	return grpcCodeUnknown
+}
+
+// grpcRoundTrip instruments gRPC call. Unlike HTTP requests, call is observed once the response stream ends, with the
+// `grpc-status` as the code, because HTTP status code of gRPC responses is always 200.
+func grpcRoundTrip(metrics *ClientMetrics, target string, next http.RoundTripper, r *http.Request) (*http.Response, error) {
+	inFlight := metrics.requestsInFlight.WithLabelValues(target)
+	inFlight.Inc()
+	start := time.Now()
+
+	resp, err := next.RoundTrip(r)
+	if err != nil {
+		inFlight.Dec()
+		return resp, err
+	}
+
+	method := strings.ToLower(r.Method)
+	resp.Body = &grpcStatusBody{ReadCloser: resp.Body, done: func(code string) {
+		inFlight.Dec()
+		metrics.requestsTotal.WithLabelValues(target, code, method).Inc()
+		metrics.requestDuration.WithLabelValues(target, code, method).Observe(time.Since(start).Seconds())
+	}, resp: resp}
+	return resp, nil
+}
+
+// grpcStatusBody calls done with gRPC status of the response, once the response body is read till EOF or closed.
+type grpcStatusBody struct {
+	io.ReadCloser
+
+	resp *http.Response
+	done func(code string)
+	once sync.Once
+}
+
+func (b *grpcStatusBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		// Trailers are available only once body is read till EOF.
+		b.once.Do(func() { b.done(GRPCStatus(b.resp.StatusCode, b.resp.Header, b.resp.Trailer)) })
+	}
+	return n, err
+}
+
+func (b *grpcStatusBody) Close() error {
+	b.once.Do(func() {
+		code := grpcCodeCancelled
+		if s := b.resp.Header.Get(grpcStatusHeader); s != "" {
+			code = s
+		}
+		b.done(code)
+	})
+	return b.ReadCloser.Close()
+}
+
+// newGRPCMetricMiddleware instruments gRPC calls handled by the given handler. Code is taken from `grpc-status` header
+// or trailer set by the handler.
+func newGRPCMetricMiddleware(metrics *ServerMetrics, handler http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metrics.requestsInFlight.Inc()
+		defer metrics.requestsInFlight.Dec()
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		handler.ServeHTTP(sw, r)
+
+		h := w.Header()
+		code := h.Get(grpcStatusHeader)
+		if code == "" {
+			// Trailers not announced before writing headers.
+			code = h.Get(http.TrailerPrefix + grpcStatusHeader)
+		}
+		if code == "" {
+			code = GRPCStatus(sw.statusCode, nil, nil)
+		}
+
+		method := strings.ToLower(r.Method)
+		metrics.requestsTotal.With(prometheus.Labels{"code": code, "method": method}).Inc()
+		metrics.requestDuration.With(prometheus.Labels{"code": code, "method": method}).Observe(time.Since(start).Seconds())
+	}
+}
+
+// statusWriter records HTTP status code written by handler. It implements http.Flusher, as gRPC responses are streamed.
+type statusWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.statusCode = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -11,6 +11,8 @@ type ServerMetrics struct {
 	requestsTotal    *prometheus.CounterVec
 	requestsInFlight prometheus.Gauge
 	requestDuration  *prometheus.HistogramVec
+	timeToFirstByte  *prometheus.HistogramVec
+	streamDuration   *prometheus.HistogramVec
 	requestSize      *prometheus.SummaryVec
 	responseSize     *prometheus.SummaryVec
 }
@@ -38,6 +40,22 @@ func NewServerMetrics(reg prometheus.Registerer) *ServerMetrics {
 			},
 			[]string{"code", "method"},
 		),
+		timeToFirstByte: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "http_request_time_to_first_byte_seconds",
+				Help:    "Tracks the time until HTTP response header is written.",
+				Buckets: []float64{0.001, 0.01, 0.1, 0.3, 0.6, 1, 3, 6, 9, 20, 30, 60, 90, 120},
+			},
+			[]string{"code", "method"},
+		),
+		streamDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "http_stream_duration_seconds",
+				Help:    "Tracks the total duration of streaming HTTP responses, e.g server-sent events or chunked responses. Streams are not tracked by http_request_duration_seconds.",
+				Buckets: []float64{1, 10, 60, 300, 900, 1800, 3600, 3 * 3600, 12 * 3600},
+			},
+			[]string{"code", "method"},
+		),
 		requestSize: prometheus.NewSummaryVec(
 			prometheus.SummaryOpts{
 				Name: "http_request_size_bytes",
@@ -53,13 +71,14 @@ func NewServerMetrics(reg prometheus.Registerer) *ServerMetrics {
 			[]string{"code", "method"},
 		),
 	}
-	reg.MustRegister(ins.requestDuration, ins.requestSize, ins.requestsTotal, ins.requestsInFlight, ins.responseSize)
+	reg.MustRegister(ins.requestDuration, ins.timeToFirstByte, ins.streamDuration, ins.requestSize, ins.requestsTotal, ins.requestsInFlight, ins.responseSize)
 	return ins
 }
 
 func newMetricMiddleware(metrics *ServerMetrics, handler http.Handler) http.HandlerFunc {
-	return promhttp.InstrumentHandlerDuration(
-		metrics.requestDuration, promhttp.InstrumentHandlerRequestSize(
+	grpcInstrumented := newGRPCMetricMiddleware(metrics, handler)
+	instrumented := instrumentHandlerDurations(
+		metrics, promhttp.InstrumentHandlerRequestSize(
 			metrics.requestSize, promhttp.InstrumentHandlerCounter(
 				metrics.requestsTotal, promhttp.InstrumentHandlerInFlight(
 					metrics.requestsInFlight, promhttp.InstrumentHandlerResponseSize(
@@ -69,16 +88,36 @@ func newMetricMiddleware(metrics *ServerMetrics, handler http.Handler) http.Hand
 			),
 		),
 	)
+	upgradeInstrumented := newUpgradeMetricMiddleware(metrics, handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if IsGRPCRequest(r) {
+			grpcInstrumented(w, r)
+			return
+		}
+		if IsUpgradeRequest(r) {
+			// Upgraded connections are long-lived and would dominate duration and size metrics.
+			upgradeInstrumented(w, r)
+			return
+		}
+		instrumented(w, r)
+	}
 }
 
 // NewHandler wraps the given HTTP handler for instrumentation. It
-// registers four metric collectors (if not already done) and reports HTTP
+// registers metric collectors (if not already done) and reports HTTP
 // metrics to the (newly or already) registered collectors: http_requests_total
 // (CounterVec), http_request_duration_seconds (Histogram),
+// http_request_time_to_first_byte_seconds (Histogram),
+// http_stream_duration_seconds (Histogram),
 // http_request_size_bytes (Summary), http_response_size_bytes (Summary). Each
 // has a constant label named "handler" with the provided handlerName as
 // value. http_requests_total is a metric vector partitioned by HTTP method
-// (label name "method") and HTTP status code (label name "code").
+// (label name "method") and HTTP status code (label name "code"). For gRPC
+// calls, the code is the `grpc-status` and sizes are not observed. Upgrade
+// requests (e.g WebSocket) are only counted, with 101 code if the connection
+// was hijacked. Duration of streaming responses (server-sent events, chunked
+// responses or responses flushed without Content-Length) is tracked by
+// http_stream_duration_seconds instead of http_request_duration_seconds.
 func NewMetricsMiddlewareHandler(reg prometheus.Registerer, handlerName string, handler http.Handler) http.HandlerFunc {
 	return newMetricMiddleware(
 		NewServerMetrics(prometheus.WrapRegistererWith(prometheus.Labels{"handler": handlerName}, reg)),
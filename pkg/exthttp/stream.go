@@ -0,0 +1,109 @@
+package exthttp
+
+import (
+	"bufio"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// IsStreamingResponse returns true if response with the given headers is a long-lived stream, i.e server-sent events or
+// chunked response. Responses flushed without Content-Length are streams too, which is not known from headers alone.
+func IsStreamingResponse(h http.Header) bool {
+	if mt, _, err := mime.ParseMediaType(h.Get("Content-Type")); err == nil && mt == "text/event-stream" {
+		return true
+	}
+	for _, te := range h.Values("Transfer-Encoding") {
+		if strings.Contains(strings.ToLower(te), "chunked") {
+			return true
+		}
+	}
+	return false
+}
+
+// timingWriter records when the response header was written, its status code and whether it is a stream.
+type timingWriter struct {
+	http.ResponseWriter
+
+	statusCode int
+	headerTime time.Time
+	stream     bool
+	// contentLength is true if response header contains Content-Length.
+	contentLength bool
+}
+
+func (w *timingWriter) WriteHeader(code int) {
+	if w.headerTime.IsZero() {
+		w.headerTime = time.Now()
+		w.statusCode = code
+		w.stream = IsStreamingResponse(w.Header())
+		w.contentLength = w.Header().Get("Content-Length") != ""
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timingWriter) Write(b []byte) (int, error) {
+	if w.headerTime.IsZero() {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timingWriter) Flush() {
+	if w.headerTime.IsZero() {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.contentLength {
+		// Response of unknown length flushed as it goes, e.g proxied chunked response.
+		w.stream = true
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *timingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return hijack(w.ResponseWriter)
+}
+
+// Unwrap allows http.ResponseController to access the wrapped writer.
+func (w *timingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return h.Hijack()
+}
+
+// instrumentHandlerDurations observes time to first byte (response header) of all requests. Total duration is observed
+// separately for streams, so long-lived streams do not distort request latencies.
+func instrumentHandlerDurations(metrics *ServerMetrics, handler http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		tw := &timingWriter{ResponseWriter: w}
+		handler.ServeHTTP(tw, r)
+
+		if tw.headerTime.IsZero() {
+			// Nothing written, server responds with 200.
+			tw.headerTime = time.Now()
+			tw.statusCode = http.StatusOK
+		}
+		labels := prometheus.Labels{"code": strconv.Itoa(tw.statusCode), "method": strings.ToLower(r.Method)}
+		metrics.timeToFirstByte.With(labels).Observe(tw.headerTime.Sub(start).Seconds())
+		if tw.stream {
+			metrics.streamDuration.With(labels).Observe(time.Since(start).Seconds())
+			return
+		}
+		metrics.requestDuration.With(labels).Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,109 @@
+package exthttp
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestMetricMiddleware_ServerSentEvents(t *testing.T) {
+	release := make(chan struct{})
+	metrics := NewServerMetrics(prometheus.NewRegistry())
+	srv := httptest.NewServer(newMetricMiddleware(metrics, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("data: 1\n\n"))
+			// Middleware passes flushes through, otherwise the event would be stuck until the handler returns.
+			w.(http.Flusher).Flush()
+			<-release
+		},
+	)))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	testutil.Ok(t, err)
+	defer resp.Body.Close()
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	testutil.Ok(t, err)
+	testutil.Equals(t, "data: 1\n", line)
+	close(release)
+
+	// Wait for the handler to return.
+	_, _ = resp.Body.Read(make([]byte, 1))
+
+	testutil.Equals(t, 1, promtestutil.CollectAndCount(metrics.streamDuration))
+	testutil.Equals(t, 1, promtestutil.CollectAndCount(metrics.timeToFirstByte))
+	testutil.Equals(t, 0, promtestutil.CollectAndCount(metrics.requestDuration))
+}
+
+func TestMetricMiddleware_ChunkedStreams(t *testing.T) {
+	for _, tcase := range []struct {
+		name     string
+		handler  http.HandlerFunc
+		expected bool
+	}{
+		{
+			name: "flushed without Content-Length",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("chunk"))
+				w.(http.Flusher).Flush()
+			},
+			expected: true,
+		},
+		{
+			name: "explicitly chunked",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Transfer-Encoding", "chunked")
+				_, _ = w.Write([]byte("chunk"))
+			},
+			expected: true,
+		},
+		{
+			name: "flushed with Content-Length",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "5")
+				_, _ = w.Write([]byte("chunk"))
+				w.(http.Flusher).Flush()
+			},
+		},
+		{
+			name: "not flushed",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("chunk"))
+			},
+		},
+	} {
+		t.Run(tcase.name, func(t *testing.T) {
+			metrics := NewServerMetrics(prometheus.NewRegistry())
+			srv := httptest.NewServer(newMetricMiddleware(metrics, tcase.handler))
+			defer srv.Close()
+
+			resp, err := http.Get(srv.URL)
+			testutil.Ok(t, err)
+			_, err = ioutil.ReadAll(resp.Body)
+			testutil.Ok(t, err)
+			testutil.Ok(t, resp.Body.Close())
+
+			streams, requests := 0, 1
+			if tcase.expected {
+				streams, requests = 1, 0
+			}
+			// Handler is done once the whole body is read, but metrics are observed after it returns.
+			for i := 0; promtestutil.CollectAndCount(metrics.streamDuration)+promtestutil.CollectAndCount(metrics.requestDuration) == 0; i++ {
+				testutil.Assert(t, i < 100, "request was not observed")
+				time.Sleep(10 * time.Millisecond)
+			}
+			testutil.Equals(t, streams, promtestutil.CollectAndCount(metrics.streamDuration))
+			testutil.Equals(t, requests, promtestutil.CollectAndCount(metrics.requestDuration))
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package exthttp
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// phaseBuckets cover phases of a single request, from local DNS cache hits to slow cross-region handshakes.
+var phaseBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.3, 0.6, 1, 3, 10}
+
+// traceMetrics are metrics of request phases of a single target.
+type traceMetrics struct {
+	dnsDuration     prometheus.Observer
+	connectDuration prometheus.Observer
+	tlsDuration     prometheus.Observer
+	timeToFirstByte prometheus.Observer
+	connsObtained   *prometheus.CounterVec
+}
+
+func (m *ClientMetrics) traceMetrics(target string) *traceMetrics {
+	return &traceMetrics{
+		dnsDuration:     m.dnsDuration.WithLabelValues(target),
+		connectDuration: m.connectDuration.WithLabelValues(target),
+		tlsDuration:     m.tlsHandshakeDuration.WithLabelValues(target),
+		timeToFirstByte: m.timeToFirstByte.WithLabelValues(target),
+		connsObtained:   m.connsObtainedTotal.MustCurryWith(prometheus.Labels{"target": target}),
+	}
+}
+
+// instrumentRoundTripperTrace observes phases of requests with promhttp.InstrumentRoundTripperTrace: DNS lookup,
+// connect, TLS handshake and time to first response byte, and counts whether connections were reused. Phases of new
+// connections are observed only if the connection is dialed for this request.
+func instrumentRoundTripperTrace(metrics *traceMetrics, next http.RoundTripper) http.RoundTripper {
+	return promhttp.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		// InstrumentTrace hooks do not tell whether connection was reused, so it is traced separately.
+		r = r.WithContext(httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				metrics.connsObtained.WithLabelValues(strconv.FormatBool(info.Reused)).Inc()
+			},
+		}))
+		t := &requestTrace{metrics: metrics}
+		return promhttp.InstrumentRoundTripperTrace(t.instrumentTrace(), next).RoundTrip(r)
+	})
+}
+
+// requestTrace keeps phase start times of a single request, in seconds since the request start. Hooks are called from
+// different goroutines, e.g dialing happens concurrently with waiting for idle connection.
+type requestTrace struct {
+	metrics *traceMetrics
+
+	mu           sync.Mutex
+	dns          phase
+	connect      phase
+	tls          phase
+	gotFirstByte bool
+}
+
+// phase is a request phase that is observed once it is done.
+type phase struct {
+	start   float64
+	started bool
+}
+
+func (t *requestTrace) instrumentTrace() *promhttp.InstrumentTrace {
+	return &promhttp.InstrumentTrace{
+		DNSStart: func(at float64) { t.start(&t.dns, at) },
+		DNSDone:  func(at float64) { t.done(&t.dns, at, t.metrics.dnsDuration) },
+		// With multiple addresses (e.g IPv4 and IPv6), connect is observed from the first attempt until the first
+		// successful one.
+		ConnectStart:      func(at float64) { t.start(&t.connect, at) },
+		ConnectDone:       func(at float64) { t.done(&t.connect, at, t.metrics.connectDuration) },
+		TLSHandshakeStart: func(at float64) { t.start(&t.tls, at) },
+		TLSHandshakeDone:  func(at float64) { t.done(&t.tls, at, t.metrics.tlsDuration) },
+		GotFirstResponseByte: func(at float64) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			// Informational (1xx) responses are followed by the final one, which is not the first byte anymore.
+			if t.gotFirstByte {
+				return
+			}
+			t.gotFirstByte = true
+			t.metrics.timeToFirstByte.Observe(at)
+		},
+	}
+}
+
+func (t *requestTrace) start(p *phase, at float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if p.started {
+		return
+	}
+	p.start, p.started = at, true
+}
+
+// done observes the given phase. Failed connect and TLS handshake attempts are not reported by InstrumentTrace, so
+// they are included in the duration of the phase that succeeds. DNS lookups are observed even if they fail.
+func (t *requestTrace) done(p *phase, at float64, o prometheus.Observer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !p.started {
+		return
+	}
+	o.Observe(at - p.start)
+	p.started = false
+}
@@ -0,0 +1,67 @@
+package exthttp
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestMetricTripperware_Trace(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	transport := srv.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	defer transport.CloseIdleConnections()
+
+	reg := prometheus.NewRegistry()
+	metrics := NewClientMetrics(reg)
+	// Use host name, so DNS lookup is done.
+	url := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	for i := 0; i < 2; i++ {
+		resp, err := NewMetricTripperware(metrics, "a", transport).RoundTrip(httptest.NewRequest("GET", url, nil))
+		testutil.Ok(t, err)
+		_, err = ioutil.ReadAll(resp.Body)
+		testutil.Ok(t, err)
+		testutil.Ok(t, resp.Body.Close())
+	}
+
+	for name, expected := range map[string]uint64{
+		"http_client_dns_duration_seconds":           1,
+		"http_client_connect_duration_seconds":       1,
+		"http_client_tls_handshake_duration_seconds": 1,
+		"http_client_time_to_first_byte_seconds":     2,
+	} {
+		testutil.Equals(t, expected, histogramCount(t, reg, name), "%s", name)
+	}
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.connsObtainedTotal.WithLabelValues("a", "false")))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.connsObtainedTotal.WithLabelValues("a", "true")))
+
+	metrics.DeleteTarget("a")
+	testutil.Equals(t, 0, promtestutil.CollectAndCount(metrics.connsObtainedTotal))
+	testutil.Equals(t, 0, promtestutil.CollectAndCount(metrics.timeToFirstByte))
+}
+
+func histogramCount(t *testing.T, g prometheus.Gatherer, name string) uint64 {
+	t.Helper()
+
+	mfs, err := g.Gather()
+	testutil.Ok(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			return mf.GetMetric()[0].GetHistogram().GetSampleCount()
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+	return 0
+}
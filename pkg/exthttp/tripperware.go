@@ -3,6 +3,7 @@ package exthttp
 import (
 	"net/http"
 
+	"github.com/observatorium/observable-demo/pkg/extprom"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -11,10 +12,27 @@ type ClientMetrics struct {
 	requestsTotal    *prometheus.CounterVec
 	requestsInFlight *prometheus.GaugeVec
 	requestDuration  *prometheus.HistogramVec
+
+	dnsDuration          *prometheus.HistogramVec
+	connectDuration      *prometheus.HistogramVec
+	tlsHandshakeDuration *prometheus.HistogramVec
+	timeToFirstByte      *prometheus.HistogramVec
+	connsObtainedTotal   *prometheus.CounterVec
+
+	targetLimiter *extprom.LabelLimiter
+}
+
+// ClientMetricsOption configures ClientMetrics.
+type ClientMetricsOption func(*ClientMetrics)
+
+// WithTargetLimiter limits number of distinct target label values with the given limiter. Targets over the limit are
+// observed as `other`.
+func WithTargetLimiter(l *extprom.LabelLimiter) ClientMetricsOption {
+	return func(m *ClientMetrics) { m.targetLimiter = l }
 }
 
 // NewClientMetrics provides ClientMetrics.
-func NewClientMetrics(reg prometheus.Registerer) *ClientMetrics {
+func NewClientMetrics(reg prometheus.Registerer, opts ...ClientMetricsOption) *ClientMetrics {
 	ins := &ClientMetrics{
 		requestsTotal: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
@@ -36,19 +54,94 @@ func NewClientMetrics(reg prometheus.Registerer) *ClientMetrics {
 			},
 			[]string{"target", "code", "method"},
 		),
+		dnsDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "http_client_dns_duration_seconds",
+				Help:    "Tracks the latencies of DNS lookups of HTTP client requests.",
+				Buckets: phaseBuckets,
+			}, []string{"target"},
+		),
+		connectDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "http_client_connect_duration_seconds",
+				Help:    "Tracks the latencies of establishing TCP connections of HTTP client requests.",
+				Buckets: phaseBuckets,
+			}, []string{"target"},
+		),
+		tlsHandshakeDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "http_client_tls_handshake_duration_seconds",
+				Help:    "Tracks the latencies of TLS handshakes of HTTP client requests.",
+				Buckets: phaseBuckets,
+			}, []string{"target"},
+		),
+		timeToFirstByte: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "http_client_time_to_first_byte_seconds",
+				Help:    "Tracks the latencies from the start of HTTP client requests to the first byte of response.",
+				Buckets: []float64{0.001, 0.01, 0.1, 0.3, 0.6, 1, 3, 6, 9, 20, 30, 60, 90, 120},
+			}, []string{"target"},
+		),
+		connsObtainedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "http_client_connections_obtained_total",
+				Help: "Tracks the number of connections obtained for HTTP client requests, by whether connection was reused from the idle pool.",
+			}, []string{"target", "reused"},
+		),
+	}
+	for _, opt := range opts {
+		opt(ins)
 	}
 	if reg != nil {
 		reg.MustRegister(ins.requestDuration, ins.requestsInFlight, ins.requestsTotal)
+		reg.MustRegister(ins.dnsDuration, ins.connectDuration, ins.tlsHandshakeDuration, ins.timeToFirstByte, ins.connsObtainedTotal)
 	}
 	return ins
 }
 
+// NewMetricTripperware instruments round trips to the given target. gRPC calls are observed once the response stream
+// ends, with `grpc-status` as the code label. Upgrade requests (e.g WebSocket) are not observed in duration histogram,
+// as upgraded connections are long-lived. Phases of all requests (DNS lookup, connect, TLS handshake, time to first
+// byte) are observed separately.
 func NewMetricTripperware(metrics *ClientMetrics, target string, next http.RoundTripper) promhttp.RoundTripperFunc {
-	return promhttp.InstrumentRoundTripperDuration(
+	target = metrics.targetLimiter.Value(target)
+	next = instrumentRoundTripperTrace(metrics.traceMetrics(target), next)
+	instrumented := promhttp.InstrumentRoundTripperDuration(
 		metrics.requestDuration.MustCurryWith(prometheus.Labels{"target": target}), promhttp.InstrumentRoundTripperCounter(
 			metrics.requestsTotal.MustCurryWith(prometheus.Labels{"target": target}), promhttp.InstrumentRoundTripperInFlight(
 				metrics.requestsInFlight.WithLabelValues(target), next,
 			),
 		),
 	)
+	upgradeInstrumented := promhttp.InstrumentRoundTripperCounter(
+		metrics.requestsTotal.MustCurryWith(prometheus.Labels{"target": target}), promhttp.InstrumentRoundTripperInFlight(
+			metrics.requestsInFlight.WithLabelValues(target), next,
+		),
+	)
+	return func(r *http.Request) (*http.Response, error) {
+		if IsGRPCRequest(r) {
+			return grpcRoundTrip(metrics, target, next, r)
+		}
+		if IsUpgradeRequest(r) {
+			return upgradeInstrumented(r)
+		}
+		return instrumented(r)
+	}
+}
+
+// DeleteTarget removes all series with the given target label. Useful to avoid unbounded cardinality when targets
+// come and go.
+func (m *ClientMetrics) DeleteTarget(target string) {
+	if !m.targetLimiter.Forget(target) {
+		// Target was observed as `other`, which is shared with other targets.
+		return
+	}
+	m.requestsInFlight.DeleteLabelValues(target)
+	m.dnsDuration.DeleteLabelValues(target)
+	m.connectDuration.DeleteLabelValues(target)
+	m.tlsHandshakeDuration.DeleteLabelValues(target)
+	m.timeToFirstByte.DeleteLabelValues(target)
+	extprom.DeleteMatching(m.connsObtainedTotal, m.connsObtainedTotal.Delete, "target", target)
+	extprom.DeleteMatching(m.requestsTotal, m.requestsTotal.Delete, "target", target)
+	extprom.DeleteMatching(m.requestDuration, m.requestDuration.Delete, "target", target)
 }
@@ -0,0 +1,66 @@
+package exthttp
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// IsUpgradeRequest returns true if the given request asks for protocol upgrade (e.g to WebSocket) via
+// `Connection: Upgrade` header.
+func IsUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header["Connection"] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// newUpgradeMetricMiddleware counts upgrade requests (e.g WebSocket) handled by the given handler. Handlers write
+// `101 Switching Protocols` directly to the hijacked connection (e.g httputil.ReverseProxy does), so hijacked requests
+// are counted with 101 code.
+func newUpgradeMetricMiddleware(metrics *ServerMetrics, handler http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metrics.requestsInFlight.Inc()
+		defer metrics.requestsInFlight.Dec()
+
+		hw := &hijackStatusWriter{statusWriter: statusWriter{ResponseWriter: w, statusCode: http.StatusOK}}
+		handler.ServeHTTP(hw, r)
+
+		code := hw.statusCode
+		if hw.hijacked {
+			code = http.StatusSwitchingProtocols
+		}
+		metrics.requestsTotal.With(prometheus.Labels{"code": strconv.Itoa(code), "method": strings.ToLower(r.Method)}).Inc()
+	}
+}
+
+// hijackStatusWriter records HTTP status code written by handler and whether the connection was hijacked.
+type hijackStatusWriter struct {
+	statusWriter
+
+	hijacked bool
+}
+
+func (w *hijackStatusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := hijack(w.ResponseWriter)
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, brw, err
+}
+
+// Unwrap allows http.ResponseController to access the wrapped writer.
+func (w *hijackStatusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,50 @@
+package exthttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestMetricMiddleware_Upgrade(t *testing.T) {
+	metrics := NewServerMetrics(prometheus.NewRegistry())
+	handler := newMetricMiddleware(metrics, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "unsupported protocol", http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = brw.Flush()
+	}))
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	for _, protocol := range []string{"echo", "other"} {
+		r, err := http.NewRequest("GET", srv.URL, nil)
+		testutil.Ok(t, err)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", protocol)
+		resp, err := http.DefaultTransport.RoundTrip(r)
+		testutil.Ok(t, err)
+		testutil.Ok(t, resp.Body.Close())
+	}
+
+	// Hijacked connection is counted with the code written to it, once handler returns.
+	for i := 0; promtestutil.ToFloat64(metrics.requestsInFlight) != 0; i++ {
+		testutil.Assert(t, i < 100, "upgrade request was not finished")
+		time.Sleep(10 * time.Millisecond)
+	}
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.requestsTotal.WithLabelValues("101", "get")))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.requestsTotal.WithLabelValues("400", "get")))
+}
@@ -0,0 +1,135 @@
+// Package extprom contains helpers for Prometheus metrics shared by other packages.
+package extprom
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// OtherValue is the value that label values over the limit collapse into.
+const OtherValue = "other"
+
+// LabelLimiter limits number of distinct values of a metric label, e.g target address, so cardinality of metrics stays
+// bounded. Once the limit is reached, new values collapse into OtherValue. Limiter can be shared by metrics of
+// different packages using the same label values. Nil LabelLimiter does not limit anything.
+type LabelLimiter struct {
+	max           int
+	key           func(string) string
+	overflowTotal prometheus.Counter
+
+	mu sync.Mutex
+	// values are the allowed values by their key. Values with the same key take a single slot.
+	values map[string]map[string]struct{}
+}
+
+// LabelLimiterOption configures LabelLimiter.
+type LabelLimiterOption func(*LabelLimiter)
+
+// WithValueKey makes values with the same key take a single slot of the limit, e.g URL and address of the same target
+// used as label values by different metrics.
+func WithValueKey(key func(string) string) LabelLimiterOption {
+	return func(l *LabelLimiter) { l.key = key }
+}
+
+// NewLabelLimiter returns LabelLimiter allowing up to max distinct label values. Zero max means no limit. Name identifies
+// the limiter in `label_value_overflow_observations_total` metric, e.g `dialer_target`.
+func NewLabelLimiter(reg prometheus.Registerer, name string, max int, opts ...LabelLimiterOption) *LabelLimiter {
+	l := &LabelLimiter{
+		max: max,
+		key: func(v string) string { return v },
+		overflowTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "label_value_overflow_observations_total",
+			Help:        "Total number of observations with label value replaced with 'other', because the limit of distinct label values was reached. Every observation is counted, not distinct values.",
+			ConstLabels: prometheus.Labels{"limiter": name},
+		}),
+		values: map[string]map[string]struct{}{},
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if reg != nil {
+		reg.MustRegister(l.overflowTotal)
+	}
+	return l
+}
+
+// Value returns the given value if it is already known or the limit is not reached yet, OtherValue otherwise. Every
+// call returning OtherValue is counted as overflow observation.
+func (l *LabelLimiter) Value(v string) string {
+	if l == nil || l.max <= 0 {
+		return v
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	k := l.key(v)
+	if vs, ok := l.values[k]; ok {
+		vs[v] = struct{}{}
+		return v
+	}
+	if len(l.values) >= l.max {
+		l.overflowTotal.Inc()
+		return OtherValue
+	}
+	l.values[k] = map[string]struct{}{v: {}}
+	return v
+}
+
+// Forget forgets the given value, e.g once target is gone. Its slot is freed once all values with the same key are
+// forgotten. It returns false if value was collapsed into OtherValue, so series with this value do not exist and
+// should not be deleted.
+func (l *LabelLimiter) Forget(v string) bool {
+	if l == nil || l.max <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	k := l.key(v)
+	vs, ok := l.values[k]
+	if !ok {
+		return false
+	}
+	if _, ok := vs[v]; !ok {
+		return false
+	}
+	delete(vs, v)
+	if len(vs) == 0 {
+		delete(l.values, k)
+	}
+	return true
+}
+
+// DeleteMatching deletes all series from the given metric vector that have label with the given value. The given
+// delete function is the vector's Delete method.
+func DeleteMatching(vec prometheus.Collector, del func(prometheus.Labels) bool, name, value string) {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		vec.Collect(ch)
+		close(ch)
+	}()
+
+	var toDelete []prometheus.Labels
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			continue
+		}
+
+		lset := prometheus.Labels{}
+		for _, lp := range pb.GetLabel() {
+			lset[lp.GetName()] = lp.GetValue()
+		}
+		if lset[name] == value {
+			toDelete = append(toDelete, lset)
+		}
+	}
+
+	for _, lset := range toDelete {
+		del(lset)
+	}
+}
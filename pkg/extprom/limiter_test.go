@@ -0,0 +1,56 @@
+package extprom
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestLabelLimiter(t *testing.T) {
+	l := NewLabelLimiter(prometheus.NewRegistry(), "test", 2)
+
+	testutil.Equals(t, "a", l.Value("a"))
+	testutil.Equals(t, "b", l.Value("b"))
+	testutil.Equals(t, "a", l.Value("a"))
+	testutil.Equals(t, OtherValue, l.Value("c"))
+	testutil.Equals(t, OtherValue, l.Value("d"))
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(l.overflowTotal))
+
+	testutil.Assert(t, !l.Forget("c"), "collapsed value should not be forgotten")
+	testutil.Assert(t, l.Forget("a"), "known value should be forgotten")
+	testutil.Equals(t, "c", l.Value("c"))
+	testutil.Equals(t, OtherValue, l.Value("a"))
+
+	var unlimited *LabelLimiter
+	testutil.Equals(t, "a", unlimited.Value("a"))
+	testutil.Assert(t, unlimited.Forget("a"), "nil limiter should allow deleting every value")
+}
+
+func TestLabelLimiter_ValueKey(t *testing.T) {
+	l := NewLabelLimiter(prometheus.NewRegistry(), "test", 1, WithValueKey(func(v string) string { return strings.TrimPrefix(v, "http://") }))
+
+	// URL and address of the same target take a single slot.
+	testutil.Equals(t, "http://a", l.Value("http://a"))
+	testutil.Equals(t, "a", l.Value("a"))
+	testutil.Equals(t, OtherValue, l.Value("b"))
+
+	// Slot is freed only once both values are forgotten.
+	testutil.Assert(t, l.Forget("http://a"), "known value should be forgotten")
+	testutil.Assert(t, !l.Forget("http://a"), "forgotten value should not be forgotten again")
+	testutil.Equals(t, OtherValue, l.Value("b"))
+	testutil.Assert(t, l.Forget("a"), "known value should be forgotten")
+	testutil.Equals(t, "b", l.Value("b"))
+}
+
+func TestDeleteMatching(t *testing.T) {
+	vec := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_total"}, []string{"target", "code"})
+	vec.WithLabelValues("a", "200")
+	vec.WithLabelValues("a", "500")
+	vec.WithLabelValues("b", "200")
+
+	DeleteMatching(vec, vec.Delete, "target", "a")
+	testutil.Equals(t, 1, promtestutil.CollectAndCount(vec))
+}
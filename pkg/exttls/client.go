@@ -0,0 +1,97 @@
+package exttls
+
+import (
+	"crypto/tls"
+
+	"github.com/pkg/errors"
+)
+
+// ClientConfig is a configuration of TLS client. Empty value means TLS with system roots and no client certificate.
+type ClientConfig struct {
+	// CAFile is a path to CA bundle used to verify server certificates. System roots are used if empty.
+	CAFile string
+	// CertFile and KeyFile are paths to client certificate and key used for mTLS.
+	CertFile string
+	KeyFile  string
+	// ServerName overrides server name used for SNI and verification.
+	ServerName string
+	// MinVersion is a minimum TLS version, e.g tls.VersionTLS12.
+	MinVersion         uint16
+	InsecureSkipVerify bool
+}
+
+// ClientTLS builds TLS client configurations. CA and client certificate files are reloaded when they change on disk.
+type ClientTLS struct {
+	cfg ClientConfig
+
+	ca *CAReloader
+	kp *KeyPairReloader
+}
+
+// NewClientTLS returns ClientTLS for the given configuration. It fails if configured files cannot be loaded.
+func NewClientTLS(c ClientConfig) (*ClientTLS, error) {
+	ct := &ClientTLS{cfg: c}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errors.New("both client certificate and key files have to be specified")
+	}
+	if c.CertFile != "" {
+		kp, err := NewKeyPairReloader(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		ct.kp = kp
+	}
+	if c.CAFile != "" {
+		ca, err := NewCAReloader(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		ct.ca = ca
+	}
+	return ct, nil
+}
+
+// Config returns tls.Config for connection to the given server name, using the current CA bundle.
+// Configured ServerName takes precedence over the given one.
+func (c *ClientTLS) Config(serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		MinVersion:         c.cfg.MinVersion,
+		InsecureSkipVerify: c.cfg.InsecureSkipVerify, // nolint: gosec
+	}
+	if c.cfg.ServerName != "" {
+		cfg.ServerName = c.cfg.ServerName
+	}
+
+	if c.ca != nil {
+		pool, err := c.ca.Get()
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if c.kp != nil {
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return c.kp.Get()
+		}
+	}
+	return cfg, nil
+}
+
+// ParseVersion parses TLS version in form of "1.0", "1.1", "1.2" or "1.3". Empty string means no minimum version (0).
+func ParseVersion(v string) (uint16, error) {
+	switch v {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, errors.Errorf("unknown TLS version %q", v)
+}
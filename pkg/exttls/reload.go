@@ -0,0 +1,169 @@
+package exttls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// modTimes returns modification times of given files.
+func modTimes(files ...string) ([]time.Time, error) {
+	mods := make([]time.Time, 0, len(files))
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		mods = append(mods, fi.ModTime())
+	}
+	return mods, nil
+}
+
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// reloadCheckInterval is how often reloaders check files for changes at most. Reloaders are asked on every TLS
+// handshake, so checking every time would stat all files on every connection.
+const reloadCheckInterval = 1 * time.Second
+
+// KeyPairReloader loads certificate and key from files and reloads them once any of the files changes on disk.
+// Files are checked for changes at most once per second. If reload fails, the previously loaded key pair is used.
+type KeyPairReloader struct {
+	certFile, keyFile string
+	checkInterval     time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	mods    []time.Time
+	cert    *tls.Certificate
+}
+
+// NewKeyPairReloader returns KeyPairReloader with initially loaded key pair.
+func NewKeyPairReloader(certFile, keyFile string) (*KeyPairReloader, error) {
+	r := &KeyPairReloader{certFile: certFile, keyFile: keyFile, checkInterval: reloadCheckInterval}
+	if _, err := r.Get(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Get returns current key pair, reloading it first if files changed.
+func (r *KeyPairReloader) Get() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if r.cert != nil && now.Sub(r.checked) < r.checkInterval {
+		return r.cert, nil
+	}
+	r.checked = now
+
+	mods, err := modTimes(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, errors.Wrap(err, "stat key pair")
+	}
+	if r.cert != nil && equalTimes(mods, r.mods) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		if r.cert != nil {
+			return r.cert, nil
+		}
+		return nil, errors.Wrapf(err, "load key pair %s, %s", r.certFile, r.keyFile)
+	}
+	if cert.Leaf == nil {
+		// Parsed leaf is used e.g for choosing certificate by SNI.
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			if r.cert != nil {
+				return r.cert, nil
+			}
+			return nil, errors.Wrapf(err, "parse certificate %s", r.certFile)
+		}
+	}
+	r.cert, r.mods = &cert, mods
+	return r.cert, nil
+}
+
+// CAReloader loads CA bundle from file and reloads it once the file changes on disk.
+// The file is checked for changes at most once per second. If reload fails, the previously loaded pool is used.
+type CAReloader struct {
+	caFile        string
+	checkInterval time.Duration
+
+	mu      sync.Mutex
+	checked time.Time
+	mods    []time.Time
+	pool    *x509.CertPool
+}
+
+// NewCAReloader returns CAReloader with initially loaded CA bundle.
+func NewCAReloader(caFile string) (*CAReloader, error) {
+	r := &CAReloader{caFile: caFile, checkInterval: reloadCheckInterval}
+	if _, err := r.Get(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Get returns current CA pool, reloading it first if the file changed.
+func (r *CAReloader) Get() (*x509.CertPool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if r.pool != nil && now.Sub(r.checked) < r.checkInterval {
+		return r.pool, nil
+	}
+	r.checked = now
+
+	mods, err := modTimes(r.caFile)
+	if err != nil {
+		if r.pool != nil {
+			return r.pool, nil
+		}
+		return nil, errors.Wrap(err, "stat CA")
+	}
+	if r.pool != nil && equalTimes(mods, r.mods) {
+		return r.pool, nil
+	}
+
+	pool, err := loadCAPool(r.caFile)
+	if err != nil {
+		if r.pool != nil {
+			return r.pool, nil
+		}
+		return nil, err
+	}
+	r.pool, r.mods = pool, mods
+	return r.pool, nil
+}
+
+func loadCAPool(caFile string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read CA %s", caFile)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.Errorf("no certificate found in CA %s", caFile)
+	}
+	return pool, nil
+}
@@ -0,0 +1,106 @@
+package exttls
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/observatorium/observable-demo/pkg/internal/testtls"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestReloaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exttls")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	now := time.Now()
+	testtls.WriteKeyPair(t, certFile, keyFile, "first", now)
+
+	kp, err := NewKeyPairReloader(certFile, keyFile)
+	testutil.Ok(t, err)
+	ca, err := NewCAReloader(certFile)
+	testutil.Ok(t, err)
+	// Files are checked on every Get.
+	kp.checkInterval, ca.checkInterval = 0, 0
+
+	cert, err := kp.Get()
+	testutil.Ok(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	testutil.Ok(t, err)
+	testutil.Equals(t, "first", leaf.Subject.CommonName)
+	pool, err := ca.Get()
+	testutil.Ok(t, err)
+
+	// Unchanged files are not reloaded.
+	cert2, err := kp.Get()
+	testutil.Ok(t, err)
+	testutil.Assert(t, cert == cert2, "key pair should not be reloaded")
+
+	testtls.WriteKeyPair(t, certFile, keyFile, "second", now.Add(1*time.Second))
+	cert, err = kp.Get()
+	testutil.Ok(t, err)
+	leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	testutil.Ok(t, err)
+	testutil.Equals(t, "second", leaf.Subject.CommonName)
+	pool2, err := ca.Get()
+	testutil.Ok(t, err)
+	testutil.Assert(t, pool != pool2, "CA should be reloaded")
+
+	// Broken files do not replace loaded ones.
+	testutil.Ok(t, ioutil.WriteFile(certFile, []byte("broken"), 0600))
+	testutil.Ok(t, os.Chtimes(certFile, now.Add(2*time.Second), now.Add(2*time.Second)))
+	cert2, err = kp.Get()
+	testutil.Ok(t, err)
+	testutil.Assert(t, cert == cert2, "previous key pair should be used")
+	pool, err = ca.Get()
+	testutil.Ok(t, err)
+	testutil.Assert(t, pool == pool2, "previous CA should be used")
+
+	_, err = NewKeyPairReloader(certFile, keyFile)
+	testutil.NotOk(t, err)
+	_, err = NewClientTLS(ClientConfig{CertFile: certFile})
+	testutil.NotOk(t, err)
+}
+
+func TestReloaders_CheckInterval(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exttls")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	now := time.Now()
+	testtls.WriteKeyPair(t, certFile, keyFile, "first", now)
+
+	kp, err := NewKeyPairReloader(certFile, keyFile)
+	testutil.Ok(t, err)
+	kp.checkInterval = 100 * time.Millisecond
+	ca, err := NewCAReloader(certFile)
+	testutil.Ok(t, err)
+	ca.checkInterval = 100 * time.Millisecond
+	cert, err := kp.Get()
+	testutil.Ok(t, err)
+	pool, err := ca.Get()
+	testutil.Ok(t, err)
+
+	// Changes are not noticed until check interval passes, so busy listeners do not stat files on every handshake.
+	testtls.WriteKeyPair(t, certFile, keyFile, "second", now.Add(1*time.Second))
+	cert2, err := kp.Get()
+	testutil.Ok(t, err)
+	testutil.Assert(t, cert == cert2, "key pair should not be checked yet")
+	pool2, err := ca.Get()
+	testutil.Ok(t, err)
+	testutil.Assert(t, pool == pool2, "CA should not be checked yet")
+
+	time.Sleep(150 * time.Millisecond)
+	cert, err = kp.Get()
+	testutil.Ok(t, err)
+	testutil.Equals(t, "second", cert.Leaf.Subject.CommonName)
+	pool2, err = ca.Get()
+	testutil.Ok(t, err)
+	testutil.Assert(t, pool != pool2, "CA should be reloaded")
+}
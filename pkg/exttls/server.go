@@ -0,0 +1,101 @@
+package exttls
+
+import (
+	"crypto/tls"
+
+	"github.com/pkg/errors"
+)
+
+// KeyPairFiles are paths to certificate and its key.
+type KeyPairFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+// ServerConfig is a configuration of TLS server.
+type ServerConfig struct {
+	// KeyPairs are served certificates. Certificate is chosen by SNI server name, first one is used if none matches.
+	KeyPairs []KeyPairFiles
+	// ClientCAFile is a path to CA bundle used to verify client certificates. Client certificates are not verified if empty.
+	ClientCAFile string
+	// RequireClientCert makes client certificate required. Otherwise it is verified only if given. It requires
+	// ClientCAFile.
+	RequireClientCert bool
+	// MinVersion is a minimum TLS version, e.g tls.VersionTLS12.
+	MinVersion uint16
+}
+
+// NewServerTLSConfig returns tls.Config for the given configuration. Certificate and CA files are reloaded when they
+// change on disk.
+func NewServerTLSConfig(c ServerConfig) (*tls.Config, error) {
+	if len(c.KeyPairs) == 0 {
+		return nil, errors.New("at least one key pair is required")
+	}
+	if c.RequireClientCert && c.ClientCAFile == "" {
+		// Otherwise client certificates would not be verified at all.
+		return nil, errors.New("client CA file is required to require client certificates")
+	}
+
+	kps := make([]*KeyPairReloader, 0, len(c.KeyPairs))
+	for _, kp := range c.KeyPairs {
+		r, err := NewKeyPairReloader(kp.CertFile, kp.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		kps = append(kps, r)
+	}
+
+	var ca *CAReloader
+	if c.ClientCAFile != "" {
+		var err error
+		if ca, err = NewCAReloader(c.ClientCAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	clientAuth := tls.VerifyClientCertIfGiven
+	if c.RequireClientCert {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return &tls.Config{
+		MinVersion: c.MinVersion,
+		// Config for each handshake is built from currently loaded files.
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, err := chooseCertificate(kps, hello.ServerName)
+			if err != nil {
+				return nil, err
+			}
+
+			cfg := &tls.Config{
+				MinVersion:   c.MinVersion,
+				Certificates: []tls.Certificate{*cert},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			if ca != nil {
+				pool, err := ca.Get()
+				if err != nil {
+					return nil, err
+				}
+				cfg.ClientCAs = pool
+				cfg.ClientAuth = clientAuth
+			}
+			return cfg, nil
+		},
+	}, nil
+}
+
+func chooseCertificate(kps []*KeyPairReloader, serverName string) (*tls.Certificate, error) {
+	if serverName != "" {
+		for _, kp := range kps {
+			cert, err := kp.Get()
+			if err != nil {
+				return nil, err
+			}
+			if cert.Leaf.VerifyHostname(serverName) == nil {
+				return cert, nil
+			}
+		}
+	}
+	return kps[0].Get()
+}
@@ -0,0 +1,116 @@
+package exttls
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/observatorium/observable-demo/pkg/conntrack"
+	"github.com/observatorium/observable-demo/pkg/internal/testtls"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestServerTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exttls")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var kps []KeyPairFiles
+	for _, name := range []string{"a", "b", "client"} {
+		kp := KeyPairFiles{CertFile: filepath.Join(dir, name+".crt"), KeyFile: filepath.Join(dir, name+".key")}
+		testtls.WriteKeyPair(t, kp.CertFile, kp.KeyFile, name, time.Now(), name+".example.com")
+		kps = append(kps, kp)
+	}
+
+	// Client certificates cannot be required without CA to verify them.
+	_, err = NewServerTLSConfig(ServerConfig{KeyPairs: kps[:2], RequireClientCert: true})
+	testutil.NotOk(t, err)
+
+	serverConfig, err := NewServerTLSConfig(ServerConfig{
+		KeyPairs:          kps[:2],
+		ClientCAFile:      kps[2].CertFile,
+		RequireClientCert: true,
+	})
+	testutil.Ok(t, err)
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	reg := prometheus.NewRegistry()
+	l := conntrack.NewInstrumentedTLSListener(inner, serverConfig, 5*time.Second, conntrack.NewListenerMetrics(reg))
+	defer func() { _ = l.Close() }()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("hello"))
+			_ = conn.Close()
+		}
+	}()
+
+	serverCA, err := NewClientTLS(ClientConfig{CAFile: kps[0].CertFile, CertFile: kps[2].CertFile, KeyFile: kps[2].KeyFile})
+	testutil.Ok(t, err)
+	withClientCert, err := serverCA.Config("a.example.com")
+	testutil.Ok(t, err)
+
+	// Certificate of "a" is chosen for a.example.com.
+	conn, err := tls.Dial("tcp", l.Addr().String(), withClientCert)
+	testutil.Ok(t, err)
+	b, err := ioutil.ReadAll(conn)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "hello", string(b))
+	testutil.Equals(t, "a", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	testutil.Ok(t, conn.Close())
+
+	// Certificate of "b" is chosen for b.example.com.
+	conn, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		ServerName:           "b.example.com",
+		InsecureSkipVerify:   true, // nolint: gosec
+		GetClientCertificate: withClientCert.GetClientCertificate,
+	})
+	testutil.Ok(t, err)
+	testutil.Equals(t, "b", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	testutil.Ok(t, conn.Close())
+
+	// Without client certificate handshake fails.
+	noClientCert, err := NewClientTLS(ClientConfig{CAFile: kps[0].CertFile})
+	testutil.Ok(t, err)
+	cfg, err := noClientCert.Config("a.example.com")
+	testutil.Ok(t, err)
+	conn, err = tls.Dial("tcp", l.Addr().String(), cfg)
+	if err == nil {
+		// With TLS 1.3 client finishes handshake before server verifies client certificate.
+		_, err = ioutil.ReadAll(conn)
+		_ = conn.Close()
+	}
+	testutil.NotOk(t, err)
+
+	// Failed handshake is counted once server gives up on the connection.
+	expected := `
+# HELP conntrack_listener_tls_handshake_failed_total Total number of failed TLS handshakes of connections made to the listener, by reason (timeout or other e.g bad certificate).
+# TYPE conntrack_listener_tls_handshake_failed_total counter
+conntrack_listener_tls_handshake_failed_total{reason="other"} 1
+conntrack_listener_tls_handshake_failed_total{reason="timeout"} 0
+# HELP conntrack_listener_tls_handshakes_total Total number of successful TLS handshakes of connections made to the listener.
+# TYPE conntrack_listener_tls_handshakes_total counter
+conntrack_listener_tls_handshakes_total 2
+`
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err = promtestutil.GatherAndCompare(reg, strings.NewReader(expected), "conntrack_listener_tls_handshakes_total", "conntrack_listener_tls_handshake_failed_total")
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	testutil.Ok(t, err)
+}
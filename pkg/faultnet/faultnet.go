@@ -0,0 +1,309 @@
+// Package faultnet contains fault-injecting wrappers of listeners, dialers and connections, for repeatable resilience
+// tests and demos without network chaos tools. Faults are drawn from a seeded random source, so the same seed gives
+// the same sequence of faults, as long as connections are used in the same order.
+package faultnet
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type options struct {
+	refuseProbability  float64
+	refuseEvery        uint64
+	latency            time.Duration
+	latencyJitter      time.Duration
+	bytesPerSecond     int
+	resetProbability   float64
+	hangProbability    float64
+	partialProbability float64
+	seed               int64
+}
+
+// Option configures Injector.
+type Option func(*options)
+
+// WithRefusal makes accepts and dials refused with the given probability.
+func WithRefusal(p float64) Option {
+	return func(o *options) { o.refuseProbability = p }
+}
+
+// WithRefuseEvery makes every n-th accept or dial refused, regardless of probability set with WithRefusal.
+func WithRefuseEvery(n int) Option {
+	return func(o *options) { o.refuseEvery = uint64(n) }
+}
+
+// WithLatency adds the given latency, plus random jitter up to the given maximum, to each dial, accept and write.
+func WithLatency(latency, jitter time.Duration) Option {
+	return func(o *options) {
+		o.latency = latency
+		o.latencyJitter = jitter
+	}
+}
+
+// WithBandwidth throttles reads and writes of each connection to the given number of bytes per second, in each
+// direction. Zero means no limit.
+func WithBandwidth(bytesPerSecond int) Option {
+	return func(o *options) { o.bytesPerSecond = bytesPerSecond }
+}
+
+// WithReset makes each read or write reset the connection with the given probability. The connection is closed with
+// RST (if it is TCP connection), so the peer sees `connection reset by peer`, and the read or write fails with
+// ECONNRESET.
+func WithReset(p float64) Option {
+	return func(o *options) { o.resetProbability = p }
+}
+
+// WithHang makes connections half-open with the given probability, as if the peer disappeared without closing the
+// connection: writes succeed but nothing is sent, and reads block until the read deadline or close, discarding anything
+// the peer sends.
+func WithHang(p float64) Option {
+	return func(o *options) { o.hangProbability = p }
+}
+
+// WithPartialWrites makes each write send only a random part of the data with the given probability. Such write fails
+// with io.ErrShortWrite.
+func WithPartialWrites(p float64) Option {
+	return func(o *options) { o.partialProbability = p }
+}
+
+// WithSeed sets seed of the random source faults are drawn from. Default: current time.
+func WithSeed(seed int64) Option {
+	return func(o *options) { o.seed = seed }
+}
+
+// Injector injects configured faults into wrapped listeners, dialers and connections. It is safe for concurrent use.
+type Injector struct {
+	opts options
+
+	// attempts counts accepts and dials, for WithRefuseEvery.
+	attempts uint64
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// New returns Injector injecting the given faults. Without options, no faults are injected.
+func New(opts ...Option) *Injector {
+	o := options{seed: time.Now().UnixNano()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return &Injector{opts: o, rnd: rand.New(rand.NewSource(o.seed))}
+}
+
+// chance returns true with the given probability.
+func (i *Injector) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.rnd.Float64() < p
+}
+
+func (i *Injector) intn(n int) int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.rnd.Intn(n)
+}
+
+func (i *Injector) refuse() bool {
+	if n := i.opts.refuseEvery; n > 0 && atomic.AddUint64(&i.attempts, 1)%n == 0 {
+		return true
+	}
+	return i.chance(i.opts.refuseProbability)
+}
+
+func (i *Injector) delay() time.Duration {
+	d := i.opts.latency
+	if i.opts.latencyJitter > 0 {
+		d += time.Duration(i.intn(int(i.opts.latencyJitter)))
+	}
+	return d
+}
+
+// sleep waits for the given duration or until context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type listener struct {
+	net.Listener
+	injector *Injector
+}
+
+// Listener wraps the given listener, so it refuses accepts and its connections are faulty. Refused Accept returns
+// ECONNREFUSED error without accepting any connection, so the pending connection stays in the kernel backlog. Note that
+// http.Server stops serving on such error.
+func (i *Injector) Listener(l net.Listener) net.Listener {
+	return &listener{Listener: l, injector: i}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	if l.injector.refuse() {
+		return nil, &net.OpError{Op: "accept", Net: l.Addr().Network(), Addr: l.Addr(), Err: os.NewSyscallError("accept", syscall.ECONNREFUSED)}
+	}
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	time.Sleep(l.injector.delay())
+	return l.injector.Conn(conn), nil
+}
+
+// DialContextFunc is the signature of net.Dialer.DialContext. It is an alias, so it fits dial function types of
+// other packages.
+type DialContextFunc = func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// DialContextFunc wraps the given dial function, so it refuses dials and its connections are faulty. Refused dial
+// fails with ECONNREFUSED error, as if nothing listened on the address.
+func (i *Injector) DialContextFunc(parent DialContextFunc) DialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if err := sleep(ctx, i.delay()); err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		if i.refuse() {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+		}
+
+		conn, err := parent(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return i.Conn(conn), nil
+	}
+}
+
+type conn struct {
+	net.Conn
+	injector *Injector
+	hang     bool
+}
+
+// Conn wraps the given connection, so its reads and writes are faulty. Whether the connection hangs is decided here.
+func (i *Injector) Conn(c net.Conn) net.Conn {
+	return &conn{Conn: c, injector: i, hang: i.chance(i.opts.hangProbability)}
+}
+
+// NetConn returns the underlying connection.
+func (c *conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	if c.injector.chance(c.injector.opts.resetProbability) {
+		return 0, c.reset("read")
+	}
+
+	if c.hang {
+		// Nothing is received from the peer that disappeared. Underlying read still returns errors, e.g on deadline
+		// or close.
+		for {
+			if _, err := c.Conn.Read(b); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	if chunk := c.chunkSize(); chunk > 0 && len(b) > chunk {
+		b = b[:chunk]
+	}
+	n, err := c.Conn.Read(b)
+	c.throttle(n)
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	if c.injector.chance(c.injector.opts.resetProbability) {
+		return 0, c.reset("write")
+	}
+	time.Sleep(c.injector.delay())
+
+	if c.hang {
+		return len(b), nil
+	}
+
+	short := false
+	if len(b) > 0 && c.injector.chance(c.injector.opts.partialProbability) {
+		b = b[:c.injector.intn(len(b))]
+		short = true
+	}
+
+	written := 0
+	for written < len(b) {
+		end := len(b)
+		if chunk := c.chunkSize(); chunk > 0 && end-written > chunk {
+			end = written + chunk
+		}
+		// Data arrives to the peer once it is transferred.
+		c.throttle(end - written)
+		n, err := c.Conn.Write(b[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	if short {
+		return written, io.ErrShortWrite
+	}
+	return written, nil
+}
+
+// chunkSize returns how many bytes are transferred at once with the configured bandwidth, so data flows steadily.
+// Zero means no limit.
+func (c *conn) chunkSize() int {
+	bps := c.injector.opts.bytesPerSecond
+	if bps <= 0 {
+		return 0
+	}
+	if bps < 10 {
+		return 1
+	}
+	return bps / 10
+}
+
+// throttle waits for as long as transferring n bytes takes with the configured bandwidth.
+func (c *conn) throttle(n int) {
+	if bps := c.injector.opts.bytesPerSecond; bps > 0 && n > 0 {
+		time.Sleep(time.Duration(n) * time.Second / time.Duration(bps))
+	}
+}
+
+// reset closes the connection with RST and returns ECONNRESET error of the given operation.
+func (c *conn) reset(op string) error {
+	var inner net.Conn = c.Conn
+	for {
+		w, ok := inner.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		inner = w.NetConn()
+	}
+	if tcp, ok := inner.(*net.TCPConn); ok {
+		// Zero linger makes close send RST instead of FIN.
+		_ = tcp.SetLinger(0)
+	}
+	_ = c.Conn.Close()
+	return &net.OpError{Op: op, Net: c.LocalAddr().Network(), Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: os.NewSyscallError(op, syscall.ECONNRESET)}
+}
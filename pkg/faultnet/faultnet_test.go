@@ -0,0 +1,116 @@
+package faultnet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+// dialPair returns client connection dialed with the given injector and server side of it.
+func dialPair(t *testing.T, i *Injector) (client net.Conn, server net.Conn) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, l.Close()) }()
+
+	client, err = i.DialContextFunc((&net.Dialer{}).DialContext)(context.Background(), "tcp", l.Addr().String())
+	testutil.Ok(t, err)
+	server, err = l.Accept()
+	testutil.Ok(t, err)
+	return client, server
+}
+
+func refusals(i *Injector, n int) []bool {
+	var refused []bool
+	for j := 0; j < n; j++ {
+		refused = append(refused, i.refuse())
+	}
+	return refused
+}
+
+func TestInjector_Refusal(t *testing.T) {
+	testutil.Equals(t, []bool{false, false, true, false, false, true}, refusals(New(WithRefuseEvery(3)), 6))
+
+	// The same seed gives the same faults.
+	a := refusals(New(WithRefusal(0.5), WithSeed(42)), 100)
+	testutil.Equals(t, a, refusals(New(WithRefusal(0.5), WithSeed(42)), 100))
+	testutil.Assert(t, !reflect.DeepEqual(a, refusals(New(WithRefusal(0.5), WithSeed(43)), 100)), "different seed should give different faults")
+
+	_, err := New(WithRefusal(1)).DialContextFunc((&net.Dialer{}).DialContext)(context.Background(), "tcp", "127.0.0.1:1")
+	testutil.Assert(t, errors.Is(err, syscall.ECONNREFUSED), "unexpected error %v", err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, l.Close()) }()
+	_, err = New(WithRefusal(1)).Listener(l).Accept()
+	testutil.Assert(t, errors.Is(err, syscall.ECONNREFUSED), "unexpected error %v", err)
+}
+
+func TestInjector_LatencyAndBandwidth(t *testing.T) {
+	client, server := dialPair(t, New(WithLatency(50*time.Millisecond, 0), WithBandwidth(1000)))
+	defer func() { testutil.Ok(t, client.Close()) }()
+	defer func() { testutil.Ok(t, server.Close()) }()
+
+	start := time.Now()
+	go func() { _, _ = client.Write(make([]byte, 200)) }()
+	_, err := io.ReadFull(server, make([]byte, 200))
+	testutil.Ok(t, err)
+	// 50ms of latency and 200ms of transfer.
+	testutil.Assert(t, time.Since(start) >= 200*time.Millisecond, "write took only %v", time.Since(start))
+}
+
+func TestInjector_Reset(t *testing.T) {
+	client, server := dialPair(t, New(WithReset(1)))
+	defer func() { testutil.Ok(t, server.Close()) }()
+
+	_, err := client.Write([]byte("hello"))
+	testutil.Assert(t, errors.Is(err, syscall.ECONNRESET), "unexpected error %v", err)
+
+	_, err = server.Read(make([]byte, 5))
+	testutil.Assert(t, errors.Is(err, syscall.ECONNRESET), "peer should see reset, got %v", err)
+}
+
+func TestInjector_Hang(t *testing.T) {
+	client, server := dialPair(t, New(WithHang(1)))
+	defer func() { testutil.Ok(t, client.Close()) }()
+	defer func() { testutil.Ok(t, server.Close()) }()
+
+	n, err := client.Write([]byte("hello"))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 5, n)
+
+	_, err = server.Write([]byte("world"))
+	testutil.Ok(t, err)
+	testutil.Ok(t, client.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = client.Read(make([]byte, 5))
+	var netErr net.Error
+	testutil.Assert(t, errors.As(err, &netErr) && netErr.Timeout(), "read should time out, got %v", err)
+
+	// Nothing was sent.
+	testutil.Ok(t, server.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = server.Read(make([]byte, 5))
+	testutil.Assert(t, errors.As(err, &netErr) && netErr.Timeout(), "read should time out, got %v", err)
+}
+
+func TestInjector_PartialWrites(t *testing.T) {
+	client, server := dialPair(t, New(WithPartialWrites(1), WithSeed(1)))
+	defer func() { testutil.Ok(t, client.Close()) }()
+	defer func() { testutil.Ok(t, server.Close()) }()
+
+	n, err := client.Write([]byte("hello world"))
+	testutil.Equals(t, io.ErrShortWrite, err)
+	testutil.Assert(t, n < len("hello world"), "write should be partial, written %v", n)
+
+	b := make([]byte, n)
+	_, err = io.ReadFull(server, b)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "hello world"[:n], string(b))
+}
@@ -3,6 +3,9 @@ package lbtransport
 import (
 	"bytes"
 	"io"
+	"sync"
+
+	"github.com/pkg/errors"
 )
 
 type replayableReader struct {
@@ -68,3 +71,128 @@ func newReplayableReader(src io.Reader) *replayableReader {
 
 	return &replayableReader{wrapped: src}
 }
+
+var (
+	errBodyReplaced      = errors.New("lb: request body was replaced by retry")
+	errBodyNotReplayable = errors.New("lb: request body is too large to be retried")
+)
+
+// streamingBody allows streamed request body to be sent again on retry, as long as no more than limit bytes were read
+// from it. Unlike replayableReader, it does not buffer the whole body, so it can be used for long-lived streams (e.g
+// gRPC streaming calls). Every attempt reads the body via its own reader; readers of previous attempts fail.
+type streamingBody struct {
+	wrapped io.Reader
+	limit   int
+
+	// readMu serializes reads from the wrapped stream. Reader of previous attempt may still be blocked reading it
+	// (e.g HTTP/2 body writer of the failed attempt), and what it reads has to be buffered before the current attempt
+	// reads more.
+	readMu sync.Mutex
+
+	mu sync.Mutex
+	// buf contains all bytes read from the wrapped stream, unless overflowed.
+	buf        []byte
+	read       int
+	overflowed bool
+	attempt    int
+}
+
+func newStreamingBody(src io.Reader, limit int) *streamingBody {
+	return &streamingBody{wrapped: src, limit: limit}
+}
+
+// newAttempt returns reader of the whole body for the next attempt, or false if body cannot be replayed.
+func (b *streamingBody) newAttempt() (io.ReadCloser, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.overflowed {
+		return nil, false
+	}
+	b.attempt++
+	return &streamingBodyReader{body: b, attempt: b.attempt}, true
+}
+
+// replayable returns true if the body can be sent again. Nil body is always replayable.
+func (b *streamingBody) replayable() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return !b.overflowed
+}
+
+type streamingBodyReader struct {
+	body    *streamingBody
+	attempt int
+	offset  int
+}
+
+// Close does nothing, as the body may be needed for the next attempt.
+func (*streamingBodyReader) Close() error {
+	return nil
+}
+
+func (r *streamingBodyReader) Read(p []byte) (int, error) {
+	// Buffered bytes are read without waiting for the stream, which may block for a long time.
+	if n, ok, err := r.readBuffered(p); ok {
+		return n, err
+	}
+
+	b := r.body
+	b.readMu.Lock()
+	defer b.readMu.Unlock()
+
+	// Reader of previous attempt might have read from the stream while we were waiting.
+	if n, ok, err := r.readBuffered(p); ok {
+		return n, err
+	}
+
+	n, err := b.wrapped.Read(p)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.read += n
+	if !b.overflowed {
+		if len(b.buf)+n > b.limit {
+			// Body is too large to be replayed. Stop buffering.
+			b.overflowed = true
+			b.buf = nil
+		} else {
+			b.buf = append(b.buf, p[:n]...)
+		}
+	}
+	if r.attempt != b.attempt {
+		// Body was replaced by retry during the read. What was read is left to the current attempt.
+		return 0, errBodyReplaced
+	}
+	r.offset += n
+	return n, err
+}
+
+// readBuffered reads bytes that were already read from the stream. It returns false if there are none and the stream
+// has to be read.
+func (r *streamingBodyReader) readBuffered(p []byte) (int, bool, error) {
+	b := r.body
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if r.attempt != b.attempt {
+		return 0, true, errBodyReplaced
+	}
+	if r.offset >= b.read {
+		return 0, false, nil
+	}
+	if b.overflowed {
+		// Reader of previous attempt read more than can be buffered, so part of the body is lost for this attempt.
+		return 0, true, errBodyNotReplayable
+	}
+	n := copy(p, b.buf[r.offset:])
+	r.offset += n
+	return n, true, nil
+}
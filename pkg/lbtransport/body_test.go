@@ -3,7 +3,9 @@ package lbtransport
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -113,3 +115,54 @@ func TestReplayableReader(t *testing.T) {
 		}
 	}
 }
+
+// chunkReader returns chunks sent to it, one per Read, and io.EOF once closed.
+type chunkReader chan []byte
+
+func (c chunkReader) Read(p []byte) (int, error) {
+	chunk, ok := <-c
+	if !ok {
+		return 0, io.EOF
+	}
+	return copy(p, chunk), nil
+}
+
+func TestStreamingBody_RetryDuringRead(t *testing.T) {
+	chunks := make(chunkReader)
+	body := newStreamingBody(chunks, 1024)
+
+	first, ok := body.newAttempt()
+	require.True(t, ok)
+	go func() { chunks <- []byte("a") }()
+	b := make([]byte, 10)
+	n, err := first.Read(b)
+	require.NoError(t, err)
+	require.Equal(t, "a", string(b[:n]))
+
+	// First attempt is still reading the stream when it is retried, e.g by HTTP/2 body writer of failed attempt.
+	firstErr := make(chan error)
+	go func() {
+		_, err := first.Read(make([]byte, 10))
+		firstErr <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	second, ok := body.newAttempt()
+	require.True(t, ok)
+	read := make(chan []byte)
+	readErr := make(chan error, 1)
+	go func() {
+		b, err := ioutil.ReadAll(second)
+		readErr <- err
+		read <- b
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Chunk read by the first attempt is not lost for the second one.
+	chunks <- []byte("b")
+	require.Equal(t, errBodyReplaced, <-firstErr)
+	chunks <- []byte("c")
+	close(chunks)
+	require.Equal(t, "abc", string(<-read))
+	require.NoError(t, <-readErr)
+}
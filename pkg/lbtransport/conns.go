@@ -0,0 +1,295 @@
+package lbtransport
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type dialContextFunc = func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// connRegistry tracks connections dialed by the parent transport per target key (see Target.Key), so connections to
+// a single target can be closed. Zero value is ready to use.
+type connRegistry struct {
+	// maxAge is the age after which connections are closed once not used by any request. Zero means no limit.
+	maxAge            time.Duration
+	maxAgeClosedTotal prometheus.Counter
+	// closeIdle closes idle connections of parent transports, which is how connections that reached max age are closed.
+	closeIdle func()
+
+	mu           sync.Mutex
+	conns        map[string]map[*registeredConn]struct{}
+	sweepPending bool
+}
+
+type registeredConn struct {
+	net.Conn
+
+	// key is the key of the target connection was dialed for, empty if unknown (e.g warm connections not used yet).
+	// It is guarded by connRegistry.mu.
+	key  string
+	reg  *connRegistry
+	once sync.Once
+
+	// Connection age tracking, see connRegistry.maxAge.
+	ageTimer *time.Timer
+	mu       sync.Mutex
+	active   int
+	expired  bool
+}
+
+func (c *registeredConn) Close() error {
+	c.once.Do(func() {
+		c.unregister()
+
+		c.mu.Lock()
+		expired := c.expired
+		c.mu.Unlock()
+		if expired && c.reg.maxAgeClosedTotal != nil {
+			c.reg.maxAgeClosedTotal.Inc()
+		}
+	})
+	return c.Conn.Close()
+}
+
+func (c *registeredConn) unregister() {
+	c.mu.Lock()
+	if c.ageTimer != nil {
+		c.ageTimer.Stop()
+	}
+	c.mu.Unlock()
+
+	c.reg.mu.Lock()
+	defer c.reg.mu.Unlock()
+
+	c.reg.removeLocked(c)
+}
+
+// NetConn returns the underlying connection, so conntrack can inspect its socket.
+func (c *registeredConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// wrapDialContext registers dialed connections under the key of the target from dial context, if any.
+func (r *connRegistry) wrapDialContext(dialContext dialContextFunc) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialContext(ctx, network, addr)
+		if err != nil {
+			return conn, err
+		}
+
+		c := &registeredConn{Conn: conn, reg: r}
+		if target, ok := TargetFromContext(ctx); ok {
+			c.key = target.Key()
+		}
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		r.addLocked(c)
+		if r.maxAge > 0 {
+			c.mu.Lock()
+			c.ageTimer = time.AfterFunc(r.maxAge, c.expire)
+			c.mu.Unlock()
+		}
+		return c, nil
+	}
+}
+
+// wrapAssignDialContext assigns registered connections returned by the given dial function to the target from dial
+// context. Connections are not always dialed for the target that uses them, e.g warm connections are shared by
+// targets with the same dial address.
+func (r *connRegistry) wrapAssignDialContext(dialContext dialContextFunc) dialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialContext(ctx, network, addr)
+		if err != nil {
+			return conn, err
+		}
+		target, ok := TargetFromContext(ctx)
+		if !ok {
+			return conn, nil
+		}
+		if c, ok := asRegisteredConn(conn); ok && c.reg == r {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			if _, ok := r.conns[c.key][c]; ok {
+				// Not closed yet.
+				r.removeLocked(c)
+				c.key = target.Key()
+				r.addLocked(c)
+			}
+		}
+		return conn, nil
+	}
+}
+
+// addLocked has to be called with mu locked.
+func (r *connRegistry) addLocked(c *registeredConn) {
+	if r.conns == nil {
+		r.conns = map[string]map[*registeredConn]struct{}{}
+	}
+	if r.conns[c.key] == nil {
+		r.conns[c.key] = map[*registeredConn]struct{}{}
+	}
+	r.conns[c.key][c] = struct{}{}
+}
+
+// removeLocked has to be called with mu locked.
+func (r *connRegistry) removeLocked(c *registeredConn) {
+	delete(r.conns[c.key], c)
+	if len(r.conns[c.key]) == 0 {
+		delete(r.conns, c.key)
+	}
+}
+
+// closeAll closes all tracked connections of the target with the given key and returns number of closed connections.
+func (r *connRegistry) closeAll(key string) int {
+	r.mu.Lock()
+	conns := make([]*registeredConn, 0, len(r.conns[key]))
+	for c := range r.conns[key] {
+		conns = append(conns, c)
+	}
+	r.mu.Unlock()
+
+	for _, c := range conns {
+		_ = c.Close()
+	}
+	return len(conns)
+}
+
+// dialAddress returns the address the parent transport dials for the given target URL, e.g `host:80` for `http://host`.
+func dialAddress(u url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// maxAgeSweepDelay is how long closing of idle connections is delayed once connection reaches max age, so connections
+// that reach it at about the same time are closed at once.
+const maxAgeSweepDelay = 100 * time.Millisecond
+
+// acquire marks connection as used by a request. The returned function has to be called once the request is done.
+// Connection that reached max age is closed once no request uses it.
+func (c *registeredConn) acquire() func() {
+	c.mu.Lock()
+	c.active++
+	c.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.mu.Lock()
+			c.active--
+			expiredIdle := c.expired && c.active == 0
+			c.mu.Unlock()
+
+			if expiredIdle {
+				c.reg.sweepIdle()
+			}
+		})
+	}
+}
+
+// expire marks connection as too old. It is closed by the next idle sweep once no request uses it.
+func (c *registeredConn) expire() {
+	c.mu.Lock()
+	c.expired = true
+	idle := c.active == 0
+	c.mu.Unlock()
+
+	if idle {
+		c.reg.sweepIdle()
+	}
+}
+
+// sweepIdle closes idle connections of parent transports shortly, so connections that reached max age are closed.
+// Connections are not closed directly, as the parent transport might be handing idle connection out to a request
+// right now (requests acquire connections only once they got them), which would fail requests that cannot be retried.
+// Parent transport never closes connection it hands out. Connection that is not idle yet (e.g its response is being
+// finished) is closed by the next sweep or idle connection timeout.
+func (r *connRegistry) sweepIdle() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.sweepPending || r.closeIdle == nil {
+		return
+	}
+	r.sweepPending = true
+	time.AfterFunc(maxAgeSweepDelay, func() {
+		r.mu.Lock()
+		r.sweepPending = false
+		r.mu.Unlock()
+
+		r.closeIdle()
+	})
+}
+
+// closeIdleConnections closes idle connections of all parent transports. Parent transport never closes connection it
+// is handing out to a request, unlike closing connections directly.
+func (t *Transport) closeIdleConnections() {
+	type closeIdler interface{ CloseIdleConnections() }
+	for _, parent := range []http.RoundTripper{t.parent, t.h2cParent} {
+		if c, ok := parent.(closeIdler); ok {
+			c.CloseIdleConnections()
+		}
+	}
+	t.tlsParents.closeIdleConnections()
+	t.grpcTLSParents.closeIdleConnections()
+}
+
+// asRegisteredConn unwraps connection wrappers implementing `NetConn() net.Conn` (like *tls.Conn or conntrack
+// trackers), until registered connection is found.
+func asRegisteredConn(conn net.Conn) (*registeredConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *registeredConn:
+			return c, true
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// withConnUse marks connections obtained for the request as used until the returned done function is called, so
+// connections that reached max age are not closed under the request.
+func withConnUse(ctx context.Context, done func()) (context.Context, func()) {
+	var (
+		mu       sync.Mutex
+		releases []func()
+	)
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c, ok := asRegisteredConn(info.Conn)
+			if !ok {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			releases = append(releases, c.acquire())
+		},
+	})
+	return ctx, func() {
+		done()
+
+		mu.Lock()
+		defer mu.Unlock()
+		for _, release := range releases {
+			release()
+		}
+		releases = nil
+	}
+}
@@ -0,0 +1,43 @@
+package lbtransport
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestConnRegistry_ExpireIdle(t *testing.T) {
+	sweeps := make(chan struct{}, 10)
+	r := &connRegistry{
+		maxAge:    time.Millisecond,
+		closeIdle: func() { sweeps <- struct{}{} },
+	}
+
+	a := &Target{DialAddr: url.URL{Host: "a"}}
+	client, server := net.Pipe()
+	defer func() { _ = server.Close() }()
+	conn, err := r.wrapDialContext(func(context.Context, string, string) (net.Conn, error) {
+		return client, nil
+	})(context.WithValue(context.Background(), targetCtxKey{}, a), "tcp", "a:80")
+	testutil.Ok(t, err)
+	defer func() { _ = conn.Close() }()
+
+	// Expired idle connection is not closed directly, as parent transport might be handing it out right now. Parent
+	// transport is asked to close its idle connections instead.
+	<-sweeps
+	r.mu.Lock()
+	n := len(r.conns[a.Key()])
+	r.mu.Unlock()
+	testutil.Equals(t, 1, n)
+
+	// Connection used by a request is swept once the request is done.
+	rc, ok := asRegisteredConn(conn)
+	testutil.Assert(t, ok, "expected registered connection")
+	release := rc.acquire()
+	release()
+	<-sweeps
+}
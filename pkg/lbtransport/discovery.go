@@ -2,37 +2,244 @@ package lbtransport
 
 import (
 	"net/url"
+	"sort"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
 )
 
 type Discovery interface {
 	Targets() []*Target
 }
 
+// StaticDiscovery returns statically configured targets. See MutableStaticDiscovery for targets changed in runtime.
 type StaticDiscovery struct {
 	targets []*Target
 }
 
 func NewStaticDiscovery(addrs []url.URL, reg prometheus.Registerer) *StaticDiscovery {
+	return NewStaticDiscoveryFromTargets(targetsFromAddrs(addrs), reg)
+}
+
+// NewStaticDiscoveryFromTargets returns StaticDiscovery for given targets, including their labels.
+func NewStaticDiscoveryFromTargets(targets []*Target, reg prometheus.Registerer) *StaticDiscovery {
+	registerStaticAddresses(reg, func() float64 { return float64(len(targets)) })
+	return &StaticDiscovery{targets: targets}
+}
+
+func (s StaticDiscovery) Targets() []*Target {
+	return s.targets
+}
+
+func targetsFromAddrs(addrs []url.URL) []*Target {
 	targets := make([]*Target, 0, len(addrs))
 	for _, a := range addrs {
 		targets = append(targets, &Target{DialAddr: a})
 	}
+	return targets
+}
 
-	if reg != nil {
-		reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
-			Subsystem: "lbtransport",
-			Name:      "static_addresses",
-			Help:      "Number of configured static addresses.",
-		}, func() float64 {
-			return float64(len(addrs))
-		}))
+func registerStaticAddresses(reg prometheus.Registerer, count func() float64) {
+	if reg == nil {
+		return
 	}
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Subsystem: "lbtransport",
+		Name:      "static_addresses",
+		Help:      "Number of configured static addresses.",
+	}, count))
+}
 
-	return &StaticDiscovery{targets: targets}
+// MutableStaticDiscovery returns statically configured targets, which can be added or removed in runtime e.g via
+// admin API.
+type MutableStaticDiscovery struct {
+	mu      sync.RWMutex
+	targets []*Target
 }
 
-func (s StaticDiscovery) Targets() []*Target {
+func NewMutableStaticDiscovery(addrs []url.URL, reg prometheus.Registerer) *MutableStaticDiscovery {
+	return NewMutableStaticDiscoveryFromTargets(targetsFromAddrs(addrs), reg)
+}
+
+// NewMutableStaticDiscoveryFromTargets returns MutableStaticDiscovery for given initial targets, including their labels.
+func NewMutableStaticDiscoveryFromTargets(targets []*Target, reg prometheus.Registerer) *MutableStaticDiscovery {
+	s := &MutableStaticDiscovery{targets: targets}
+	registerStaticAddresses(reg, func() float64 { return float64(len(s.Targets())) })
+	return s
+}
+
+func (s *MutableStaticDiscovery) Targets() []*Target {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	return s.targets
 }
+
+// AddTarget adds the given target. It returns false if target with the same DialAddr already exists.
+func (s *MutableStaticDiscovery) AddTarget(target *Target) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.targets {
+		if t.DialAddr == target.DialAddr {
+			return false
+		}
+	}
+
+	// Copy on write, so returned targets are never modified.
+	targets := make([]*Target, 0, len(s.targets)+1)
+	s.targets = append(append(targets, s.targets...), target)
+	return true
+}
+
+// RemoveTarget removes target with the given DialAddr. It returns false if there was no such target.
+func (s *MutableStaticDiscovery) RemoveTarget(addr url.URL) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	targets := make([]*Target, 0, len(s.targets))
+	for _, t := range s.targets {
+		if t.DialAddr == addr {
+			continue
+		}
+		targets = append(targets, t)
+	}
+	if len(targets) == len(s.targets) {
+		return false
+	}
+	s.targets = targets
+	return true
+}
+
+// CompositeMode defines how CompositeDiscovery combines targets from its sources.
+type CompositeMode int
+
+const (
+	// CompositeUnion merges targets from all sources. For duplicated addresses, the target from the first source wins.
+	CompositeUnion CompositeMode = iota
+	// CompositePrecedence uses targets only from the first source (in the given order) that returns any target.
+	CompositePrecedence
+)
+
+// DiscoverySource is a named Discovery used by CompositeDiscovery.
+type DiscoverySource struct {
+	Name      string
+	Discovery Discovery
+}
+
+// CompositeDiscovery combines multiple discovery sources into one, deduplicating targets by DialAddr.
+// It is useful e.g. during migrations when two sources have to work side by side.
+type CompositeDiscovery struct {
+	mode    CompositeMode
+	sources []DiscoverySource
+}
+
+func NewCompositeDiscovery(reg prometheus.Registerer, mode CompositeMode, sources ...DiscoverySource) *CompositeDiscovery {
+	c := &CompositeDiscovery{
+		mode:    mode,
+		sources: sources,
+	}
+
+	if reg != nil {
+		reg.MustRegister(&compositeSourcesCollector{c: c})
+	}
+	return c
+}
+
+func (c *CompositeDiscovery) Targets() []*Target {
+	targets, _ := c.merge()
+	return targets
+}
+
+// merge returns combined targets and the number of targets contributed by each source.
+func (c *CompositeDiscovery) merge() ([]*Target, []int) {
+	var (
+		targets     []*Target
+		contributed = make([]int, len(c.sources))
+		seen        = map[string]struct{}{}
+	)
+
+	for i, s := range c.sources {
+		if c.mode == CompositePrecedence && len(targets) > 0 {
+			// Higher priority source already gave us targets.
+			continue
+		}
+
+		for _, t := range s.Discovery.Targets() {
+			addr := t.DialAddr.String()
+			if _, ok := seen[addr]; ok {
+				continue
+			}
+			seen[addr] = struct{}{}
+			targets = append(targets, t)
+			contributed[i]++
+		}
+	}
+	return targets, contributed
+}
+
+var compositeSourceTargetsDesc = prometheus.NewDesc(
+	"lbtransport_composite_discovery_source_targets",
+	"Number of targets contributed by the given discovery source.",
+	[]string{"source"}, nil,
+)
+
+// compositeSourcesCollector exposes number of targets contributed by each source of CompositeDiscovery. Sources are
+// merged once per scrape, so Targets stays cheap for every proxied request and all sources come from the same merge.
+type compositeSourcesCollector struct {
+	c *CompositeDiscovery
+}
+
+func (c *compositeSourcesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- compositeSourceTargetsDesc
+}
+
+func (c *compositeSourcesCollector) Collect(ch chan<- prometheus.Metric) {
+	_, contributed := c.c.merge()
+	for i, s := range c.c.sources {
+		ch <- prometheus.MustNewConstMetric(compositeSourceTargetsDesc, prometheus.GaugeValue, float64(contributed[i]), s.Name)
+	}
+}
+
+const (
+	targetInfoName = "lbtransport_target_info"
+	targetInfoHelp = "Information about discovered target with its labels. Join on target label to relabel other target metrics."
+)
+
+type targetInfoCollector struct {
+	discovery Discovery
+}
+
+// NewTargetInfoCollector returns collector exposing lbtransport_target_info metric for each discovered target. Metric contains
+// all target labels which are valid Prometheus label names, except the ones with filesystem paths (e.g tls_ca_file).
+// Label sets can differ between targets, so collector is unchecked.
+func NewTargetInfoCollector(discovery Discovery) prometheus.Collector {
+	return &targetInfoCollector{discovery: discovery}
+}
+
+func (c *targetInfoCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c *targetInfoCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, t := range c.discovery.Targets() {
+		names := make([]string, 0, len(t.Labels))
+		for n := range t.Labels {
+			if _, ok := tlsFileLabels[n]; ok || n == "target" || !model.LabelName(n).IsValid() {
+				continue
+			}
+			names = append(names, n)
+		}
+		sort.Strings(names)
+
+		values := make([]string, 0, len(names)+1)
+		values = append(values, t.DialAddr.String())
+		for _, n := range names {
+			values = append(values, t.Labels[n])
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc(targetInfoName, targetInfoHelp, append([]string{"target"}, names...), nil),
+			prometheus.GaugeValue, 1, values...,
+		)
+	}
+}
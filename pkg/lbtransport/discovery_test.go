@@ -0,0 +1,112 @@
+package lbtransport
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func hosts(targets []*Target) []string {
+	h := make([]string, 0, len(targets))
+	for _, t := range targets {
+		h = append(h, t.DialAddr.Host)
+	}
+	return h
+}
+
+func TestCompositeDiscovery(t *testing.T) {
+	a := &countingDiscovery{}
+	b := &countingDiscovery{}
+
+	for _, tcase := range []struct {
+		mode     CompositeMode
+		a, b     []string
+		expected []string
+
+		expectedA, expectedB float64
+	}{
+		{mode: CompositeUnion, expected: []string{}},
+		{mode: CompositeUnion, a: []string{"a", "b"}, b: []string{"c"}, expected: []string{"a", "b", "c"}, expectedA: 2, expectedB: 1},
+		{mode: CompositeUnion, a: []string{"a", "b"}, b: []string{"b", "c", "a"}, expected: []string{"a", "b", "c"}, expectedA: 2, expectedB: 1},
+		{mode: CompositeUnion, b: []string{"b", "b"}, expected: []string{"b"}, expectedB: 1},
+		{mode: CompositePrecedence, a: []string{"a", "b"}, b: []string{"c"}, expected: []string{"a", "b"}, expectedA: 2},
+		{mode: CompositePrecedence, b: []string{"c", "c"}, expected: []string{"c"}, expectedB: 1},
+		{mode: CompositePrecedence, expected: []string{}},
+	} {
+		if ok := t.Run("", func(t *testing.T) {
+			a.Reset(tcase.a)
+			b.Reset(tcase.b)
+
+			reg := prometheus.NewRegistry()
+			c := NewCompositeDiscovery(reg, tcase.mode, DiscoverySource{Name: "a", Discovery: a}, DiscoverySource{Name: "b", Discovery: b})
+			testutil.Equals(t, tcase.expected, hosts(c.Targets()))
+
+			a.calls, b.calls = 0, 0
+			testutil.Ok(t, promtestutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+# HELP lbtransport_composite_discovery_source_targets Number of targets contributed by the given discovery source.
+# TYPE lbtransport_composite_discovery_source_targets gauge
+lbtransport_composite_discovery_source_targets{source="a"} %v
+lbtransport_composite_discovery_source_targets{source="b"} %v
+`, tcase.expectedA, tcase.expectedB))))
+
+			// Sources are merged once per scrape.
+			testutil.Assert(t, a.calls <= 1 && b.calls <= 1, "expected at most one Targets call per source, got %d and %d", a.calls, b.calls)
+		}); !ok {
+			return
+		}
+	}
+}
+
+type countingDiscovery struct {
+	mockedDiscovery
+	calls int
+}
+
+func (d *countingDiscovery) Targets() []*Target {
+	d.calls++
+	return d.mockedDiscovery.Targets()
+}
+
+func TestStaticDiscovery(t *testing.T) {
+	s := NewStaticDiscovery([]url.URL{{Host: "a"}, {Host: "b"}}, nil)
+	testutil.Equals(t, []string{"a", "b"}, hosts(s.Targets()))
+
+	// StaticDiscovery value is a Discovery too.
+	var d Discovery = *s
+	testutil.Equals(t, []string{"a", "b"}, hosts(d.Targets()))
+}
+
+func TestTargetInfoCollector(t *testing.T) {
+	s := NewStaticDiscoveryFromTargets([]*Target{
+		{DialAddr: url.URL{Scheme: "http", Host: "a"}},
+		{DialAddr: url.URL{Scheme: "http", Host: "b"}, Labels: Labels{"zone": "eu", "canary": "true", "in-valid": "x", "target": "x", TLSCAFileLabel: "/etc/ca.crt", TLSServerNameLabel: "b"}},
+	}, nil)
+
+	testutil.Ok(t, promtestutil.CollectAndCompare(NewTargetInfoCollector(s), strings.NewReader(`
+# HELP lbtransport_target_info Information about discovered target with its labels. Join on target label to relabel other target metrics.
+# TYPE lbtransport_target_info gauge
+lbtransport_target_info{target="http://a"} 1
+lbtransport_target_info{canary="true",target="http://b",tls_server_name="b",zone="eu"} 1
+`)))
+}
+
+func TestMutableStaticDiscovery(t *testing.T) {
+	s := NewMutableStaticDiscovery([]url.URL{{Host: "a"}}, nil)
+	before := s.Targets()
+
+	testutil.Assert(t, s.AddTarget(&Target{DialAddr: url.URL{Host: "b"}}), "b should be added")
+	testutil.Assert(t, !s.AddTarget(&Target{DialAddr: url.URL{Host: "a"}, Labels: Labels{"zone": "eu"}}), "a already exists")
+	testutil.Equals(t, []string{"a", "b"}, hosts(s.Targets()))
+
+	testutil.Assert(t, s.RemoveTarget(url.URL{Host: "a"}), "a should be removed")
+	testutil.Assert(t, !s.RemoveTarget(url.URL{Host: "c"}), "c does not exist")
+	testutil.Equals(t, []string{"b"}, hosts(s.Targets()))
+
+	// Previously returned targets are never modified.
+	testutil.Equals(t, []string{"a"}, hosts(before))
+}
@@ -0,0 +1,298 @@
+package lbtransport
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DrainLabel is a target label that, when set to "true" by discovery, makes Transport drain the target.
+	DrainLabel = "drain"
+
+	drainedIdle    = "idle"
+	drainedTimeout = "timeout"
+)
+
+// inFlightTracker tracks in-flight requests per target and the draining targets. Zero value is ready to use.
+type inFlightTracker struct {
+	mu       sync.Mutex
+	inFlight map[string]int
+	// draining contains draining or drained targets.
+	draining map[string]*targetDrain
+	// byLabel contains draining targets that were drained because of DrainLabel.
+	byLabel map[string]struct{}
+	// idleWaiters are closed once target has no in-flight requests.
+	idleWaiters map[string][]chan struct{}
+}
+
+// targetDrain is a drain of a single target.
+type targetDrain struct {
+	// idle is closed once target has no in-flight requests.
+	idle chan struct{}
+	// canceled is closed once target is undrained, so drain does not close connections of the target that is used again.
+	canceled chan struct{}
+}
+
+// start marks the beginning of a request to the given target. The returned function has to be called once the request
+// is done.
+func (t *inFlightTracker) start(target *Target, m *Metrics) func() {
+	key := target.Key()
+
+	t.mu.Lock()
+	if t.inFlight == nil {
+		t.inFlight = map[string]int{}
+	}
+	t.inFlight[key]++
+	t.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			t.inFlight[key]--
+			n := t.inFlight[key]
+			if n == 0 {
+				delete(t.inFlight, key)
+				for _, ch := range t.idleWaiters[key] {
+					close(ch)
+				}
+				delete(t.idleWaiters, key)
+			}
+
+			d, ok := t.draining[key]
+			if !ok {
+				return
+			}
+			select {
+			case <-d.idle:
+				// Already drained.
+				return
+			default:
+			}
+			m.drainingInFlight.WithLabelValues(target.DialAddr.String()).Set(float64(n))
+			if n == 0 {
+				closeOnce(d.idle)
+			}
+		})
+	}
+}
+
+// idle returns channel closed once the given target has no in-flight requests, regardless of draining. The returned
+// function stops waiting, so the channel is not kept until then.
+func (t *inFlightTracker) idle(target *Target) (<-chan struct{}, func()) {
+	key := target.Key()
+	ch := make(chan struct{})
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.inFlight[key] == 0 {
+		close(ch)
+		return ch, func() {}
+	}
+	if t.idleWaiters == nil {
+		t.idleWaiters = map[string][]chan struct{}{}
+	}
+	t.idleWaiters[key] = append(t.idleWaiters[key], ch)
+	return ch, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		waiters := t.idleWaiters[key]
+		for i, w := range waiters {
+			if w == ch {
+				t.idleWaiters[key] = append(waiters[:i:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(t.idleWaiters[key]) == 0 {
+			delete(t.idleWaiters, key)
+		}
+	}
+}
+
+// drain marks target as draining. It returns the drain of the target and false if target was already draining.
+func (t *inFlightTracker) drain(target *Target, m *Metrics, byLabel bool) (*targetDrain, bool) {
+	key := target.Key()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if d, ok := t.draining[key]; ok {
+		return d, false
+	}
+	if t.draining == nil {
+		t.draining = map[string]*targetDrain{}
+	}
+
+	d := &targetDrain{idle: make(chan struct{}), canceled: make(chan struct{})}
+	t.draining[key] = d
+	if byLabel {
+		if t.byLabel == nil {
+			t.byLabel = map[string]struct{}{}
+		}
+		t.byLabel[key] = struct{}{}
+	}
+	m.drainingInFlight.WithLabelValues(target.DialAddr.String()).Set(float64(t.inFlight[key]))
+	if t.inFlight[key] == 0 {
+		close(d.idle)
+	}
+	return d, true
+}
+
+// drained marks draining target as drained, even if it still has in-flight requests.
+func (t *inFlightTracker) drained(target *Target) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if d, ok := t.draining[target.Key()]; ok {
+		closeOnce(d.idle)
+	}
+}
+
+func (t *inFlightTracker) undrain(target *Target) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.undrainLocked(target.Key())
+}
+
+// undrainByLabel undrains the given target if it was drained because of DrainLabel. It returns true if target was
+// undrained.
+func (t *inFlightTracker) undrainByLabel(target *Target) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.byLabel[target.Key()]; !ok {
+		return false
+	}
+	t.undrainLocked(target.Key())
+	return true
+}
+
+// undrainLocked has to be called with mu locked.
+func (t *inFlightTracker) undrainLocked(key string) {
+	if d, ok := t.draining[key]; ok {
+		close(d.canceled)
+	}
+	delete(t.draining, key)
+	delete(t.byLabel, key)
+}
+
+func (t *inFlightTracker) isDraining(target *Target) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	_, ok := t.draining[target.Key()]
+	return ok
+}
+
+// closeOnce closes the given channel if not closed yet. It is not safe to be used concurrently.
+func closeOnce(ch chan struct{}) {
+	select {
+	case <-ch:
+	default:
+		close(ch)
+	}
+}
+
+// DrainTarget stops sending new requests to the given target. Requests that are already in flight are allowed to finish
+// within the given timeout. Once target is idle (or timeout passes), connections to it are closed.
+// Target stays drained (and thus never picked) until UndrainTarget is called. The returned channel is closed once
+// the target is drained, or once it is undrained before that.
+func (t *Transport) DrainTarget(target *Target, timeout time.Duration) <-chan struct{} {
+	return t.drainTarget(target, timeout, false)
+}
+
+func (t *Transport) drainTarget(target *Target, timeout time.Duration, byLabel bool) <-chan struct{} {
+	done := make(chan struct{})
+	d, started := t.inFlight.drain(target, t.metrics, byLabel)
+	if !started {
+		// Already draining.
+		go func() {
+			select {
+			case <-d.idle:
+			case <-d.canceled:
+			}
+			close(done)
+		}()
+		return done
+	}
+
+	// Draining target never receives new requests, so there is no point in keeping warm connections to it.
+	t.warm.remove(warmKey(target))
+	go func() {
+		defer close(done)
+
+		defer t.metrics.drainingInFlight.DeleteLabelValues(target.DialAddr.String())
+
+		result := drainedIdle
+		select {
+		case <-d.idle:
+		case <-d.canceled:
+			// Target is used again, so its connections are kept.
+			return
+		case <-time.After(timeout):
+			result = drainedTimeout
+			t.inFlight.drained(target)
+		}
+
+		t.conns.closeAll(target.Key())
+		t.metrics.drainedTotal.WithLabelValues(result).Inc()
+	}()
+	return done
+}
+
+// UndrainTarget allows the given target to be picked again.
+func (t *Transport) UndrainTarget(target *Target) {
+	t.inFlight.undrain(target)
+}
+
+// DrainTimeout returns the timeout used for drains requested without one, see WithDrainTimeout.
+func (t *Transport) DrainTimeout() time.Duration {
+	return t.drainTimeout
+}
+
+// IsDraining returns true if the given target is draining or drained.
+func (t *Transport) IsDraining(target *Target) bool {
+	return t.inFlight.isDraining(target) || target.Labels[DrainLabel] == "true"
+}
+
+func (t *Transport) isDraining(target *Target) bool {
+	drainLabel := target.Labels[DrainLabel] == "true"
+	if t.inFlight.isDraining(target) {
+		if !drainLabel && t.inFlight.undrainByLabel(target) {
+			// Discovery does not request drain anymore.
+			return false
+		}
+		return true
+	}
+	if drainLabel {
+		// Drain requested by discovery.
+		t.drainTarget(target, t.drainTimeout, true)
+		return true
+	}
+	return false
+}
+
+// nonDraining returns targets that are not draining.
+func (t *Transport) nonDraining(targets []*Target) []*Target {
+	for i, target := range targets {
+		if !t.isDraining(target) {
+			continue
+		}
+
+		// Copy only if there is any draining target.
+		filtered := make([]*Target, 0, len(targets)-1)
+		filtered = append(filtered, targets[:i]...)
+		for _, rest := range targets[i+1:] {
+			if !t.isDraining(rest) {
+				filtered = append(filtered, rest)
+			}
+		}
+		return filtered
+	}
+	return targets
+}
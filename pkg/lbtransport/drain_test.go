@@ -0,0 +1,167 @@
+package lbtransport
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func bodyResponse(host string) response {
+	return response{host: host, Response: &http.Response{
+		Request: &http.Request{URL: &url.URL{Host: host}},
+		Body:    ioutil.NopCloser(strings.NewReader("ok")),
+	}}
+}
+
+func TestTransport_DrainTarget(t *testing.T) {
+	metrics := NewMetrics(nil)
+	discovery := &mockedDiscovery{targets: []string{"a", "b"}}
+	picker := &mockedPicker{}
+	transport := &mockedTransport{t: t}
+
+	lb := &Transport{
+		discovery: discovery,
+		picker:    picker,
+		metrics:   metrics,
+		parent:    transport,
+	}
+
+	responses := []response{bodyResponse("a")}
+	transport.Reset(responses)
+	picker.Reset(responses)
+	resp, err := lb.RoundTrip(httptest.NewRequest("GET", "http://whatever", nil))
+	testutil.Ok(t, err)
+
+	a := &Target{DialAddr: url.URL{Host: "a"}}
+	drained := lb.DrainTarget(a, 1*time.Minute)
+	testutil.Assert(t, lb.IsDraining(a), "a should be draining")
+	testutil.Equals(t, float64(1), promtestutil.ToFloat64(metrics.drainingInFlight.WithLabelValues("//a")))
+
+	// Draining target is not given to picker anymore.
+	responses = []response{bodyResponse("b")}
+	transport.Reset(responses)
+	picker.Reset(responses)
+	_, err = lb.RoundTrip(httptest.NewRequest("GET", "http://whatever", nil))
+	testutil.Ok(t, err)
+	testutil.Equals(t, []*Target{{DialAddr: url.URL{Host: "b"}}}, picker.lastSeenTargets)
+
+	select {
+	case <-drained:
+		t.Fatal("target should not be drained while request is in flight")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	testutil.Ok(t, resp.Body.Close())
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("target should be drained once in-flight request is done")
+	}
+	testutil.Equals(t, float64(1), promtestutil.ToFloat64(metrics.drainedTotal.WithLabelValues(drainedIdle)))
+	testutil.Equals(t, 0, promtestutil.CollectAndCount(metrics.drainingInFlight))
+
+	// Drained target stays excluded until undrained.
+	testutil.Assert(t, lb.IsDraining(a), "a should be still drained")
+	lb.UndrainTarget(a)
+	testutil.Assert(t, !lb.IsDraining(a), "a should be undrained")
+}
+
+func TestTransport_DrainTarget_Timeout(t *testing.T) {
+	metrics := NewMetrics(nil)
+	lb := &Transport{metrics: metrics}
+
+	a := &Target{DialAddr: url.URL{Host: "a"}}
+	done := lb.inFlight.start(a, metrics)
+
+	c1, c2 := net.Pipe()
+	defer func() { _ = c2.Close() }()
+	_, err := lb.conns.wrapDialContext(func(context.Context, string, string) (net.Conn, error) { return c1, nil })(context.WithValue(context.Background(), targetCtxKey{}, a), "tcp", "a:80")
+	testutil.Ok(t, err)
+
+	<-lb.DrainTarget(a, 10*time.Millisecond)
+	testutil.Equals(t, float64(1), promtestutil.ToFloat64(metrics.drainedTotal.WithLabelValues(drainedTimeout)))
+	testutil.Equals(t, 0, len(lb.conns.conns))
+
+	// Finishing request after timeout does not bring the series back.
+	done()
+	testutil.Equals(t, 0, promtestutil.CollectAndCount(metrics.drainingInFlight))
+}
+
+func TestTransport_UndrainTarget_BeforeTimeout(t *testing.T) {
+	metrics := NewMetrics(nil)
+	lb := &Transport{metrics: metrics, drainTimeout: 50 * time.Millisecond}
+
+	a := &Target{DialAddr: url.URL{Host: "a"}}
+	done := lb.inFlight.start(a, metrics)
+	defer done()
+
+	c1, c2 := net.Pipe()
+	defer func() { _ = c2.Close() }()
+	_, err := lb.conns.wrapDialContext(func(context.Context, string, string) (net.Conn, error) { return c1, nil })(context.WithValue(context.Background(), targetCtxKey{}, a), "tcp", "a:80")
+	testutil.Ok(t, err)
+
+	// Undrained target is used again, so its connections are not closed once drain timeout passes.
+	drained := lb.DrainTarget(a, 50*time.Millisecond)
+	lb.UndrainTarget(a)
+	<-drained
+
+	// The same goes for target undrained by discovery.
+	labeled := &Target{DialAddr: url.URL{Host: "a"}, Labels: Labels{DrainLabel: "true"}}
+	testutil.Equals(t, 0, len(lb.nonDraining([]*Target{labeled})))
+	testutil.Equals(t, []*Target{a}, lb.nonDraining([]*Target{a}))
+
+	time.Sleep(100 * time.Millisecond)
+	testutil.Assert(t, !lb.IsDraining(a), "a should be undrained")
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.drainedTotal.WithLabelValues(drainedTimeout)))
+	testutil.Equals(t, 1, len(lb.conns.conns[a.Key()]))
+	testutil.Equals(t, 0, promtestutil.CollectAndCount(metrics.drainingInFlight))
+}
+
+func TestTransport_DrainTarget_SameDialAddress(t *testing.T) {
+	lb := &Transport{metrics: NewMetrics(nil)}
+
+	// Both targets dial a:80, but only connections of the drained one are closed.
+	a := &Target{DialAddr: url.URL{Scheme: "http", Host: "a"}}
+	a80 := &Target{DialAddr: url.URL{Scheme: "http", Host: "a:80"}}
+	for _, target := range []*Target{a, a80} {
+		c1, c2 := net.Pipe()
+		defer func() { _ = c2.Close() }()
+		_, err := lb.conns.wrapDialContext(func(context.Context, string, string) (net.Conn, error) { return c1, nil })(context.WithValue(context.Background(), targetCtxKey{}, target), "tcp", "a:80")
+		testutil.Ok(t, err)
+	}
+
+	<-lb.DrainTarget(a, 1*time.Minute)
+	testutil.Equals(t, 0, len(lb.conns.conns[a.Key()]))
+	testutil.Equals(t, 1, len(lb.conns.conns[a80.Key()]))
+}
+
+func TestTransport_DrainLabel(t *testing.T) {
+	lb := &Transport{metrics: NewMetrics(nil), drainTimeout: 1 * time.Minute}
+
+	targets := []*Target{
+		{DialAddr: url.URL{Host: "a"}, Labels: Labels{DrainLabel: "true"}},
+		{DialAddr: url.URL{Host: "b"}, Labels: Labels{DrainLabel: "false"}},
+		{DialAddr: url.URL{Host: "c"}},
+	}
+	testutil.Equals(t, targets[1:], lb.nonDraining(targets))
+	testutil.Equals(t, targets[1:], lb.nonDraining(targets[1:]))
+	testutil.Assert(t, lb.inFlight.isDraining(targets[0]), "a should be draining")
+
+	// Target is identified by its address, so it is undrained once discovery stops requesting drain.
+	relabeled := []*Target{{DialAddr: url.URL{Host: "a"}}, targets[1], targets[2]}
+	testutil.Equals(t, relabeled, lb.nonDraining(relabeled))
+	testutil.Assert(t, !lb.inFlight.isDraining(relabeled[0]), "a should not be draining")
+
+	// Manual drain is kept regardless of labels.
+	lb.DrainTarget(targets[1], 1*time.Minute)
+	testutil.Equals(t, []*Target{relabeled[0], targets[2]}, lb.nonDraining([]*Target{relabeled[0], {DialAddr: url.URL{Host: "b"}}, targets[2]}))
+}
@@ -0,0 +1,96 @@
+package lbtransport
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/observatorium/observable-demo/pkg/conntrack"
+	"github.com/pkg/errors"
+)
+
+const grpcStatusHeader = "Grpc-Status"
+
+// roundTripGRPC proxies gRPC call. Call may be a long-lived stream, so request body is streamed and replayed on retry
+// only if no more than the replay limit was read from it. Apart from dial errors, call is retried on another target if
+// the target responded with retryable gRPC status before sending any message (trailers-only response).
+func (t *Transport) roundTripGRPC(r *http.Request, targets []*Target, durationRT *time.Duration) (*http.Response, error) {
+	var body *streamingBody
+	// Request stream may outlive the round trip, so the request body is closed once the response is done.
+	closeBody := func() {}
+	if r.Body != nil {
+		orig := r.Body
+		closeBody = func() { _ = orig.Close() }
+		body = newStreamingBody(orig, t.grpcReplayLimit)
+	}
+
+	// Draining targets never receive new requests.
+	targets = t.nonDraining(targets)
+
+	for r.Context().Err() == nil {
+		target := t.picker.Pick(targets)
+		if target == nil {
+			closeBody()
+			t.metrics.failures.WithLabelValues(failedNoTargetAvailable).Inc()
+			return nil, errors.Errorf("lb: no target is available")
+		}
+
+		if body != nil {
+			attempt, ok := body.newAttempt()
+			if !ok {
+				closeBody()
+				t.metrics.failures.WithLabelValues(failedGRPCReplayLimit).Inc()
+				return nil, errBodyNotReplayable
+			}
+			r.Body = attempt
+		}
+
+		startRT := time.Now()
+		resp, done, err := t.roundTripTarget(r, target)
+		if err == nil {
+			if code := resp.Header.Get(grpcStatusHeader); t.grpcRetryableCodes[code] && len(targets) > 1 && body.replayable() {
+				// Retry on other targets, without excluding this one from picking, as the target is reachable.
+				t.metrics.grpcRetriesTotal.WithLabelValues(code).Inc()
+				_ = resp.Body.Close()
+				done()
+				targets = withoutTarget(targets, target)
+				continue
+			}
+
+			// Success.
+			*durationRT = time.Since(startRT)
+			t.metrics.successes.Inc()
+			// Request is in flight until the response body is closed.
+			resp.Body = &doneOnCloseBody{ReadCloser: resp.Body, done: func() {
+				done()
+				closeBody()
+			}}
+			return resp, nil
+		}
+		done()
+
+		if !isDialError(err) {
+			closeBody()
+			t.metrics.failures.WithLabelValues(conntrack.ErrorReason(err)).Inc()
+			return resp, err
+		}
+
+		// Retry without this target.
+		// NOTE: We need to trust picker that it blacklist the targets well.
+		t.picker.ExcludeTarget(target)
+	}
+
+	closeBody()
+	t.metrics.failures.WithLabelValues(conntrack.ErrorReason(r.Context().Err())).Inc()
+	return nil, r.Context().Err()
+}
+
+// withoutTarget returns copy of targets without the given one.
+func withoutTarget(targets []*Target, target *Target) []*Target {
+	filtered := make([]*Target, 0, len(targets))
+	for _, t := range targets {
+		if t != target {
+			filtered = append(filtered, t)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,210 @@
+package lbtransport
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/observatorium/observable-demo/pkg/exthttp"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func newH2CServer(t *testing.T, handler http.HandlerFunc) *url.URL {
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.Protocols = &http.Protocols{}
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+	return u
+}
+
+func newGRPCRequest(body io.Reader) *http.Request {
+	r := httptest.NewRequest("POST", "http://whatever/grpc.health.v1.Health/Watch", body)
+	r.Header.Set("Content-Type", "application/grpc")
+	r.Header.Set("TE", "trailers")
+	return r
+}
+
+func TestTransport_GRPC_RetryAndTrailers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	unavailable := newH2CServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// Trailers-only response.
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "14")
+		w.WriteHeader(http.StatusOK)
+	})
+	var path string
+	ok := newH2CServer(t, func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(b)
+		w.Header().Set("Grpc-Status", "0")
+	})
+
+	reg := prometheus.NewRegistry()
+	// Picker starting with the unavailable target.
+	lb := NewLoadBalancingTransportWithContext(
+		ctx,
+		NewStaticDiscoveryFromTargets([]*Target{{DialAddr: *ok}, {DialAddr: *unavailable}}, nil),
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		NewMetrics(reg),
+	)
+
+	resp, err := lb.RoundTrip(newGRPCRequest(strings.NewReader("message")))
+	testutil.Ok(t, err)
+	b, err := ioutil.ReadAll(resp.Body)
+	testutil.Ok(t, err)
+	testutil.Ok(t, resp.Body.Close())
+
+	testutil.Equals(t, "message", string(b))
+	testutil.Equals(t, "0", resp.Trailer.Get("Grpc-Status"))
+	// Target receives the called gRPC method.
+	testutil.Equals(t, "/grpc.health.v1.Health/Watch", path)
+	testutil.Equals(t, 1.0, gatheredCounter(t, reg, "lbtransport_grpc_retries_total", "code", "14"))
+	testutil.Equals(t, 1.0, gatheredCounter(t, reg, "http_client_requests_total", "code", "14"))
+	testutil.Equals(t, 1.0, gatheredCounter(t, reg, "http_client_requests_total", "code", "0"))
+}
+
+func TestTransport_GRPC_TLSWithoutHTTP2(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !exthttp.IsGRPCRequest(r) {
+			_, _ = w.Write([]byte("ok"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	// HTTP/2 is not enabled for HTTPS targets.
+	lb := NewLoadBalancingTransportWithContext(
+		ctx,
+		NewStaticDiscoveryFromTargets([]*Target{{DialAddr: *u}}, nil),
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		NewMetrics(nil),
+		WithTLSConfig(srv.Client().Transport.(*http.Transport).TLSClientConfig),
+		WithWarmConnsPerTarget(1),
+	)
+
+	// gRPC requires HTTP/2, so it is negotiated for gRPC calls anyway.
+	resp, err := lb.RoundTrip(newGRPCRequest(strings.NewReader("message")))
+	testutil.Ok(t, err)
+	_, err = ioutil.ReadAll(resp.Body)
+	testutil.Ok(t, err)
+	testutil.Ok(t, resp.Body.Close())
+	testutil.Equals(t, 2, resp.ProtoMajor)
+	testutil.Equals(t, "0", resp.Trailer.Get("Grpc-Status"))
+
+	// Other requests still use HTTP/1.1.
+	resp, err = lb.RoundTrip(httptest.NewRequest("GET", "http://whatever", nil))
+	testutil.Ok(t, err)
+	testutil.Ok(t, resp.Body.Close())
+	testutil.Equals(t, 1, resp.ProtoMajor)
+}
+
+func TestTransport_GRPC_BidiStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echo := newH2CServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+
+		buf := make([]byte, 1024)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				_, _ = w.Write(buf[:n])
+				w.(http.Flusher).Flush()
+			}
+			if err != nil {
+				break
+			}
+		}
+		w.Header().Set("Grpc-Status", "0")
+	})
+
+	lb := NewLoadBalancingTransportWithContext(
+		ctx,
+		NewStaticDiscoveryFromTargets([]*Target{{DialAddr: *echo}}, nil),
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		NewMetrics(nil),
+	)
+
+	pr, pw := io.Pipe()
+	resp, err := lb.RoundTrip(newGRPCRequest(pr))
+	testutil.Ok(t, err)
+
+	// Messages are proxied as they come, without waiting for the end of the request stream.
+	buf := make([]byte, 1024)
+	for _, msg := range []string{"ping", "pong"} {
+		_, err := pw.Write([]byte(msg))
+		testutil.Ok(t, err)
+		n, err := resp.Body.Read(buf)
+		testutil.Ok(t, err)
+		testutil.Equals(t, msg, string(buf[:n]))
+	}
+	testutil.Ok(t, pw.Close())
+
+	_, err = ioutil.ReadAll(resp.Body)
+	testutil.Ok(t, err)
+	testutil.Ok(t, resp.Body.Close())
+	testutil.Equals(t, "0", resp.Trailer.Get("Grpc-Status"))
+}
+
+func TestTransport_GRPC_ReplayLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	metrics := NewMetrics(nil)
+	lb := &Transport{
+		discovery: &mockedDiscovery{targets: []string{"a", "b"}},
+		picker:    NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		metrics:   metrics,
+		// Target fails with dial error only after the request stream was read.
+		parent: promhttp.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			_, _ = ioutil.ReadAll(r.Body)
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+		}),
+		grpcReplayLimit: 4,
+	}
+
+	_, err := lb.RoundTrip(newGRPCRequest(strings.NewReader("message")))
+	testutil.Equals(t, errBodyNotReplayable, err)
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.failures.WithLabelValues(failedGRPCReplayLimit)))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.failures.WithLabelValues("unknown")))
+}
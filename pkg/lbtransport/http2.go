@@ -0,0 +1,84 @@
+package lbtransport
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+
+	"github.com/observatorium/observable-demo/pkg/exthttp"
+)
+
+const (
+	// ProtocolLabel is a target label that sets protocol the target speaks. Currently only "h2c" (cleartext HTTP/2 with
+	// prior knowledge) is supported; targets without it use HTTP/1.1 (or HTTP/2 negotiated via ALPN, see WithHTTP2).
+	ProtocolLabel = "protocol"
+
+	protocolH2C = "h2c"
+)
+
+// newH2CTransport returns transport that speaks only cleartext HTTP/2 with prior knowledge, using the same dialer and
+// connection pool settings as the given one. HTTP/2 multiplexes requests over a single connection per target, so
+// conntrack dialer metrics count connections, not requests.
+func newH2CTransport(t *http.Transport) *http.Transport {
+	h2c := t.Clone()
+	h2c.Protocols = &http.Protocols{}
+	h2c.Protocols.SetUnencryptedHTTP2(true)
+	return h2c
+}
+
+// newHTTP2Transport returns transport that speaks only HTTP/2 over TLS, using the same dialer and connection pool
+// settings as the given one. Its connections have to negotiate HTTP/2 via ALPN (see http2FromContext).
+func newHTTP2Transport(t *http.Transport) *http.Transport {
+	h2 := t.Clone()
+	h2.Protocols = &http.Protocols{}
+	h2.Protocols.SetHTTP2(true)
+	return h2
+}
+
+type http2CtxKey struct{}
+
+// http2FromContext returns true if context is of the request that requires HTTP/2 over TLS, even though HTTP/2 is not
+// enabled for HTTPS targets (see WithHTTP2), e.g gRPC call.
+func http2FromContext(ctx context.Context) bool {
+	h2, _ := ctx.Value(http2CtxKey{}).(bool)
+	return h2
+}
+
+// requiresHTTP2Parent returns true if the given request to the given target has to be sent with HTTP/2 only parent
+// transport. gRPC requires HTTP/2, so gRPC calls to HTTPS targets use it if HTTP/2 is not enabled for HTTPS targets.
+func (t *Transport) requiresHTTP2Parent(target *Target, r *http.Request) bool {
+	return t.grpcTLSParents != nil && target.DialAddr.Scheme == "https" && exthttp.IsGRPCRequest(r)
+}
+
+// parentFor returns round tripper the given request to the given target is sent with. gRPC requires HTTP/2, so gRPC
+// calls to HTTP targets always use h2c, and gRPC calls to HTTPS targets always negotiate HTTP/2. Upgrade requests
+// (e.g WebSocket) always use HTTP/1.1. HTTPS targets use connection pool of their TLS configuration.
+func (t *Transport) parentFor(target *Target, r *http.Request) http.RoundTripper {
+	if t.h2cParent == nil {
+		// Parent given by the caller.
+		return t.parent
+	}
+	if t.requiresHTTP2Parent(target, r) {
+		return t.grpcTLSParents.forTarget(target)
+	}
+	if target.DialAddr.Scheme == "https" {
+		return t.tlsParents.forTarget(target)
+	}
+	if target.DialAddr.Scheme != "http" || exthttp.IsUpgradeRequest(r) {
+		return t.parent
+	}
+	if exthttp.IsGRPCRequest(r) || t.h2cAll || target.Labels[ProtocolLabel] == protocolH2C {
+		return t.h2cParent
+	}
+	return t.parent
+}
+
+// withHTTP2NextProtos returns TLS configuration advertising HTTP/2 via ALPN, with HTTP/1.1 as a fallback.
+func withHTTP2NextProtos(cfg *tls.Config) *tls.Config {
+	if len(cfg.NextProtos) > 0 {
+		return cfg
+	}
+	cfg = cfg.Clone()
+	cfg.NextProtos = []string{"h2", "http/1.1"}
+	return cfg
+}
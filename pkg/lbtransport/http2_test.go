@@ -0,0 +1,132 @@
+package lbtransport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+// newHTTP2Backend returns backend counting requests received via HTTP/2.
+func newHTTP2Backend(t *testing.T, tls bool) (*httptest.Server, *int, *sync.Mutex) {
+	var (
+		mu       sync.Mutex
+		requests int
+	)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+			return
+		}
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	if tls {
+		srv.EnableHTTP2 = true
+		srv.StartTLS()
+		return srv, &requests, &mu
+	}
+	srv.Config.Protocols = &http.Protocols{}
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	return srv, &requests, &mu
+}
+
+func TestTransport_H2C(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv1, requests1, mu1 := newHTTP2Backend(t, false)
+	defer srv1.Close()
+	srv2, requests2, mu2 := newHTTP2Backend(t, false)
+	defer srv2.Close()
+
+	u1, err := url.Parse(srv1.URL)
+	testutil.Ok(t, err)
+	u2, err := url.Parse(srv2.URL)
+	testutil.Ok(t, err)
+
+	reg := prometheus.NewRegistry()
+	lb := NewLoadBalancingTransportWithContext(
+		ctx,
+		NewStaticDiscoveryFromTargets([]*Target{
+			{DialAddr: *u1, Labels: Labels{ProtocolLabel: "h2c"}},
+			{DialAddr: *u2, Labels: Labels{ProtocolLabel: "h2c"}},
+		}, nil),
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		NewMetrics(reg),
+	)
+
+	// Keep all responses open, so HTTP/1.1 would need new connection for each request.
+	var resps []*http.Response
+	for i := 0; i < 6; i++ {
+		resp, err := lb.RoundTrip(httptest.NewRequest("GET", "http://whatever", nil))
+		testutil.Ok(t, err)
+		testutil.Equals(t, http.StatusOK, resp.StatusCode)
+		testutil.Equals(t, 2, resp.ProtoMajor)
+		resps = append(resps, resp)
+	}
+	for _, resp := range resps {
+		testutil.Ok(t, resp.Body.Close())
+	}
+
+	// Requests are still balanced one by one, but multiplexed over single connection per target.
+	mu1.Lock()
+	testutil.Equals(t, 3, *requests1)
+	mu1.Unlock()
+	mu2.Lock()
+	testutil.Equals(t, 3, *requests2)
+	mu2.Unlock()
+	testutil.Equals(t, 2.0, gatheredCounter(t, reg, "conntrack_dialer_conn_established_total", "", ""))
+}
+
+func TestTransport_HTTP2OverTLS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv, requests, mu := newHTTP2Backend(t, true)
+	defer srv.Close()
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	reg := prometheus.NewRegistry()
+	lb := NewLoadBalancingTransportWithContext(
+		ctx,
+		NewStaticDiscoveryFromTargets([]*Target{{DialAddr: *u}}, nil),
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		NewMetrics(reg),
+		WithTLSConfig(&tls.Config{RootCAs: pool}),
+		WithHTTP2(),
+	)
+
+	var resps []*http.Response
+	for i := 0; i < 3; i++ {
+		resp, err := lb.RoundTrip(httptest.NewRequest("GET", "http://whatever", nil))
+		testutil.Ok(t, err)
+		testutil.Equals(t, http.StatusOK, resp.StatusCode)
+		testutil.Equals(t, 2, resp.ProtoMajor)
+		resps = append(resps, resp)
+	}
+	for _, resp := range resps {
+		testutil.Ok(t, resp.Body.Close())
+	}
+
+	mu.Lock()
+	testutil.Equals(t, 3, *requests)
+	mu.Unlock()
+	testutil.Equals(t, 1.0, gatheredCounter(t, reg, "conntrack_dialer_conn_established_total", "", ""))
+}
@@ -0,0 +1,354 @@
+package lbadmin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/observatorium/observable-demo/pkg/lbtransport"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	actionAddTarget       = "add_target"
+	actionRemoveTarget    = "remove_target"
+	actionExcludeTarget   = "exclude_target"
+	actionUnexcludeTarget = "unexclude_target"
+	actionSetBackoff      = "set_backoff"
+	actionDrainTarget     = "drain_target"
+	actionUndrainTarget   = "undrain_target"
+)
+
+type metrics struct {
+	changesTotal       *prometheus.CounterVec
+	unauthorizedTotal  prometheus.Counter
+	failedChangesTotal *prometheus.CounterVec
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		changesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "lbadmin",
+			Name:      "changes_total",
+			Help:      "Total number of changes applied via admin API.",
+		}, []string{"action"}),
+		failedChangesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "lbadmin",
+			Name:      "failed_changes_total",
+			Help:      "Total number of changes requested via admin API that were rejected.",
+		}, []string{"action"}),
+		unauthorizedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Subsystem: "lbadmin",
+			Name:      "unauthorized_requests_total",
+			Help:      "Total number of admin API requests rejected due to missing or invalid token.",
+		}),
+	}
+
+	if reg != nil {
+		reg.MustRegister(m.changesTotal, m.failedChangesTotal, m.unauthorizedTotal)
+	}
+
+	for _, a := range []string{actionAddTarget, actionRemoveTarget, actionExcludeTarget, actionUnexcludeTarget, actionSetBackoff, actionDrainTarget, actionUndrainTarget} {
+		m.changesTotal.WithLabelValues(a)
+		m.failedChangesTotal.WithLabelValues(a)
+	}
+	return m
+}
+
+// API is an authenticated HTTP API allowing to manage load balancer targets in runtime.
+//
+// Endpoints:
+//
+//	GET    /targets                                         Lists discovered targets together with their picker state.
+//	POST   /targets                                         Adds static target. Body: {"target": "<URL>", "labels": {"<name>": "<value>"}}.
+//	                                                        Labels with TLS file paths (e.g tls_ca_file) are rejected.
+//	DELETE /targets?target=<URL>                            Removes static target.
+//	POST   /targets/exclude?target=<URL>                    Excludes target until it is unexcluded.
+//	POST   /targets/unexclude?target=<URL>                  Removes any exclusion of the target.
+//	POST   /targets/drain?target=<URL>[&timeout=<duration>] Drains target. Transport's drain timeout is used by default.
+//	POST   /targets/undrain?target=<URL>                    Allows drained target to be picked again.
+//	GET    /backoff                                         Returns blacklist backoff duration.
+//	PUT    /backoff?duration=<duration>                     Changes blacklist backoff duration.
+//
+// Every request has to contain `Authorization: Bearer <token>` header.
+type API struct {
+	token     string
+	discovery lbtransport.Discovery
+	static    *lbtransport.MutableStaticDiscovery
+	picker    *lbtransport.RoundRobinPicker
+	transport *lbtransport.Transport
+
+	metrics *metrics
+	mux     *http.ServeMux
+}
+
+// New returns admin API. Discovery is used to list all targets, whereas static discovery is the one targets are added to
+// or removed from.
+func New(
+	reg prometheus.Registerer,
+	token string,
+	discovery lbtransport.Discovery,
+	static *lbtransport.MutableStaticDiscovery,
+	picker *lbtransport.RoundRobinPicker,
+	transport *lbtransport.Transport,
+) *API {
+	a := &API{
+		token:     token,
+		discovery: discovery,
+		static:    static,
+		picker:    picker,
+		transport: transport,
+		metrics:   newMetrics(reg),
+		mux:       http.NewServeMux(),
+	}
+
+	a.mux.HandleFunc("/targets", a.targets)
+	a.mux.HandleFunc("/targets/exclude", a.exclude)
+	a.mux.HandleFunc("/targets/unexclude", a.unexclude)
+	a.mux.HandleFunc("/targets/drain", a.drain)
+	a.mux.HandleFunc("/targets/undrain", a.undrain)
+	a.mux.HandleFunc("/backoff", a.backoff)
+	return a
+}
+
+// Handle registers additional handler for the given pattern, e.g debug pages. It requires the same token as the API.
+func (a *API) Handle(pattern string, handler http.Handler) {
+	a.mux.Handle(pattern, handler)
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if a.token == "" || !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(a.token)) != 1 {
+		a.metrics.unauthorizedTotal.Inc()
+		log.Printf("audit: lbadmin: unauthorized method=%s path=%s remote=%s\n", r.Method, r.URL.Path, r.RemoteAddr)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	a.mux.ServeHTTP(w, r)
+}
+
+type targetJSON struct {
+	Target           string            `json:"target"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	Static           bool              `json:"static"`
+	BlacklistedUntil *time.Time        `json:"blacklisted_until,omitempty"`
+	ManuallyExcluded bool              `json:"manually_excluded"`
+	Draining         bool              `json:"draining"`
+}
+
+func (a *API) targets(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a.listTargets(w)
+	case http.MethodPost:
+		a.addTarget(w, r)
+	case http.MethodDelete:
+		a.removeTarget(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *API) listTargets(w http.ResponseWriter) {
+	static := map[url.URL]struct{}{}
+	for _, t := range a.static.Targets() {
+		static[t.DialAddr] = struct{}{}
+	}
+
+	resp := []targetJSON{}
+	for _, t := range a.discovery.Targets() {
+		state := a.picker.TargetState(t)
+		_, isStatic := static[t.DialAddr]
+
+		tj := targetJSON{
+			Target:           t.DialAddr.String(),
+			Labels:           t.Labels,
+			Static:           isStatic,
+			ManuallyExcluded: state.ManuallyExcluded,
+			Draining:         a.transport.IsDraining(t),
+		}
+		if !state.BlacklistedUntil.IsZero() {
+			tj.BlacklistedUntil = &state.BlacklistedUntil
+		}
+		resp = append(resp, tj)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Printf("error: lbadmin: failed to encode targets, err: %v\n", err)
+	}
+}
+
+func (a *API) addTarget(w http.ResponseWriter, r *http.Request) {
+	var req targetJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		a.fail(w, r, actionAddTarget, "", http.StatusBadRequest, "decode body: "+err.Error())
+		return
+	}
+	u, ok := parseTargetURL(req.Target)
+	if !ok {
+		a.fail(w, r, actionAddTarget, req.Target, http.StatusBadRequest, invalidTargetURL)
+		return
+	}
+	for n := range req.Labels {
+		// Otherwise API caller could make load balancer read any file on the host as key material.
+		if lbtransport.IsTLSFileLabel(n) {
+			a.fail(w, r, actionAddTarget, u.String(), http.StatusBadRequest, "label "+n+" is not allowed via admin API")
+			return
+		}
+	}
+
+	if !a.static.AddTarget(&lbtransport.Target{DialAddr: *u, Labels: req.Labels}) {
+		a.fail(w, r, actionAddTarget, u.String(), http.StatusConflict, "target already exists")
+		return
+	}
+	a.audit(r, actionAddTarget, u.String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (a *API) removeTarget(w http.ResponseWriter, r *http.Request) {
+	arg := r.URL.Query().Get("target")
+	u, ok := parseTargetURL(arg)
+	if !ok {
+		a.fail(w, r, actionRemoveTarget, arg, http.StatusBadRequest, invalidTargetURL)
+		return
+	}
+
+	if !a.static.RemoveTarget(*u) {
+		a.fail(w, r, actionRemoveTarget, u.String(), http.StatusNotFound, "no such static target")
+		return
+	}
+	a.audit(r, actionRemoveTarget, u.String())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) exclude(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	target, ok := a.findTarget(r.URL.Query().Get("target"))
+	if !ok {
+		a.fail(w, r, actionExcludeTarget, r.URL.Query().Get("target"), http.StatusNotFound, "no such target")
+		return
+	}
+	a.picker.ManuallyExcludeTarget(target)
+	a.audit(r, actionExcludeTarget, target.DialAddr.String())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) unexclude(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	target, ok := a.findTarget(r.URL.Query().Get("target"))
+	if !ok {
+		a.fail(w, r, actionUnexcludeTarget, r.URL.Query().Get("target"), http.StatusNotFound, "no such target")
+		return
+	}
+	a.picker.UnexcludeTarget(target)
+	a.audit(r, actionUnexcludeTarget, target.DialAddr.String())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) drain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	timeout := a.transport.DrainTimeout()
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil || d < 0 {
+			a.fail(w, r, actionDrainTarget, t, http.StatusBadRequest, "invalid timeout")
+			return
+		}
+		timeout = d
+	}
+
+	target, ok := a.findTarget(r.URL.Query().Get("target"))
+	if !ok {
+		a.fail(w, r, actionDrainTarget, r.URL.Query().Get("target"), http.StatusNotFound, "no such target")
+		return
+	}
+	a.transport.DrainTarget(target, timeout)
+	a.audit(r, actionDrainTarget, target.DialAddr.String())
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (a *API) undrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	target, ok := a.findTarget(r.URL.Query().Get("target"))
+	if !ok {
+		a.fail(w, r, actionUndrainTarget, r.URL.Query().Get("target"), http.StatusNotFound, "no such target")
+		return
+	}
+	a.transport.UndrainTarget(target)
+	a.audit(r, actionUndrainTarget, target.DialAddr.String())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) backoff(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		_, _ = w.Write([]byte(a.picker.BlacklistBackoff().String()))
+	case http.MethodPut:
+		d, err := time.ParseDuration(r.URL.Query().Get("duration"))
+		if err != nil || d < 0 {
+			a.fail(w, r, actionSetBackoff, r.URL.Query().Get("duration"), http.StatusBadRequest, "invalid duration")
+			return
+		}
+		a.picker.SetBlacklistBackoff(d)
+		a.audit(r, actionSetBackoff, d.String())
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *API) findTarget(addr string) (*lbtransport.Target, bool) {
+	for _, t := range a.discovery.Targets() {
+		if t.DialAddr.String() == addr {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+const invalidTargetURL = "invalid target URL, expected http(s)://host[:port]"
+
+// parseTargetURL parses URL of the target. Requests to targets without address or with unsupported scheme fail without
+// being retried with other targets, so such targets are rejected.
+func parseTargetURL(s string) (*url.URL, bool) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, false
+	}
+	return u, true
+}
+
+// audit records applied change.
+func (a *API) audit(r *http.Request, action string, arg string) {
+	a.metrics.changesTotal.WithLabelValues(action).Inc()
+	log.Printf("audit: lbadmin: action=%s arg=%s remote=%s result=ok\n", action, arg, r.RemoteAddr)
+}
+
+// fail records rejected change and responds with the given error.
+func (a *API) fail(w http.ResponseWriter, r *http.Request, action string, arg string, code int, msg string) {
+	a.metrics.failedChangesTotal.WithLabelValues(action).Inc()
+	log.Printf("audit: lbadmin: action=%s arg=%s remote=%s result=failed error=%q\n", action, arg, r.RemoteAddr, msg)
+	http.Error(w, msg, code)
+}
@@ -0,0 +1,118 @@
+package lbadmin
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/observatorium/observable-demo/pkg/lbtransport"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestAPI(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	static := lbtransport.NewMutableStaticDiscovery([]url.URL{{Scheme: "http", Host: "a"}}, nil)
+	picker := lbtransport.NewRoundRobinPicker(ctx, nil, 5*time.Second)
+	transport := lbtransport.NewLoadBalancingTransportWithContext(ctx, static, picker, lbtransport.NewMetrics(nil))
+	api := New(nil, "secret", static, static, picker, transport)
+
+	var auditLog bytes.Buffer
+	log.SetOutput(&auditLog)
+	defer log.SetOutput(os.Stderr)
+
+	do := func(method, target, token, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		return w
+	}
+
+	testutil.Equals(t, http.StatusUnauthorized, do(http.MethodGet, "/targets", "", "").Code)
+	testutil.Equals(t, http.StatusUnauthorized, do(http.MethodGet, "/targets", "wrong", "").Code)
+	testutil.Equals(t, float64(2), promtestutil.ToFloat64(api.metrics.unauthorizedTotal))
+
+	testutil.Equals(t, http.StatusCreated, do(http.MethodPost, "/targets", "secret", `{"target":"http://b","labels":{"zone":"eu"}}`).Code)
+	testutil.Equals(t, http.StatusConflict, do(http.MethodPost, "/targets", "secret", `{"target":"http://b"}`).Code)
+	testutil.Equals(t, http.StatusBadRequest, do(http.MethodPost, "/targets", "secret", `{"target":""}`).Code)
+	testutil.Equals(t, http.StatusBadRequest, do(http.MethodPost, "/targets", "secret", `{"target":"foo"}`).Code)
+	testutil.Equals(t, http.StatusBadRequest, do(http.MethodPost, "/targets", "secret", `{"target":"host:8080"}`).Code)
+	testutil.Equals(t, http.StatusBadRequest, do(http.MethodPost, "/targets", "secret", `{"target":"ftp://host"}`).Code)
+	testutil.Equals(t, http.StatusBadRequest, do(http.MethodPost, "/targets", "secret", `{"target":"https://c","labels":{"tls_key_file":"/etc/shadow"}}`).Code)
+	testutil.Equals(t, http.StatusNoContent, do(http.MethodPost, "/targets/exclude?target=http://b", "secret", "").Code)
+	testutil.Equals(t, http.StatusNotFound, do(http.MethodPost, "/targets/exclude?target=http://c", "secret", "").Code)
+
+	testutil.Equals(t, http.StatusAccepted, do(http.MethodPost, "/targets/drain?target=http://a&timeout=1s", "secret", "").Code)
+
+	w := do(http.MethodGet, "/targets", "secret", "")
+	testutil.Equals(t, http.StatusOK, w.Code)
+	testutil.Equals(t, `[{"target":"http://a","static":true,"manually_excluded":false,"draining":true},`+
+		`{"target":"http://b","labels":{"zone":"eu"},"static":true,"manually_excluded":true,"draining":false}]`+"\n", w.Body.String())
+	testutil.Equals(t, http.StatusNoContent, do(http.MethodPost, "/targets/undrain?target=http://a", "secret", "").Code)
+
+	testutil.Equals(t, http.StatusNoContent, do(http.MethodPost, "/targets/unexclude?target=http://b", "secret", "").Code)
+	testutil.Equals(t, http.StatusNoContent, do(http.MethodDelete, "/targets?target=http://a", "secret", "").Code)
+	testutil.Equals(t, http.StatusNotFound, do(http.MethodDelete, "/targets?target=http://a", "secret", "").Code)
+	testutil.Equals(t, http.StatusBadRequest, do(http.MethodDelete, "/targets?target=a", "secret", "").Code)
+
+	testutil.Equals(t, http.StatusNoContent, do(http.MethodPut, "/backoff?duration=1m", "secret", "").Code)
+	testutil.Equals(t, http.StatusBadRequest, do(http.MethodPut, "/backoff?duration=xx", "secret", "").Code)
+	testutil.Equals(t, 1*time.Minute, picker.BlacklistBackoff())
+
+	testutil.Equals(t, float64(1), promtestutil.ToFloat64(api.metrics.changesTotal.WithLabelValues(actionAddTarget)))
+	testutil.Equals(t, float64(1), promtestutil.ToFloat64(api.metrics.changesTotal.WithLabelValues(actionRemoveTarget)))
+	testutil.Equals(t, float64(1), promtestutil.ToFloat64(api.metrics.changesTotal.WithLabelValues(actionExcludeTarget)))
+	testutil.Equals(t, float64(1), promtestutil.ToFloat64(api.metrics.changesTotal.WithLabelValues(actionUnexcludeTarget)))
+	testutil.Equals(t, float64(1), promtestutil.ToFloat64(api.metrics.changesTotal.WithLabelValues(actionSetBackoff)))
+	testutil.Equals(t, float64(1), promtestutil.ToFloat64(api.metrics.changesTotal.WithLabelValues(actionDrainTarget)))
+	testutil.Equals(t, float64(1), promtestutil.ToFloat64(api.metrics.changesTotal.WithLabelValues(actionUndrainTarget)))
+	testutil.Equals(t, float64(6), promtestutil.ToFloat64(api.metrics.failedChangesTotal.WithLabelValues(actionAddTarget)))
+	testutil.Equals(t, float64(2), promtestutil.ToFloat64(api.metrics.failedChangesTotal.WithLabelValues(actionRemoveTarget)))
+
+	// Rejected and unauthorized attempts are audited too.
+	logged := auditLog.String()
+	for _, line := range []string{
+		"audit: lbadmin: unauthorized method=GET path=/targets",
+		"audit: lbadmin: action=add_target arg=http://b remote=192.0.2.1:1234 result=ok",
+		`audit: lbadmin: action=add_target arg=ftp://host remote=192.0.2.1:1234 result=failed error="invalid target URL, expected http(s)://host[:port]"`,
+		`audit: lbadmin: action=add_target arg=https://c remote=192.0.2.1:1234 result=failed error="label tls_key_file is not allowed via admin API"`,
+		`audit: lbadmin: action=remove_target arg=a remote=192.0.2.1:1234 result=failed error="invalid target URL, expected http(s)://host[:port]"`,
+		`audit: lbadmin: action=exclude_target arg=http://c remote=192.0.2.1:1234 result=failed error="no such target"`,
+	} {
+		testutil.Assert(t, strings.Contains(logged, line), "expected %q in audit log:\n%s", line, logged)
+	}
+}
+
+func TestAPI_Handle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	static := lbtransport.NewMutableStaticDiscovery(nil, nil)
+	picker := lbtransport.NewRoundRobinPicker(ctx, nil, 5*time.Second)
+	transport := lbtransport.NewLoadBalancingTransportWithContext(ctx, static, picker, lbtransport.NewMetrics(nil))
+	api := New(nil, "secret", static, static, picker, transport)
+	api.Handle("/debug/conns", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// Additional handlers require the token too.
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/conns", nil))
+	testutil.Equals(t, http.StatusUnauthorized, w.Code)
+
+	r := httptest.NewRequest(http.MethodGet, "/debug/conns", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	api.ServeHTTP(w, r)
+	testutil.Equals(t, http.StatusOK, w.Code)
+}
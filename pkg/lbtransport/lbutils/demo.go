@@ -6,21 +6,32 @@ import (
 	"net"
 	"net/http"
 	"sync/atomic"
-	"syscall"
 	"time"
 
 	"github.com/observatorium/observable-demo/pkg/conntrack"
 	"github.com/observatorium/observable-demo/pkg/exthttp"
+	"github.com/observatorium/observable-demo/pkg/faultnet"
 	"github.com/oklog/run"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// ListenFunc is the signature of net.Listen.
+type ListenFunc func(network, address string) (net.Listener, error)
+
+// CreateDemoEndpoints adds demo servers listening on the given addresses to the group: always OK one, one failing every
+// 10th request and one refusing connections from time to time.
 func CreateDemoEndpoints(reg prometheus.Registerer, g *run.Group, addr1, addr2, addr3 string) {
+	CreateDemoEndpointsWithListen(reg, g, net.Listen, addr1, addr2, addr3)
+}
+
+// CreateDemoEndpointsWithListen is like CreateDemoEndpoints, but servers listen with the given function, e.g Listen of
+// memnet.Net for hermetic tests.
+func CreateDemoEndpointsWithListen(reg prometheus.Registerer, g *run.Group, listen ListenFunc, addr1, addr2, addr3 string) {
 	{
 		const name = "demo-ok"
 
 		srv := &http.Server{Handler: exthttp.NewMetricsMiddlewareHandler(reg, name, okTestEndpoint(addr1))}
-		l, err := net.Listen("tcp", addr1)
+		l, err := listen("tcp", addr1)
 		if err != nil {
 			log.Fatalf("new demo1 listener failed %v; exiting\n", err)
 		}
@@ -44,7 +55,7 @@ func CreateDemoEndpoints(reg prometheus.Registerer, g *run.Group, addr1, addr2,
 		const name = "demo-500-sometimes"
 
 		srv := &http.Server{Handler: exthttp.NewMetricsMiddlewareHandler(reg, name, flakyTestEndpoint(addr2))}
-		l, err := net.Listen("tcp", addr2)
+		l, err := listen("tcp", addr2)
 		if err != nil {
 			log.Fatalf("new demo2 listener failed %v; exiting\n", err)
 		}
@@ -80,12 +91,13 @@ func CreateDemoEndpoints(reg prometheus.Registerer, g *run.Group, addr1, addr2,
 			)
 
 			for ctx.Err() == nil {
-				l, err := newFlakyTCPListener(addr3)
+				l, err := listen("tcp", addr3)
 				if err != nil {
 					return err
 				}
 
-				_ = srv.Serve(conntrack.NewInstrumentedListener(l, m))
+				// Every 5th accept fails, which stops the server, so connections are refused until it is restarted.
+				_ = srv.Serve(conntrack.NewInstrumentedListener(faultnet.New(faultnet.WithRefuseEvery(5)).Listener(l), m))
 				if ctx.Err() != nil {
 					break
 				}
@@ -135,31 +147,3 @@ func flakyTestEndpoint(addr string) http.HandlerFunc {
 		return
 	}
 }
-
-type flakyListener struct {
-	net.Listener
-
-	counter uint64
-}
-
-func newFlakyTCPListener(address string) (*flakyListener, error) {
-	l, err := net.Listen("tcp", address)
-	if err != nil {
-		return nil, err
-	}
-	return &flakyListener{Listener: l}, nil
-}
-
-// Set max connection to 0 to always hit this.
-func (f *flakyListener) Accept() (net.Conn, error) {
-	cur := atomic.AddUint64(&f.counter, 1)
-	if cur%5 == 0 {
-		return nil, syscall.ECONNREFUSED
-	}
-	return f.Listener.Accept()
-
-}
-
-func (f *flakyListener) Close() error {
-	return f.Listener.Close()
-}
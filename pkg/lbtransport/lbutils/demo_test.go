@@ -0,0 +1,38 @@
+package lbutils
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/observatorium/observable-demo/pkg/memnet"
+	"github.com/oklog/run"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestCreateDemoEndpoints(t *testing.T) {
+	n := memnet.New()
+	g := &run.Group{}
+	CreateDemoEndpointsWithListen(prometheus.NewRegistry(), g, n.Listen, "demo1:80", "demo2:80", "demo3:80")
+
+	stop := make(chan struct{})
+	g.Add(func() error {
+		<-stop
+		return nil
+	}, func(error) {})
+	errs := make(chan error)
+	go func() { errs <- g.Run() }()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: n.DialContext}}
+	resp, err := client.Get("http://demo1/")
+	testutil.Ok(t, err)
+	b, err := ioutil.ReadAll(resp.Body)
+	testutil.Ok(t, err)
+	testutil.Ok(t, resp.Body.Close())
+	testutil.Equals(t, http.StatusOK, resp.StatusCode)
+	testutil.Equals(t, "demo1:80 says hello! (:", string(b))
+
+	close(stop)
+	<-errs
+}
@@ -0,0 +1,179 @@
+package lbtransport
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/observatorium/observable-demo/pkg/conntrack"
+	"github.com/observatorium/observable-demo/pkg/dnscache"
+)
+
+type options struct {
+	dialTimeout           time.Duration
+	keepAlive             time.Duration
+	maxIdleConns          int
+	maxIdleConnsPerHost   int
+	maxConnsPerHost       int
+	idleConnTimeout       time.Duration
+	responseHeaderTimeout time.Duration
+	tlsHandshakeTimeout   time.Duration
+	tlsConfigFunc         TLSConfigFunc
+	parent                http.RoundTripper
+	http2                 bool
+	h2c                   bool
+
+	grpcRetryableCodes []string
+	grpcReplayLimit    int
+
+	dialerOpts  []conntrack.DialerOption
+	resolver    *dnscache.Resolver
+	dialContext dialContextFunc
+
+	drainTimeout time.Duration
+
+	warmConnsPerTarget int
+	maxConnAge         time.Duration
+}
+
+func defaultOptions() options {
+	return options{
+		dialTimeout:         10 * time.Second,
+		keepAlive:           30 * time.Second,
+		maxIdleConns:        4,
+		idleConnTimeout:     90 * time.Second,
+		tlsHandshakeTimeout: 10 * time.Second,
+		tlsConfigFunc:       staticTLSConfigFunc(nil),
+		drainTimeout:        30 * time.Second,
+		grpcRetryableCodes:  []string{"14"}, // Unavailable.
+		grpcReplayLimit:     64 * 1024,
+	}
+}
+
+// Option configures Transport.
+type Option func(*options)
+
+// WithDialTimeout sets maximum time for dialing a target. Default: 10s.
+func WithDialTimeout(d time.Duration) Option {
+	return func(o *options) { o.dialTimeout = d }
+}
+
+// WithKeepAlive sets TCP keep-alive period of connections to targets. Default: 30s.
+func WithKeepAlive(d time.Duration) Option {
+	return func(o *options) { o.keepAlive = d }
+}
+
+// WithMaxIdleConns sets maximum number of idle connections across all targets. Zero means no limit. Default: 4.
+func WithMaxIdleConns(n int) Option {
+	return func(o *options) { o.maxIdleConns = n }
+}
+
+// WithMaxIdleConnsPerHost sets maximum number of idle connections per target. Zero means http.DefaultMaxIdleConnsPerHost.
+func WithMaxIdleConnsPerHost(n int) Option {
+	return func(o *options) { o.maxIdleConnsPerHost = n }
+}
+
+// WithMaxConnsPerHost limits total number of connections per target, including ones in dialing, active and idle
+// state. Zero means no limit.
+func WithMaxConnsPerHost(n int) Option {
+	return func(o *options) { o.maxConnsPerHost = n }
+}
+
+// WithIdleConnTimeout sets how long idle connection stays in the pool. Zero means no limit. Default: 90s.
+func WithIdleConnTimeout(d time.Duration) Option {
+	return func(o *options) { o.idleConnTimeout = d }
+}
+
+// WithResponseHeaderTimeout sets how long to wait for target's response headers after the request is written.
+// Zero means no timeout.
+func WithResponseHeaderTimeout(d time.Duration) Option {
+	return func(o *options) { o.responseHeaderTimeout = d }
+}
+
+// WithTLSHandshakeTimeout sets maximum time for TLS handshake with a target. Default: 10s.
+func WithTLSHandshakeTimeout(d time.Duration) Option {
+	return func(o *options) { o.tlsHandshakeTimeout = d }
+}
+
+// WithTLSConfig sets TLS configuration used for all HTTPS targets. If ServerName is not set, target host is used.
+func WithTLSConfig(c *tls.Config) Option {
+	return func(o *options) { o.tlsConfigFunc = staticTLSConfigFunc(c) }
+}
+
+// WithTLSConfigFunc sets function that returns TLS configuration for the given HTTPS target, allowing per-target
+// configurations. See NewLabelsTLSConfigFunc.
+func WithTLSConfigFunc(fn TLSConfigFunc) Option {
+	return func(o *options) { o.tlsConfigFunc = fn }
+}
+
+// WithParent sets custom round tripper requests are sent with to the picked target. All other connection options are
+// ignored in this case, and connection tracking (used to close connections of drained targets) is not available.
+func WithParent(rt http.RoundTripper) Option {
+	return func(o *options) { o.parent = rt }
+}
+
+// WithHTTP2 enables HTTP/2 for HTTPS targets. Protocol is negotiated via ALPN, so targets that do not support HTTP/2
+// are still reached via HTTP/1.1. gRPC calls negotiate HTTP/2 even without it, as gRPC requires HTTP/2.
+func WithHTTP2() Option {
+	return func(o *options) { o.http2 = true }
+}
+
+// WithH2C makes Transport use cleartext HTTP/2 with prior knowledge (h2c) for all HTTP targets. Without it, h2c is used only
+// for targets with ProtocolLabel set to "h2c".
+func WithH2C() Option {
+	return func(o *options) { o.h2c = true }
+}
+
+// WithGRPCRetryableCodes sets gRPC status codes (e.g "14" for Unavailable) that make gRPC call retried on another target,
+// if returned before any response message. Default: 14 (Unavailable).
+func WithGRPCRetryableCodes(codes ...string) Option {
+	return func(o *options) { o.grpcRetryableCodes = codes }
+}
+
+// WithGRPCReplayLimit sets how many bytes of gRPC request stream are buffered, so the call can be retried. Calls that
+// sent more are not retried. Default: 64KiB.
+func WithGRPCReplayLimit(n int) Option {
+	return func(o *options) { o.grpcReplayLimit = n }
+}
+
+// WithDialerOptions sets options of instrumented dialer used to connect to targets, e.g conntrack.WithDialerConnRegistry.
+// Ignored if custom parent is set with WithParent.
+func WithDialerOptions(opts ...conntrack.DialerOption) Option {
+	return func(o *options) { o.dialerOpts = append(o.dialerOpts, opts...) }
+}
+
+// WithDialContext sets function targets are dialed with instead of net.Dialer, e.g DialContext of memnet.Net for
+// hermetic tests. Keep-alive is not used in this case, dial timeout is applied via context. Ignored if custom parent is
+// set with WithParent.
+func WithDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
+	return func(o *options) { o.dialContext = dial }
+}
+
+// WithResolver sets caching resolver used to resolve host names of targets when dialing, instead of looking them up
+// on every new connection. Ignored if custom parent is set with WithParent.
+func WithResolver(r *dnscache.Resolver) Option {
+	return func(o *options) { o.resolver = r }
+}
+
+// WithDrainTimeout sets how long in-flight requests can take, when target drain is triggered by discovery or
+// target disappearing from discovery. Default: 30s.
+func WithDrainTimeout(d time.Duration) Option {
+	return func(o *options) { o.drainTimeout = d }
+}
+
+// WithWarmConnsPerTarget makes Transport keep n pre-dialed connections to each discovered target that is not draining,
+// so targets that appear in discovery do not pay connection setup latency on their first requests. Connections to HTTPS
+// targets are pre-dialed with TLS handshake, but are not used for upgrade requests. Warm connections waiting longer
+// than idle connection timeout are replaced. Ignored if custom parent is set with WithParent.
+func WithWarmConnsPerTarget(n int) Option {
+	return func(o *options) { o.warmConnsPerTarget = n }
+}
+
+// WithMaxConnAge sets age after which connections to targets are closed, once no request uses them. This makes
+// long-lived keep-alive connections rebalance, e.g to targets added when scaling out. Zero means no limit. Ignored if
+// custom parent is set with WithParent.
+func WithMaxConnAge(d time.Duration) Option {
+	return func(o *options) { o.maxConnAge = d }
+}
@@ -3,6 +3,9 @@ package lbtransport
 import (
 	"context"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -21,19 +24,66 @@ type TargetPicker interface {
 // Target represents the canonical address of a backend.
 type Target struct {
 	DialAddr url.URL
+	// Labels are optional metadata of the target (e.g version, zone or canary) populated by discovery.
+	Labels Labels
+}
+
+// Key returns comparable identity of the target. Useful as a map key.
+// Targets are identified by DialAddr only, the same way discovery deduplicates them, so state kept for a target (e.g
+// blacklisting or draining) survives changes of its labels.
+func (t *Target) Key() string {
+	return t.DialAddr.String()
+}
+
+// Labels is a set of target metadata.
+type Labels map[string]string
+
+// String returns canonical representation of labels, sorted by name e.g `{version="v1",zone="eu"}`.
+func (l Labels) String() string {
+	names := make([]string, 0, len(l))
+	for n := range l {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	b := strings.Builder{}
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n)
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(l[n]))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Matches returns true if all given matchers are present in labels with exactly the same values.
+func (l Labels) Matches(matchers Labels) bool {
+	for n, v := range matchers {
+		if lv, ok := l[n]; !ok || lv != v {
+			return false
+		}
+	}
+	return true
 }
 
 // RoundRobinPicker picks target using round robin behaviour.
 // It does NOT dial to the chosen target to check if it is accessible, instead it exposes ExcludeTarget method that allows to report
 // connection troubles. That handles the situation when DNS resolution contains invalid targets. In that case, it
 // blacklists it for defined period of time called "blacklist backoff".
+// Targets can be also excluded manually, until explicitly unexcluded.
 type RoundRobinPicker struct {
 	blacklistBackoffDuration time.Duration
 	blacklistMu              sync.RWMutex
-	blacklistedTargets       map[Target]time.Time
+	blacklistedTargets       map[string]time.Time
+	manuallyExcludedTargets  map[string]struct{}
 
-	backlistedTargetsNum prometheus.Gauge
-	roundRobinCounter    uint64
+	backlistedTargetsNum       prometheus.Gauge
+	manuallyExcludedTargetsNum prometheus.Gauge
+	roundRobinCounter          uint64
 
 	// For testing purposes.
 	timeNow func() time.Time
@@ -42,17 +92,23 @@ type RoundRobinPicker struct {
 func NewRoundRobinPicker(ctx context.Context, reg prometheus.Registerer, backoffDuration time.Duration) *RoundRobinPicker {
 	rr := &RoundRobinPicker{
 		blacklistBackoffDuration: backoffDuration,
-		blacklistedTargets:       make(map[Target]time.Time),
+		blacklistedTargets:       make(map[string]time.Time),
+		manuallyExcludedTargets:  make(map[string]struct{}),
 		timeNow:                  time.Now,
 		backlistedTargetsNum: prometheus.NewGauge(prometheus.GaugeOpts{
 			Subsystem: "lbtransport",
 			Name:      "blacklisted_targets",
 			Help:      "Number of targets that are blacklisted.",
 		}),
+		manuallyExcludedTargetsNum: prometheus.NewGauge(prometheus.GaugeOpts{
+			Subsystem: "lbtransport",
+			Name:      "manually_excluded_targets",
+			Help:      "Number of targets that are manually excluded.",
+		}),
 	}
 
 	if reg != nil {
-		reg.MustRegister(rr.backlistedTargetsNum)
+		reg.MustRegister(rr.backlistedTargetsNum, rr.manuallyExcludedTargetsNum)
 	}
 
 	go func() {
@@ -83,9 +139,13 @@ func (rr *RoundRobinPicker) cleanUpBlacklist() {
 
 func (rr *RoundRobinPicker) isTargetBlacklisted(target *Target) bool {
 	rr.blacklistMu.RLock()
-	failTime, ok := rr.blacklistedTargets[*target]
-	rr.blacklistMu.RUnlock()
+	defer rr.blacklistMu.RUnlock()
 
+	if _, ok := rr.manuallyExcludedTargets[target.Key()]; ok {
+		return true
+	}
+
+	failTime, ok := rr.blacklistedTargets[target.Key()]
 	if !ok {
 		return false
 	}
@@ -116,7 +176,102 @@ func (rr *RoundRobinPicker) ExcludeTarget(target *Target) {
 	rr.blacklistMu.Lock()
 	defer rr.blacklistMu.Unlock()
 
-	rr.blacklistedTargets[*target] = rr.timeNow()
+	rr.blacklistedTargets[target.Key()] = rr.timeNow()
 
 	rr.backlistedTargetsNum.Set(float64(len(rr.blacklistedTargets)))
 }
+
+// ManuallyExcludeTarget excludes the given target until UnexcludeTarget is called for it.
+func (rr *RoundRobinPicker) ManuallyExcludeTarget(target *Target) {
+	rr.blacklistMu.Lock()
+	defer rr.blacklistMu.Unlock()
+
+	rr.manuallyExcludedTargets[target.Key()] = struct{}{}
+
+	rr.manuallyExcludedTargetsNum.Set(float64(len(rr.manuallyExcludedTargets)))
+}
+
+// UnexcludeTarget removes both manual exclusion and blacklisting of the given target.
+func (rr *RoundRobinPicker) UnexcludeTarget(target *Target) {
+	rr.blacklistMu.Lock()
+	defer rr.blacklistMu.Unlock()
+
+	delete(rr.manuallyExcludedTargets, target.Key())
+	delete(rr.blacklistedTargets, target.Key())
+
+	rr.manuallyExcludedTargetsNum.Set(float64(len(rr.manuallyExcludedTargets)))
+	rr.backlistedTargetsNum.Set(float64(len(rr.blacklistedTargets)))
+}
+
+// BlacklistBackoff returns currently used blacklist backoff duration.
+func (rr *RoundRobinPicker) BlacklistBackoff() time.Duration {
+	rr.blacklistMu.RLock()
+	defer rr.blacklistMu.RUnlock()
+
+	return rr.blacklistBackoffDuration
+}
+
+// SetBlacklistBackoff changes blacklist backoff duration. It also applies to already blacklisted targets.
+func (rr *RoundRobinPicker) SetBlacklistBackoff(d time.Duration) {
+	rr.blacklistMu.Lock()
+	defer rr.blacklistMu.Unlock()
+
+	rr.blacklistBackoffDuration = d
+}
+
+// TargetState describes the picker state of a target.
+type TargetState struct {
+	// BlacklistedUntil is zero if target is not blacklisted.
+	BlacklistedUntil time.Time
+	ManuallyExcluded bool
+}
+
+// TargetState returns the current picker state for the given target.
+func (rr *RoundRobinPicker) TargetState(target *Target) TargetState {
+	rr.blacklistMu.RLock()
+	defer rr.blacklistMu.RUnlock()
+
+	var s TargetState
+	if failTime, ok := rr.blacklistedTargets[target.Key()]; ok {
+		if until := failTime.Add(rr.blacklistBackoffDuration); until.After(rr.timeNow()) {
+			s.BlacklistedUntil = until
+		}
+	}
+	_, s.ManuallyExcluded = rr.manuallyExcludedTargets[target.Key()]
+	return s
+}
+
+// LabelMatchingPicker picks only from targets which labels match all given matchers. Picking itself is delegated
+// to the wrapped picker. Useful for routing rules e.g to route only to `canary="true"` targets.
+type LabelMatchingPicker struct {
+	matchers Labels
+	next     TargetPicker
+}
+
+func NewLabelMatchingPicker(matchers Labels, next TargetPicker) *LabelMatchingPicker {
+	return &LabelMatchingPicker{matchers: matchers, next: next}
+}
+
+func (p *LabelMatchingPicker) Pick(targets []*Target) *Target {
+	matching := make([]*Target, 0, len(targets))
+	for _, t := range targets {
+		if t.Labels.Matches(p.matchers) {
+			matching = append(matching, t)
+		}
+	}
+	if len(matching) == 0 {
+		return nil
+	}
+	return p.next.Pick(matching)
+}
+
+func (p *LabelMatchingPicker) ExcludeTarget(target *Target) {
+	p.next.ExcludeTarget(target)
+}
+
+// UnexcludeTarget removes exclusions of the given target, if the wrapped picker supports that.
+func (p *LabelMatchingPicker) UnexcludeTarget(target *Target) {
+	if u, ok := p.next.(targetUnexcluder); ok {
+		u.UnexcludeTarget(target)
+	}
+}
@@ -69,3 +69,87 @@ func TestRoundRobinPicker(t *testing.T) {
 		}
 	}
 }
+
+func TestLabels(t *testing.T) {
+	testutil.Equals(t, "{}", Labels(nil).String())
+	testutil.Equals(t, `{canary="true",version="v1",zone="eu"}`, Labels{"zone": "eu", "version": "v1", "canary": "true"}.String())
+
+	testutil.Assert(t, Labels{"zone": "eu", "version": "v1"}.Matches(nil), "empty matchers should match")
+	testutil.Assert(t, Labels{"zone": "eu", "version": "v1"}.Matches(Labels{"zone": "eu"}), "should match")
+	testutil.Assert(t, !Labels{"zone": "eu", "version": "v1"}.Matches(Labels{"zone": "us"}), "should not match")
+	testutil.Assert(t, !Labels(nil).Matches(Labels{"zone": ""}), "should not match missing label")
+
+	a := &Target{DialAddr: url.URL{Host: "a"}, Labels: Labels{"zone": "eu"}}
+	testutil.Equals(t, (&Target{DialAddr: url.URL{Host: "a"}, Labels: Labels{"zone": "eu"}}).Key(), a.Key())
+	testutil.Equals(t, (&Target{DialAddr: url.URL{Host: "a"}, Labels: Labels{"zone": "us"}}).Key(), a.Key())
+}
+
+func TestLabelMatchingPicker(t *testing.T) {
+	defer leaktest.Check(t)
+
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	rr := NewRoundRobinPicker(cancelledCtx, nil, 2*time.Second)
+	p := NewLabelMatchingPicker(Labels{"canary": "true"}, rr)
+
+	targets := []*Target{
+		{DialAddr: url.URL{Host: "a"}},
+		{DialAddr: url.URL{Host: "b"}, Labels: Labels{"canary": "true"}},
+		{DialAddr: url.URL{Host: "c"}, Labels: Labels{"canary": "false"}},
+		{DialAddr: url.URL{Host: "d"}, Labels: Labels{"canary": "true", "zone": "eu"}},
+	}
+	testutil.Equals(t, targets[3], p.Pick(targets))
+	testutil.Equals(t, targets[1], p.Pick(targets))
+
+	p.ExcludeTarget(targets[1])
+	testutil.Equals(t, targets[3], p.Pick(targets))
+	testutil.Equals(t, targets[3], p.Pick(targets))
+
+	p.ExcludeTarget(targets[3])
+	testutil.Assert(t, p.Pick(targets) == nil, "no target should be available")
+	testutil.Assert(t, p.Pick(targets[:1]) == nil, "no target should match")
+}
+
+func TestRoundRobinPicker_ManualExclusion(t *testing.T) {
+	defer leaktest.Check(t)
+
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	currTime := time.Now()
+	rr := NewRoundRobinPicker(cancelledCtx, nil, 2*time.Second)
+	rr.timeNow = func() time.Time {
+		return currTime
+	}
+
+	targets := []*Target{
+		{DialAddr: url.URL{Host: "a"}},
+		{DialAddr: url.URL{Host: "b"}},
+	}
+
+	rr.ManuallyExcludeTarget(targets[0])
+	testutil.Equals(t, TargetState{ManuallyExcluded: true}, rr.TargetState(targets[0]))
+	testutil.Equals(t, float64(1), promtestutil.ToFloat64(rr.manuallyExcludedTargetsNum))
+
+	// Manual exclusion does not expire.
+	currTime = currTime.Add(1 * time.Hour)
+	testutil.Equals(t, targets[1], rr.Pick(targets))
+	testutil.Equals(t, targets[1], rr.Pick(targets))
+
+	rr.ExcludeTarget(targets[1])
+	testutil.Equals(t, TargetState{BlacklistedUntil: currTime.Add(2 * time.Second)}, rr.TargetState(targets[1]))
+	testutil.Assert(t, rr.Pick(targets) == nil, "no target should be available")
+
+	rr.SetBlacklistBackoff(0)
+	testutil.Equals(t, time.Duration(0), rr.BlacklistBackoff())
+	testutil.Equals(t, TargetState{}, rr.TargetState(targets[1]))
+	testutil.Equals(t, targets[1], rr.Pick(targets))
+
+	rr.SetBlacklistBackoff(1 * time.Minute)
+	rr.ExcludeTarget(targets[0])
+	rr.UnexcludeTarget(targets[0])
+	testutil.Equals(t, TargetState{}, rr.TargetState(targets[0]))
+	testutil.Equals(t, float64(0), promtestutil.ToFloat64(rr.manuallyExcludedTargetsNum))
+	testutil.Equals(t, float64(1), promtestutil.ToFloat64(rr.backlistedTargetsNum))
+}
@@ -0,0 +1,307 @@
+package lbtransport
+
+import (
+	"context"
+	"crypto/tls"
+	stderrors "errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// warmUpInterval is how often warm connections are refilled and targets that appeared in discovery are warmed up.
+const warmUpInterval = 5 * time.Second
+
+// warmPool keeps pre-dialed connections per dial address, so targets do not pay connection setup latency on their
+// first requests. Parent transport takes warm connections instead of dialing, and they are refilled in the background.
+// Connections to HTTPS targets are pre-dialed together with TLS handshake. Nil warmPool keeps no connections.
+type warmPool struct {
+	size int
+	// maxIdle is how long warm connection can wait to be used before it is replaced. Zero means no limit.
+	maxIdle time.Duration
+	dial    dialContextFunc
+	dialTLS dialContextFunc
+	metrics *Metrics
+
+	mu sync.Mutex
+	// addrs are addresses to keep warm connections to, by their warm key.
+	addrs   map[string]warmAddr
+	conns   map[string][]warmConn
+	dialing map[string]int
+}
+
+// warmAddr is an address to keep warm connections to.
+type warmAddr struct {
+	addr string
+	// tlsTarget is the target connections are dialed for with TLS handshake, nil for plain connections.
+	tlsTarget *Target
+}
+
+type warmConn struct {
+	net.Conn
+	dialed time.Time
+}
+
+func newWarmPool(size int, maxIdle time.Duration, dial, dialTLS dialContextFunc, metrics *Metrics) *warmPool {
+	return &warmPool{
+		size:    size,
+		maxIdle: maxIdle,
+		dial:    dial,
+		dialTLS: dialTLS,
+		metrics: metrics,
+		addrs:   map[string]warmAddr{},
+		conns:   map[string][]warmConn{},
+		dialing: map[string]int{},
+	}
+}
+
+// tlsWarmKey returns warm key of TLS connections to the given address. Targets with different TLS configuration do not
+// share connections, just like with tlsParents.
+func tlsWarmKey(addr string, target *Target) string {
+	return "tls:" + addr + targetTLSLabels(target).String()
+}
+
+// warmKey returns warm key of connections to the given target.
+func warmKey(target *Target) string {
+	addr := dialAddress(target.DialAddr)
+	if target.DialAddr.Scheme == "https" {
+		return tlsWarmKey(addr, target)
+	}
+	return addr
+}
+
+// dialContext returns warm connection to the given address if there is any, dials new connection otherwise.
+func (p *warmPool) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network == "tcp" {
+		conn, taken := p.take(addr)
+		if taken {
+			go p.fill(addr)
+		}
+		if conn != nil {
+			p.metrics.warmConnsUsedTotal.Inc()
+			return conn, nil
+		}
+	}
+	return p.dial(ctx, network, addr)
+}
+
+// dialTLSContext returns warm TLS connection to the given address if there is any, dials new connection with TLS
+// handshake otherwise. Upgrade requests always dial new connections, as they require HTTP/1.1, while warm connections
+// may have negotiated HTTP/2. So do requests that require HTTP/2 when it is not enabled, as warm connections did not
+// negotiate it.
+func (p *warmPool) dialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network == "tcp" && !upgradeFromContext(ctx) && !http2FromContext(ctx) {
+		target, _ := TargetFromContext(ctx)
+		key := tlsWarmKey(addr, target)
+		conn, taken := p.take(key)
+		if taken {
+			go p.fill(key)
+		}
+		if conn != nil {
+			p.metrics.warmConnsUsedTotal.Inc()
+			return conn, nil
+		}
+	}
+	return p.dialTLS(ctx, network, addr)
+}
+
+// take returns the oldest usable warm connection with the given warm key, or nil if there is none. It returns true if
+// any connection was taken from the pool, including unusable ones that were closed, so the pool has to be refilled.
+func (p *warmPool) take(key string) (net.Conn, bool) {
+	taken := false
+	for {
+		p.mu.Lock()
+		conns := p.conns[key]
+		if len(conns) == 0 {
+			p.mu.Unlock()
+			return nil, taken
+		}
+		c := conns[0]
+		p.conns[key] = conns[1:]
+		p.updateMetrics()
+		p.mu.Unlock()
+
+		taken = true
+		if p.usable(c, time.Now()) {
+			return c.Conn, true
+		}
+		_ = c.Close()
+	}
+}
+
+func (p *warmPool) usable(c warmConn, now time.Time) bool {
+	if p.maxIdle > 0 && now.Sub(c.dialed) >= p.maxIdle {
+		return false
+	}
+	if negotiatedHTTP2(c.Conn) {
+		// HTTP/2 target sends its SETTINGS frame right after the connection opens, so reading idle connection does not
+		// time out and would consume the frame. Such connections are only replaced once waiting longer than maxIdle.
+		return true
+	}
+	return isAlive(c.Conn)
+}
+
+// negotiatedHTTP2 returns true if HTTP/2 was negotiated via ALPN for the given connection.
+func negotiatedHTTP2(conn net.Conn) bool {
+	tlsConn, ok := conn.(*tls.Conn)
+	return ok && tlsConn.ConnectionState().NegotiatedProtocol == "h2"
+}
+
+// isAlive checks that idle connection was not closed, e.g by the target or due to max age. It blocks for up to 1ms.
+// It must not be used for connections the target sends data to on its own, e.g HTTP/2 ones.
+func isAlive(conn net.Conn) bool {
+	// Read with deadline in the past fails without looking at the socket, so the deadline has to be in the future.
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	var b [1]byte
+	// Nothing is expected to be read from idle connection, so read has to time out.
+	_, err := conn.Read(b[:])
+	var netErr net.Error
+	if !stderrors.As(err, &netErr) || !netErr.Timeout() {
+		return false
+	}
+	return conn.SetReadDeadline(time.Time{}) == nil
+}
+
+// update sets addresses to keep warm connections to, by their warm key. Connections to other addresses are closed and
+// missing or expired connections are dialed in the background.
+func (p *warmPool) update(addrs map[string]warmAddr) {
+	if p == nil {
+		return
+	}
+
+	keys := make([]string, 0, len(addrs))
+	for key := range addrs {
+		keys = append(keys, key)
+	}
+
+	var toClose []warmConn
+	now := time.Now()
+	p.mu.Lock()
+	p.addrs = addrs
+	for key, conns := range p.conns {
+		if _, ok := addrs[key]; !ok {
+			toClose = append(toClose, conns...)
+			delete(p.conns, key)
+			continue
+		}
+		kept := conns[:0]
+		for _, c := range conns {
+			if p.maxIdle > 0 && now.Sub(c.dialed) >= p.maxIdle {
+				toClose = append(toClose, c)
+				continue
+			}
+			kept = append(kept, c)
+		}
+		p.conns[key] = kept
+	}
+	p.updateMetrics()
+	p.mu.Unlock()
+
+	for _, c := range toClose {
+		_ = c.Close()
+	}
+	for _, key := range keys {
+		go p.fill(key)
+	}
+}
+
+// remove stops keeping warm connections with the given warm key and closes them.
+func (p *warmPool) remove(key string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	conns := p.conns[key]
+	delete(p.conns, key)
+	delete(p.addrs, key)
+	p.updateMetrics()
+	p.mu.Unlock()
+
+	for _, c := range conns {
+		_ = c.Close()
+	}
+}
+
+// fill dials missing warm connections with the given warm key, if it is kept warm. It gives up on the first dial error;
+// filling is retried periodically.
+func (p *warmPool) fill(key string) {
+	p.mu.Lock()
+	a, ok := p.addrs[key]
+	missing := p.size - len(p.conns[key]) - p.dialing[key]
+	if !ok || missing <= 0 {
+		p.mu.Unlock()
+		return
+	}
+	p.dialing[key] += missing
+	p.mu.Unlock()
+
+	dial, ctx := p.dial, context.Background()
+	if a.tlsTarget != nil {
+		// TLS configuration is chosen by the target, just like for requests.
+		dial, ctx = p.dialTLS, context.WithValue(ctx, targetCtxKey{}, a.tlsTarget)
+	}
+	for ; missing > 0; missing-- {
+		conn, err := dial(ctx, "tcp", a.addr)
+
+		p.mu.Lock()
+		if err != nil {
+			p.dialing[key] -= missing
+		} else {
+			p.dialing[key]--
+		}
+		if p.dialing[key] == 0 {
+			delete(p.dialing, key)
+		}
+		if _, ok := p.addrs[key]; ok && err == nil {
+			p.conns[key] = append(p.conns[key], warmConn{Conn: conn, dialed: time.Now()})
+			conn = nil
+		}
+		p.updateMetrics()
+		p.mu.Unlock()
+
+		if err != nil {
+			return
+		}
+		if conn != nil {
+			// Address is not kept warm anymore.
+			_ = conn.Close()
+		}
+	}
+}
+
+// updateMetrics has to be called with mu locked.
+func (p *warmPool) updateMetrics() {
+	n := 0
+	for _, conns := range p.conns {
+		n += len(conns)
+	}
+	p.metrics.warmConns.Set(float64(n))
+}
+
+func (t *Transport) runWarmUp(ctx context.Context, interval time.Duration) {
+	for {
+		t.warmUp()
+		select {
+		case <-ctx.Done():
+			t.warm.update(nil)
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// warmUp keeps warm connections to all discovered targets that are not draining.
+func (t *Transport) warmUp() {
+	addrs := map[string]warmAddr{}
+	for _, target := range t.nonDraining(t.discovery.Targets()) {
+		a := warmAddr{addr: dialAddress(target.DialAddr)}
+		if target.DialAddr.Scheme == "https" {
+			a.tlsTarget = target
+		}
+		addrs[warmKey(target)] = a
+	}
+	t.warm.update(addrs)
+}
@@ -0,0 +1,264 @@
+package lbtransport
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+// newConnCountingBackend returns backend counting new connections, that responds after the given delay.
+func newConnCountingBackend(delay time.Duration) (*httptest.Server, *int64) {
+	srv, conns := newUnstartedConnCountingBackend(delay)
+	srv.Start()
+	return srv, conns
+}
+
+// newConnCountingTLSBackend returns HTTPS backend counting new connections.
+func newConnCountingTLSBackend() (*httptest.Server, *int64) {
+	srv, conns := newUnstartedConnCountingBackend(0)
+	srv.StartTLS()
+	return srv, conns
+}
+
+func newUnstartedConnCountingBackend(delay time.Duration) (*httptest.Server, *int64) {
+	var conns int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		_, _ = w.Write([]byte("ok"))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	return srv, &conns
+}
+
+func roundTripOK(t *testing.T, lb http.RoundTripper) {
+	t.Helper()
+
+	resp, err := lb.RoundTrip(httptest.NewRequest("GET", "http://whatever", nil))
+	testutil.Ok(t, err)
+	_, err = ioutil.ReadAll(resp.Body)
+	testutil.Ok(t, err)
+	testutil.Ok(t, resp.Body.Close())
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met on time")
+		}
+	}
+}
+
+func TestTransport_MaxConnAge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv, conns := newConnCountingBackend(300 * time.Millisecond)
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	metrics := NewMetrics(nil)
+	lb := NewLoadBalancingTransportWithContext(
+		ctx,
+		NewStaticDiscoveryFromTargets([]*Target{{DialAddr: *u}}, nil),
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		metrics,
+		WithMaxConnAge(100*time.Millisecond),
+	)
+
+	// Connection reaches max age during the request, so it is closed once the request is done, not before.
+	roundTripOK(t, lb)
+	waitFor(t, func() bool { return promtestutil.ToFloat64(metrics.maxAgeClosedTotal) == 1 })
+
+	roundTripOK(t, lb)
+	testutil.Equals(t, int64(2), atomic.LoadInt64(conns))
+
+	// Idle connection is closed as soon as it reaches max age.
+	waitFor(t, func() bool { return promtestutil.ToFloat64(metrics.maxAgeClosedTotal) == 2 })
+	testutil.Equals(t, 0, len(lb.conns.conns))
+}
+
+func TestTransport_WarmConns(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv, conns := newConnCountingBackend(0)
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+	lb := NewLoadBalancingTransportWithContext(
+		ctx,
+		NewStaticDiscoveryFromTargets([]*Target{{DialAddr: *u}}, nil),
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		metrics,
+		WithWarmConnsPerTarget(2),
+	)
+
+	// Connections are dialed before any request, and tracked as established from then on.
+	waitFor(t, func() bool { return promtestutil.ToFloat64(metrics.warmConns) == 2 })
+	testutil.Equals(t, int64(2), atomic.LoadInt64(conns))
+	testutil.Equals(t, 2.0, gatheredCounter(t, reg, "conntrack_dialer_conn_established_total", "", ""))
+
+	// Request takes warm connection, which is replaced.
+	roundTripOK(t, lb)
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.warmConnsUsedTotal))
+	waitFor(t, func() bool { return promtestutil.ToFloat64(metrics.warmConns) == 2 })
+	testutil.Equals(t, int64(3), atomic.LoadInt64(conns))
+
+	// Warm connections closed by the target are not used.
+	srv.CloseClientConnections()
+	// Let the parent transport notice its idle connection was closed too.
+	time.Sleep(100 * time.Millisecond)
+	roundTripOK(t, lb)
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.warmConnsUsedTotal))
+
+	// Warm connections of draining target are closed.
+	<-lb.DrainTarget(&Target{DialAddr: *u}, time.Minute)
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.warmConns))
+}
+
+func TestTransport_WarmConnsHTTPS(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv, conns := newConnCountingTLSBackend()
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+	lb := NewLoadBalancingTransportWithContext(
+		ctx,
+		NewStaticDiscoveryFromTargets([]*Target{{DialAddr: *u}}, nil),
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		metrics,
+		WithTLSConfig(srv.Client().Transport.(*http.Transport).TLSClientConfig),
+		WithWarmConnsPerTarget(2),
+	)
+
+	// Connections are dialed with TLS handshake before any request.
+	waitFor(t, func() bool { return promtestutil.ToFloat64(metrics.warmConns) == 2 })
+	testutil.Equals(t, int64(2), atomic.LoadInt64(conns))
+	testutil.Equals(t, 2.0, gatheredCounter(t, reg, "conntrack_dialer_conn_established_total", "", ""))
+
+	// Request takes warm connection, which is replaced.
+	roundTripOK(t, lb)
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.warmConnsUsedTotal))
+	waitFor(t, func() bool { return promtestutil.ToFloat64(metrics.warmConns) == 2 })
+	testutil.Equals(t, int64(3), atomic.LoadInt64(conns))
+
+	// Warm connections of draining target are closed.
+	<-lb.DrainTarget(&Target{DialAddr: *u}, time.Minute)
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.warmConns))
+}
+
+func TestTransport_WarmConnsHTTP2(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv, conns := newUnstartedConnCountingBackend(0)
+	// HTTP/2 server sends its SETTINGS frame right after the connection opens, so warm connections have data to read.
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+	lb := NewLoadBalancingTransportWithContext(
+		ctx,
+		NewStaticDiscoveryFromTargets([]*Target{{DialAddr: *u}}, nil),
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		metrics,
+		WithTLSConfig(srv.Client().Transport.(*http.Transport).TLSClientConfig),
+		WithHTTP2(),
+		WithWarmConnsPerTarget(2),
+	)
+
+	waitFor(t, func() bool { return promtestutil.ToFloat64(metrics.warmConns) == 2 })
+
+	// Request takes warm HTTP/2 connection, which is replaced.
+	resp, err := lb.RoundTrip(httptest.NewRequest("GET", "http://whatever", nil))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, resp.ProtoMajor)
+	_, err = ioutil.ReadAll(resp.Body)
+	testutil.Ok(t, err)
+	testutil.Ok(t, resp.Body.Close())
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.warmConnsUsedTotal))
+	waitFor(t, func() bool { return promtestutil.ToFloat64(metrics.warmConns) == 2 })
+	testutil.Equals(t, int64(3), atomic.LoadInt64(conns))
+}
+
+func TestTransport_WarmConnsDialFailures(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	addr := l.Addr().String()
+	testutil.Ok(t, l.Close())
+
+	reg := prometheus.NewRegistry()
+	_ = NewLoadBalancingTransportWithContext(
+		ctx,
+		NewStaticDiscoveryFromTargets([]*Target{{DialAddr: url.URL{Scheme: "http", Host: addr}}}, nil),
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		NewMetrics(reg),
+		WithWarmConnsPerTarget(2),
+	)
+
+	// Failed pre-dials are counted, even though no request was sent.
+	waitFor(t, func() bool {
+		return gatheredCounter(t, reg, "conntrack_dialer_conn_failed_total", "reason", "refused") == 1
+	})
+}
+
+func TestTransport_MaxConnAgeNonReplayableRequests(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv, _ := newConnCountingBackend(0)
+	defer srv.Close()
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	lb := NewLoadBalancingTransportWithContext(
+		ctx,
+		NewStaticDiscoveryFromTargets([]*Target{{DialAddr: *u}}, nil),
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		NewMetrics(nil),
+		WithMaxConnAge(time.Millisecond),
+	)
+
+	// Connections reach max age all the time, but the ones handed out to requests are never closed under them, so
+	// requests that cannot be retried do not fail.
+	for i := 0; i < 300; i++ {
+		resp, err := lb.RoundTrip(httptest.NewRequest("POST", "http://whatever", strings.NewReader("body")))
+		testutil.Ok(t, err)
+		_, err = ioutil.ReadAll(resp.Body)
+		testutil.Ok(t, err)
+		testutil.Ok(t, resp.Body.Close())
+	}
+}
@@ -0,0 +1,105 @@
+package lbtransport
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// seenTargets tracks targets that requests were sent to, by DialAddr. Zero value is ready to use.
+type seenTargets struct {
+	mu      sync.Mutex
+	targets map[string]*Target
+}
+
+func (s *seenTargets) add(target *Target) {
+	addr := target.DialAddr.String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.targets == nil {
+		s.targets = map[string]*Target{}
+	}
+	s.targets[addr] = target
+}
+
+// removeStale removes and returns targets which addresses are not in the given current targets.
+func (s *seenTargets) removeStale(current []*Target) []*Target {
+	addrs := make(map[string]struct{}, len(current))
+	for _, t := range current {
+		addrs[t.DialAddr.String()] = struct{}{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stale []*Target
+	for addr, t := range s.targets {
+		if _, ok := addrs[addr]; ok {
+			continue
+		}
+		stale = append(stale, t)
+		delete(s.targets, addr)
+	}
+	return stale
+}
+
+// targetUnexcluder is implemented by pickers that keep exclusions of targets until told otherwise, e.g RoundRobinPicker.
+type targetUnexcluder interface {
+	UnexcludeTarget(*Target)
+}
+
+func (t *Transport) runStaleTargetsCleanup(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+		t.cleanUpStaleTargets()
+	}
+}
+
+// cleanUpStaleTargets drains targets that disappeared from discovery. Once drained, their connections are closed, their
+// picker exclusions are removed and, once no request to them is in flight (or drain timeout passes again), all their
+// target-labeled metric series are deleted, so neither cardinality nor picker state grows when targets change.
+// It returns channel closed once all stale targets are cleaned up.
+func (t *Transport) cleanUpStaleTargets() <-chan struct{} {
+	var wg sync.WaitGroup
+	for _, target := range t.seen.removeStale(t.discovery.Targets()) {
+		wg.Add(1)
+		go func(target *Target) {
+			defer wg.Done()
+
+			<-t.DrainTarget(target, t.drainTimeout)
+			// Requests that outlived drain timeout would bring deleted series back once finished (e.g in-flight gauges
+			// with negative values), so wait for them. Their connections are closed already, so they usually finish
+			// soon. Upgraded or streaming requests can last for hours though, so series are deleted anyway once drain
+			// timeout passes again.
+			idle, stop := t.inFlight.idle(target)
+			select {
+			case <-idle:
+			case <-time.After(t.drainTimeout):
+			}
+			stop()
+
+			// Target is gone, so there is no point in keeping it drained or excluded. If it appears again, it will be
+			// picked.
+			t.UndrainTarget(target)
+			if p, ok := t.picker.(targetUnexcluder); ok {
+				p.UnexcludeTarget(target)
+			}
+			t.metrics.httpMetrics.DeleteTarget(target.DialAddr.String())
+			t.metrics.dialerMetrics.DeleteTarget(dialAddress(target.DialAddr))
+			t.metrics.staleTargetsCleanedTotal.Inc()
+		}(target)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done
+}
@@ -0,0 +1,208 @@
+package lbtransport
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func countSeriesWithLabel(t *testing.T, g prometheus.Gatherer, name, value string) int {
+	mfs, err := g.Gather()
+	testutil.Ok(t, err)
+
+	cnt := 0
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == name && lp.GetValue() == value {
+					cnt++
+				}
+			}
+		}
+	}
+	return cnt
+}
+
+// metricNamesWithLabel returns names of metrics that have series with the given label.
+func metricNamesWithLabel(t *testing.T, g prometheus.Gatherer, name, value string) map[string]bool {
+	mfs, err := g.Gather()
+	testutil.Ok(t, err)
+
+	names := map[string]bool{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == name && lp.GetValue() == value {
+					names[mf.GetName()] = true
+				}
+			}
+		}
+	}
+	return names
+}
+
+// gatheredCounter returns value of the counter with the given name and label.
+func gatheredCounter(t *testing.T, g prometheus.Gatherer, metricName, name, value string) float64 {
+	mfs, err := g.Gather()
+	testutil.Ok(t, err)
+
+	for _, mf := range mfs {
+		if mf.GetName() != metricName {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if name == "" {
+				// Metric without labels.
+				return m.GetCounter().GetValue()
+			}
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == name && lp.GetValue() == value {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
+
+func TestTransport_CleanUpStaleTargets(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+	discovery := &mockedDiscovery{targets: []string{"a", "b"}}
+	picker := &mockedPicker{}
+	transport := &mockedTransport{t: t}
+
+	lb := &Transport{
+		discovery: discovery,
+		picker:    picker,
+		metrics:   metrics,
+		parent:    transport,
+	}
+
+	for _, host := range []string{"a", "b"} {
+		responses := []response{bodyResponse(host)}
+		transport.Reset(responses)
+		picker.Reset(responses)
+		resp, err := lb.RoundTrip(httptest.NewRequest("GET", "http://whatever", nil))
+		testutil.Ok(t, err)
+		testutil.Ok(t, resp.Body.Close())
+	}
+
+	c1, c2 := net.Pipe()
+	defer func() { _ = c2.Close() }()
+	_, err := lb.conns.wrapDialContext(func(context.Context, string, string) (net.Conn, error) { return c1, nil })(context.WithValue(context.Background(), targetCtxKey{}, &Target{DialAddr: url.URL{Host: "a"}}), "tcp", "a:80")
+	testutil.Ok(t, err)
+
+	// Requests series, among others.
+	names := metricNamesWithLabel(t, reg, "target", "//a")
+	for _, name := range []string{"http_client_requests_total", "http_client_requests_in_flight", "http_client_request_duration_seconds"} {
+		testutil.Assert(t, names[name], "expected %v series of target a", name)
+	}
+	series := countSeriesWithLabel(t, reg, "target", "//a")
+	testutil.Equals(t, series, countSeriesWithLabel(t, reg, "target", "//b"))
+
+	// Nothing is stale.
+	<-lb.cleanUpStaleTargets()
+	testutil.Equals(t, series, countSeriesWithLabel(t, reg, "target", "//a"))
+	testutil.Equals(t, float64(0), promtestutil.ToFloat64(metrics.staleTargetsCleanedTotal))
+
+	discovery.Reset([]string{"b"})
+	select {
+	case <-lb.cleanUpStaleTargets():
+	case <-time.After(5 * time.Second):
+		t.Fatal("cleanup timed out")
+	}
+	testutil.Equals(t, 0, countSeriesWithLabel(t, reg, "target", "//a"))
+	testutil.Equals(t, series, countSeriesWithLabel(t, reg, "target", "//b"))
+	testutil.Equals(t, 0, len(lb.conns.conns))
+	testutil.Equals(t, float64(1), promtestutil.ToFloat64(metrics.staleTargetsCleanedTotal))
+
+	// Target that appears again is not drained.
+	discovery.Reset([]string{"a", "b"})
+	testutil.Equals(t, 2, len(lb.nonDraining(discovery.Targets())))
+}
+
+func TestTransport_CleanUpStaleTargets_InFlight(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reg := prometheus.NewRegistry()
+	discovery := &mockedDiscovery{targets: []string{"a"}}
+	picker := NewRoundRobinPicker(ctx, nil, 1*time.Minute)
+	transport := &mockedTransport{t: t}
+
+	lb := &Transport{
+		discovery:    discovery,
+		picker:       picker,
+		metrics:      NewMetrics(reg),
+		parent:       transport,
+		drainTimeout: 200 * time.Millisecond,
+	}
+
+	transport.Reset([]response{bodyResponse("a")})
+	resp, err := lb.RoundTrip(httptest.NewRequest("GET", "http://whatever", nil))
+	testutil.Ok(t, err)
+	picker.ManuallyExcludeTarget(&Target{DialAddr: url.URL{Host: "a"}})
+	testutil.Assert(t, metricNamesWithLabel(t, reg, "target", "//a")["http_client_requests_in_flight"], "expected in-flight series of target a")
+	series := countSeriesWithLabel(t, reg, "target", "//a")
+
+	discovery.Reset([]string{"b"})
+	done := lb.cleanUpStaleTargets()
+
+	// Series of the target are kept while request outlives drain timeout, so they do not come back once it finishes.
+	select {
+	case <-done:
+		t.Fatal("cleanup should wait for in-flight request")
+	case <-time.After(300 * time.Millisecond):
+	}
+	testutil.Equals(t, series, countSeriesWithLabel(t, reg, "target", "//a"))
+
+	testutil.Ok(t, resp.Body.Close())
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cleanup timed out")
+	}
+	testutil.Equals(t, 0, countSeriesWithLabel(t, reg, "target", "//a"))
+	testutil.Equals(t, 0, len(lb.inFlight.idleWaiters))
+	testutil.Assert(t, !picker.TargetState(&Target{DialAddr: url.URL{Host: "a"}}).ManuallyExcluded, "exclusion of stale target should be removed")
+}
+
+func TestTransport_CleanUpStaleTargets_LongRunning(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reg := prometheus.NewRegistry()
+	discovery := &mockedDiscovery{targets: []string{"a"}}
+	transport := &mockedTransport{t: t}
+
+	lb := &Transport{
+		discovery:    discovery,
+		picker:       NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		metrics:      NewMetrics(reg),
+		parent:       transport,
+		drainTimeout: 10 * time.Millisecond,
+	}
+
+	transport.Reset([]response{bodyResponse("a")})
+	resp, err := lb.RoundTrip(httptest.NewRequest("GET", "http://whatever", nil))
+	testutil.Ok(t, err)
+	defer func() { _ = resp.Body.Close() }()
+
+	// Request that outlives drain timeout twice (e.g streaming one) does not block cleanup.
+	discovery.Reset([]string{"b"})
+	select {
+	case <-lb.cleanUpStaleTargets():
+	case <-time.After(5 * time.Second):
+		t.Fatal("cleanup timed out")
+	}
+	testutil.Equals(t, 0, countSeriesWithLabel(t, reg, "target", "//a"))
+	testutil.Equals(t, 0, len(lb.inFlight.idleWaiters))
+}
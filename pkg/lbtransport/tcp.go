@@ -0,0 +1,391 @@
+package lbtransport
+
+import (
+	"context"
+	stderrors "errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/observatorium/observable-demo/pkg/conntrack"
+	"github.com/observatorium/observable-demo/pkg/dnscache"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type TCPProxyMetrics struct {
+	proxiedTotal prometheus.Counter
+	failures     *prometheus.CounterVec
+	active       prometheus.Gauge
+	duration     prometheus.Histogram
+	bytes        *prometheus.CounterVec
+
+	dialerMetrics *conntrack.DialerMetrics
+}
+
+// NewTCPProxyMetrics provides TCPProxyMetrics. Dialer metrics are prefixed with `lbtransport_tcp_proxy_`, so they
+// do not collide with the ones of Transport.
+func NewTCPProxyMetrics(reg prometheus.Registerer) *TCPProxyMetrics {
+	dialerReg := reg
+	if reg != nil {
+		dialerReg = prometheus.WrapRegistererWithPrefix("lbtransport_tcp_proxy_", reg)
+	}
+
+	m := &TCPProxyMetrics{
+		proxiedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Subsystem: "lbtransport",
+			Name:      "tcp_proxied_connections_total",
+			Help:      "Total number of TCP connections successfully proxied to a target.",
+		}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "lbtransport",
+			Name:      "tcp_proxy_failed_connections_total",
+			Help:      "Total number of TCP connections that could not be proxied to any target.",
+		}, []string{"reason"}),
+		active: prometheus.NewGauge(prometheus.GaugeOpts{
+			Subsystem: "lbtransport",
+			Name:      "tcp_proxy_active_connections",
+			Help:      "Number of TCP connections currently proxied.",
+		}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Subsystem: "lbtransport",
+			Name:      "tcp_proxy_connection_duration_seconds",
+			Help:      "Duration of proxied TCP connections.",
+			Buckets:   []float64{0.01, 0.1, 1, 10, 60, 300, 900, 3600, 3 * 3600, 12 * 3600},
+		}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "lbtransport",
+			Name:      "tcp_proxy_bytes_total",
+			Help:      "Total number of bytes sent to (direction=sent) or received from (direction=received) targets.",
+		}, []string{"direction"}),
+		dialerMetrics: conntrack.NewDialerMetrics(dialerReg),
+	}
+
+	if reg != nil {
+		reg.MustRegister(m.proxiedTotal, m.failures, m.active, m.duration, m.bytes)
+	}
+
+	m.bytes.WithLabelValues(directionSent)
+	m.bytes.WithLabelValues(directionReceived)
+
+	m.failures.WithLabelValues(failedNoTargetAvailable)
+	m.failures.WithLabelValues(failedNoTargetResolved)
+	for _, reason := range conntrack.ErrorReasons {
+		m.failures.WithLabelValues(reason)
+	}
+	return m
+}
+
+// TCPProxy load balances raw TCP connections between discovered targets. Each accepted connection is proxied to
+// a single target picked by the picker. Target's URL scheme and path are ignored, only host and port are used.
+// Targets that discovery requests to drain (see DrainLabel) or that are drained by Transport given with
+// WithDrainingFrom do not receive new connections.
+type TCPProxy struct {
+	discovery  Discovery
+	picker     TargetPicker
+	metrics    *TCPProxyMetrics
+	isDraining func(*Target) bool
+
+	dialContext dialContextFunc
+	dialTimeout time.Duration
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+type tcpProxyOptions struct {
+	dialTimeout       time.Duration
+	keepAlive         time.Duration
+	dialContext       dialContextFunc
+	resolver          *dnscache.Resolver
+	dialerOpts        []conntrack.DialerOption
+	sendProxyProtocol int
+	isDraining        func(*Target) bool
+}
+
+// TCPProxyOption configures TCPProxy.
+type TCPProxyOption func(*tcpProxyOptions)
+
+// WithTCPDialTimeout sets maximum time spent on dialing all targets tried for the single connection. Default: 10s.
+func WithTCPDialTimeout(d time.Duration) TCPProxyOption {
+	return func(o *tcpProxyOptions) { o.dialTimeout = d }
+}
+
+// WithTCPKeepAlive sets TCP keep-alive period of connections to targets. Default: 30s.
+func WithTCPKeepAlive(d time.Duration) TCPProxyOption {
+	return func(o *tcpProxyOptions) { o.keepAlive = d }
+}
+
+// WithTCPDialContext sets function targets are dialed with instead of net.Dialer, e.g DialContext of memnet.Net for
+// hermetic tests. Keep-alive is not used in this case.
+func WithTCPDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) TCPProxyOption {
+	return func(o *tcpProxyOptions) { o.dialContext = dial }
+}
+
+// WithTCPResolver sets caching resolver used to resolve host names of targets when dialing.
+func WithTCPResolver(r *dnscache.Resolver) TCPProxyOption {
+	return func(o *tcpProxyOptions) { o.resolver = r }
+}
+
+// WithTCPDialerOptions sets options of instrumented dialer used to connect to targets, e.g
+// conntrack.WithDialerConnRegistry.
+func WithTCPDialerOptions(opts ...conntrack.DialerOption) TCPProxyOption {
+	return func(o *tcpProxyOptions) { o.dialerOpts = append(o.dialerOpts, opts...) }
+}
+
+// WithSendProxyProtocol makes TCPProxy send PROXY protocol header of the given version (conntrack.ProxyProtocolV1 or
+// conntrack.ProxyProtocolV2) with the proxied client address to targets.
+func WithSendProxyProtocol(version int) TCPProxyOption {
+	return func(o *tcpProxyOptions) { o.sendProxyProtocol = version }
+}
+
+// WithDrainingFrom makes TCPProxy skip targets that the given Transport drains (see Transport.IsDraining), so drains
+// started via Transport.DrainTarget apply to proxied TCP connections too. Without it, only targets with DrainLabel are
+// skipped.
+func WithDrainingFrom(t *Transport) TCPProxyOption {
+	return func(o *tcpProxyOptions) { o.isDraining = t.IsDraining }
+}
+
+// NewTCPProxy returns TCPProxy.
+func NewTCPProxy(discovery Discovery, picker TargetPicker, metrics *TCPProxyMetrics, opts ...TCPProxyOption) *TCPProxy {
+	o := tcpProxyOptions{
+		dialTimeout: 10 * time.Second,
+		keepAlive:   30 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	dialer := &net.Dialer{KeepAlive: o.keepAlive}
+	dialContext := dialer.DialContext
+	if o.dialContext != nil {
+		dialContext = o.dialContext
+	}
+	if o.resolver != nil {
+		dialContext = o.resolver.DialContextFunc(dialContext)
+	}
+	if o.sendProxyProtocol != 0 {
+		dialContext = conntrack.NewProxyProtocolDialContextFunc(dialContext, o.sendProxyProtocol)
+	}
+	isDraining := o.isDraining
+	if isDraining == nil {
+		isDraining = func(target *Target) bool { return target.Labels[DrainLabel] == "true" }
+	}
+	return &TCPProxy{
+		discovery:   discovery,
+		picker:      picker,
+		metrics:     metrics,
+		isDraining:  isDraining,
+		dialContext: conntrack.NewInstrumentedDialContextFunc(dialContext, metrics.dialerMetrics, o.dialerOpts...),
+		dialTimeout: o.dialTimeout,
+		conns:       map[net.Conn]struct{}{},
+	}
+}
+
+// Serve accepts connections from the given listener and proxies them until listener is closed.
+// Use conntrack.NewInstrumentedListener to track accepted connections. Just like http.Server.Serve, it retries
+// temporary accept errors (e.g running out of file descriptors) with exponential backoff.
+func (p *TCPProxy) Serve(l net.Listener) error {
+	var backoff time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !isTemporaryAcceptError(err) {
+				return err
+			}
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else {
+				backoff *= 2
+			}
+			if backoff > maxAcceptBackoff {
+				backoff = maxAcceptBackoff
+			}
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		go p.ServeConn(conn)
+	}
+}
+
+const maxAcceptBackoff = 1 * time.Second
+
+// isTemporaryAcceptError returns true if accepting connections may succeed later after the given error, e.g once
+// file descriptors are released.
+func isTemporaryAcceptError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED, syscall.ECONNRESET} {
+		if stderrors.Is(err, errno) {
+			return true
+		}
+	}
+	var ne net.Error
+	return stderrors.As(err, &ne) && ne.Timeout()
+}
+
+// ServeConn proxies the given connection to the picked target. The connection is closed once proxying is done.
+func (p *TCPProxy) ServeConn(conn net.Conn) {
+	if !p.track(conn) {
+		_ = conn.Close()
+		return
+	}
+	defer p.untrack(conn)
+	defer func() { _ = conn.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.dialTimeout)
+	// Client addresses are sent to target if PROXY protocol is enabled.
+	ctx = conntrack.ContextWithProxyAddrs(ctx, conn.RemoteAddr(), conn.LocalAddr())
+	target, err := p.dial(ctx)
+	cancel()
+	if err != nil {
+		return
+	}
+	if !p.track(target) {
+		_ = target.Close()
+		return
+	}
+	defer p.untrack(target)
+	defer func() { _ = target.Close() }()
+
+	p.metrics.proxiedTotal.Inc()
+	p.metrics.active.Inc()
+	start := time.Now()
+	defer func() {
+		p.metrics.active.Dec()
+		p.metrics.duration.Observe(time.Since(start).Seconds())
+	}()
+
+	// Proxying is done once both directions are done. EOF of one side is passed to the other one as half-close (e.g
+	// client sends request and shuts down writing), so the other direction can still finish. On errors, or if
+	// connection does not support half-close, both connections are closed, which unblocks the other direction.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(&countingWriter{Writer: target, bytes: p.metrics.bytes.WithLabelValues(directionSent)}, conn)
+		finishCopy(target, conn, err)
+	}()
+	go func() {
+		defer wg.Done()
+		_, err := io.Copy(&countingWriter{Writer: conn, bytes: p.metrics.bytes.WithLabelValues(directionReceived)}, target)
+		finishCopy(conn, target, err)
+	}()
+	wg.Wait()
+}
+
+// countingWriter counts bytes as they are written, so long-lived connections report traffic before they are closed.
+type countingWriter struct {
+	io.Writer
+	bytes prometheus.Counter
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.bytes.Add(float64(n))
+	return n, err
+}
+
+// finishCopy finishes copying from src to dst, that ended with the given error.
+func finishCopy(dst, src net.Conn, err error) {
+	if err == nil && closeWrite(dst) {
+		return
+	}
+	_ = dst.Close()
+	_ = src.Close()
+}
+
+// closeWrite shuts down writing side of the given connection. Connection wrappers implementing `NetConn() net.Conn`
+// (like conntrack ones) are unwrapped until connection that supports it (e.g *net.TCPConn). It returns false if there
+// is none or shutting down fails.
+func closeWrite(conn net.Conn) bool {
+	for {
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+			return cw.CloseWrite() == nil
+		}
+		w, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return false
+		}
+		conn = w.NetConn()
+	}
+}
+
+// dial dials a picked target. Just like Transport.RoundTrip, it retries with other targets on dial errors.
+func (p *TCPProxy) dial(ctx context.Context) (net.Conn, error) {
+	targets := p.discovery.Targets()
+	if len(targets) == 0 {
+		p.metrics.failures.WithLabelValues(failedNoTargetResolved).Inc()
+		return nil, errors.Errorf("lb: no target was resolved")
+	}
+	targets = p.nonDraining(targets)
+
+	for ctx.Err() == nil {
+		target := p.picker.Pick(targets)
+		if target == nil {
+			p.metrics.failures.WithLabelValues(failedNoTargetAvailable).Inc()
+			return nil, errors.Errorf("lb: no target is available")
+		}
+
+		conn, err := p.dialContext(ctx, "tcp", target.DialAddr.Host)
+		if err == nil {
+			return conn, nil
+		}
+
+		if !isDialError(err) {
+			p.metrics.failures.WithLabelValues(conntrack.ErrorReason(err)).Inc()
+			return nil, err
+		}
+
+		// Retry without this target.
+		// NOTE: We need to trust picker that it blacklist the targets well.
+		p.picker.ExcludeTarget(target)
+	}
+
+	p.metrics.failures.WithLabelValues(conntrack.ErrorReason(ctx.Err())).Inc()
+	return nil, ctx.Err()
+}
+
+// nonDraining returns targets that are not draining.
+func (p *TCPProxy) nonDraining(targets []*Target) []*Target {
+	filtered := make([]*Target, 0, len(targets))
+	for _, target := range targets {
+		if !p.isDraining(target) {
+			filtered = append(filtered, target)
+		}
+	}
+	return filtered
+}
+
+// track registers connection, so it is closed on Close. It returns false if proxy is closed.
+func (p *TCPProxy) track(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conns == nil {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+func (p *TCPProxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.conns, conn)
+}
+
+// Close closes all proxied connections. Connections served after Close are closed immediately.
+func (p *TCPProxy) Close() error {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = nil
+	p.mu.Unlock()
+
+	for c := range conns {
+		_ = c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package lbtransport
+
+import (
+	"context"
+	stderrors "errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/observatorium/observable-demo/pkg/conntrack"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func newEchoListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestTCPProxy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echo := newEchoListener(t)
+	defer echo.Close()
+
+	// Closed listener gives us address with nothing listening.
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	testutil.Ok(t, dead.Close())
+
+	reg := prometheus.NewRegistry()
+	metrics := NewTCPProxyMetrics(reg)
+	proxy := NewTCPProxy(
+		NewStaticDiscoveryFromTargets([]*Target{
+			{DialAddr: url.URL{Scheme: "tcp", Host: echo.Addr().String()}},
+			{DialAddr: url.URL{Scheme: "tcp", Host: dead.Addr().String()}},
+		}, nil),
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		metrics,
+	)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	go func() { _ = proxy.Serve(l) }()
+	defer l.Close()
+	defer proxy.Close()
+
+	// First connection is picked for the dead target, so it is retried on the echo one.
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		testutil.Ok(t, err)
+
+		_, err = conn.Write([]byte("hello"))
+		testutil.Ok(t, err)
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(conn, buf)
+		testutil.Ok(t, err)
+		testutil.Equals(t, "hello", string(buf))
+		// Bytes are counted while connection is open.
+		waitFor(t, func() bool {
+			return promtestutil.ToFloat64(metrics.bytes.WithLabelValues(directionReceived)) == float64(5*(i+1))
+		})
+		testutil.Ok(t, conn.Close())
+	}
+
+	for i := 0; promtestutil.ToFloat64(metrics.active) != 0; i++ {
+		testutil.Assert(t, i < 100, "proxied connections were not closed")
+		time.Sleep(10 * time.Millisecond)
+	}
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(metrics.proxiedTotal))
+	testutil.Equals(t, 1.0, gatheredCounter(t, reg, "lbtransport_tcp_proxy_conntrack_dialer_conn_failed_total", "reason", "refused"))
+	testutil.Equals(t, 10.0, promtestutil.ToFloat64(metrics.bytes.WithLabelValues(directionSent)))
+	testutil.Equals(t, 10.0, promtestutil.ToFloat64(metrics.bytes.WithLabelValues(directionReceived)))
+}
+
+func TestTCPProxy_DrainLabel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echo := newEchoListener(t)
+	defer echo.Close()
+	draining := newEchoListener(t)
+	defer draining.Close()
+
+	metrics := NewTCPProxyMetrics(nil)
+	proxy := NewTCPProxy(
+		NewStaticDiscoveryFromTargets([]*Target{
+			{DialAddr: url.URL{Scheme: "tcp", Host: draining.Addr().String()}, Labels: Labels{DrainLabel: "true"}},
+			{DialAddr: url.URL{Scheme: "tcp", Host: echo.Addr().String()}},
+		}, nil),
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		metrics,
+	)
+	defer proxy.Close()
+
+	// Draining target never gets new connections.
+	for i := 0; i < 4; i++ {
+		conn, err := proxy.dial(ctx)
+		testutil.Ok(t, err)
+		testutil.Equals(t, echo.Addr().String(), conn.RemoteAddr().String())
+		testutil.Ok(t, conn.Close())
+	}
+
+	// Neither does the only target, if it is draining.
+	proxy = NewTCPProxy(
+		NewStaticDiscoveryFromTargets([]*Target{
+			{DialAddr: url.URL{Scheme: "tcp", Host: draining.Addr().String()}, Labels: Labels{DrainLabel: "true"}},
+		}, nil),
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		metrics,
+	)
+	_, err := proxy.dial(ctx)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.failures.WithLabelValues(failedNoTargetAvailable)))
+}
+
+func TestTCPProxy_DrainingFrom(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	echo := newEchoListener(t)
+	defer echo.Close()
+	drained := newEchoListener(t)
+	defer drained.Close()
+
+	target := &Target{DialAddr: url.URL{Scheme: "tcp", Host: drained.Addr().String()}}
+	lb := &Transport{metrics: NewMetrics(nil)}
+	<-lb.DrainTarget(target, 1*time.Minute)
+
+	// Target drained via Transport (e.g by admin API) never gets new connections, even without drain label.
+	proxy := NewTCPProxy(
+		NewStaticDiscoveryFromTargets([]*Target{
+			{DialAddr: url.URL{Scheme: "tcp", Host: drained.Addr().String()}},
+			{DialAddr: url.URL{Scheme: "tcp", Host: echo.Addr().String()}},
+		}, nil),
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		NewTCPProxyMetrics(nil),
+		WithDrainingFrom(lb),
+	)
+	defer proxy.Close()
+
+	for i := 0; i < 4; i++ {
+		conn, err := proxy.dial(ctx)
+		testutil.Ok(t, err)
+		testutil.Equals(t, echo.Addr().String(), conn.RemoteAddr().String())
+		testutil.Ok(t, conn.Close())
+	}
+
+	// Once undrained, target is picked again.
+	lb.UndrainTarget(target)
+	picked := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		conn, err := proxy.dial(ctx)
+		testutil.Ok(t, err)
+		picked[conn.RemoteAddr().String()] = true
+		testutil.Ok(t, conn.Close())
+	}
+	testutil.Assert(t, picked[drained.Addr().String()], "undrained target should be picked")
+}
+
+func TestTCPProxy_HalfClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Backend replies only once it reads the whole request, so it needs client's half-close to be passed.
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	defer backend.Close()
+	go func() {
+		conn, err := backend.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		req, err := ioutil.ReadAll(conn)
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write(append([]byte("got "), req...))
+	}()
+
+	proxy := NewTCPProxy(
+		NewStaticDiscoveryFromTargets([]*Target{{DialAddr: url.URL{Scheme: "tcp", Host: backend.Addr().String()}}}, nil),
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		NewTCPProxyMetrics(nil),
+	)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	testutil.Ok(t, err)
+	go func() { _ = proxy.Serve(conntrack.NewInstrumentedListener(l, conntrack.NewListenerMetrics(nil))) }()
+	defer l.Close()
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	testutil.Ok(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	testutil.Ok(t, err)
+	testutil.Ok(t, conn.(*net.TCPConn).CloseWrite())
+
+	testutil.Ok(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	resp, err := ioutil.ReadAll(conn)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "got hello", string(resp))
+}
+
+// emfileListener fails every accept with EMFILE until it is closed.
+type emfileListener struct {
+	net.Listener
+
+	accepts int32
+	closed  chan struct{}
+}
+
+func (l *emfileListener) Accept() (net.Conn, error) {
+	atomic.AddInt32(&l.accepts, 1)
+	select {
+	case <-l.closed:
+		return nil, net.ErrClosed
+	default:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+}
+
+func TestTCPProxy_ServeBackoff(t *testing.T) {
+	l := &emfileListener{closed: make(chan struct{})}
+	proxy := NewTCPProxy(NewStaticDiscoveryFromTargets(nil, nil), NewRoundRobinPicker(context.Background(), nil, 1*time.Minute), NewTCPProxyMetrics(nil))
+
+	served := make(chan error, 1)
+	go func() { served <- proxy.Serve(l) }()
+	time.Sleep(200 * time.Millisecond)
+	close(l.closed)
+
+	select {
+	case err := <-served:
+		testutil.Assert(t, stderrors.Is(err, net.ErrClosed), "unexpected error %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after listener was closed")
+	}
+	// Backoff of 5ms, 10ms, 20ms, ... gives only few accepts in 200ms.
+	accepts := atomic.LoadInt32(&l.accepts)
+	testutil.Assert(t, accepts < 10, "expected accept errors to be retried with backoff, got %d accepts", accepts)
+}
@@ -0,0 +1,153 @@
+package lbtransport
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+
+	"github.com/observatorium/observable-demo/pkg/exttls"
+)
+
+// Target labels that define per-target TLS configuration. See NewLabelsTLSConfigFunc.
+const (
+	TLSCAFileLabel     = "tls_ca_file"
+	TLSCertFileLabel   = "tls_cert_file"
+	TLSKeyFileLabel    = "tls_key_file"
+	TLSServerNameLabel = "tls_server_name"
+	TLSMinVersionLabel = "tls_min_version"
+)
+
+var tlsLabels = []string{TLSCAFileLabel, TLSCertFileLabel, TLSKeyFileLabel, TLSServerNameLabel, TLSMinVersionLabel}
+
+// tlsFileLabels are TLS labels with filesystem paths. They are not exposed as metric labels.
+var tlsFileLabels = map[string]struct{}{TLSCAFileLabel: {}, TLSCertFileLabel: {}, TLSKeyFileLabel: {}}
+
+// IsTLSFileLabel returns true if the given label holds filesystem path of TLS key material.
+func IsTLSFileLabel(name string) bool {
+	_, ok := tlsFileLabels[name]
+	return ok
+}
+
+// targetTLSLabels returns TLS labels of the given target.
+func targetTLSLabels(target *Target) Labels {
+	tlsLset := Labels{}
+	if target == nil {
+		return tlsLset
+	}
+	for _, n := range tlsLabels {
+		if v, ok := target.Labels[n]; ok {
+			tlsLset[n] = v
+		}
+	}
+	return tlsLset
+}
+
+// TLSConfigFunc returns TLS configuration for connection to the given target. Target is nil if it is not known
+// (e.g when connection is made by parent transport on its own).
+type TLSConfigFunc func(target *Target, serverName string) (*tls.Config, error)
+
+func staticTLSConfigFunc(c *tls.Config) TLSConfigFunc {
+	return func(_ *Target, serverName string) (*tls.Config, error) {
+		if c == nil {
+			return &tls.Config{ServerName: serverName}, nil
+		}
+		if c.ServerName != "" {
+			return c, nil
+		}
+		cfg := c.Clone()
+		cfg.ServerName = serverName
+		return cfg, nil
+	}
+}
+
+// NewLabelsTLSConfigFunc returns TLSConfigFunc that uses per-target TLS configuration if target has any of the TLS labels
+// (tls_ca_file, tls_cert_file, tls_key_file, tls_server_name, tls_min_version), or the given default one otherwise.
+// Certificate files of all configurations are reloaded when they change on disk.
+func NewLabelsTLSConfigFunc(def *exttls.ClientTLS) TLSConfigFunc {
+	var (
+		mu     sync.Mutex
+		byKeys = map[string]*exttls.ClientTLS{}
+	)
+	return func(target *Target, serverName string) (*tls.Config, error) {
+		tlsLset := targetTLSLabels(target)
+		if len(tlsLset) == 0 {
+			return def.Config(serverName)
+		}
+
+		key := tlsLset.String()
+
+		mu.Lock()
+		ct, ok := byKeys[key]
+		if !ok {
+			minVersion, err := exttls.ParseVersion(tlsLset[TLSMinVersionLabel])
+			if err != nil {
+				mu.Unlock()
+				return nil, err
+			}
+			ct, err = exttls.NewClientTLS(exttls.ClientConfig{
+				CAFile:     tlsLset[TLSCAFileLabel],
+				CertFile:   tlsLset[TLSCertFileLabel],
+				KeyFile:    tlsLset[TLSKeyFileLabel],
+				ServerName: tlsLset[TLSServerNameLabel],
+				MinVersion: minVersion,
+			})
+			if err != nil {
+				mu.Unlock()
+				return nil, err
+			}
+			byKeys[key] = ct
+		}
+		mu.Unlock()
+
+		return ct.Config(serverName)
+	}
+}
+
+// tlsParents keeps a parent transport per distinct set of TLS labels. http.Transport pools connections by scheme and
+// address only, so otherwise targets with the same address and different TLS configuration would share connections.
+type tlsParents struct {
+	base *http.Transport
+
+	mu     sync.Mutex
+	byKeys map[string]*http.Transport
+}
+
+func newTLSParents(base *http.Transport) *tlsParents {
+	return &tlsParents{base: base, byKeys: map[string]*http.Transport{}}
+}
+
+// closeIdleConnections closes idle connections of the base and all parent transports created for TLS configurations.
+func (p *tlsParents) closeIdleConnections() {
+	if p == nil {
+		return
+	}
+
+	p.base.CloseIdleConnections()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, parent := range p.byKeys {
+		parent.CloseIdleConnections()
+	}
+}
+
+// forTarget returns parent transport for the TLS configuration of the given target.
+func (p *tlsParents) forTarget(target *Target) *http.Transport {
+	tlsLset := targetTLSLabels(target)
+	if len(tlsLset) == 0 {
+		return p.base
+	}
+
+	key := tlsLset.String()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	parent, ok := p.byKeys[key]
+	if !ok {
+		// Clone shares dialers, so connections are still tracked and instrumented the same way.
+		parent = p.base.Clone()
+		p.byKeys[key] = parent
+	}
+	return parent
+}
@@ -0,0 +1,151 @@
+package lbtransport
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/observatorium/observable-demo/pkg/exttls"
+	"github.com/observatorium/observable-demo/pkg/internal/testtls"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestTransport_MTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lbtransport-tls")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	clientCert, clientKey := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	testtls.WriteKeyPair(t, clientCert, clientKey, "client", time.Now())
+	clientCA, err := exttls.NewCAReloader(clientCert)
+	testutil.Ok(t, err)
+	clientPool, err := clientCA.Get()
+	testutil.Ok(t, err)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientPool}
+	srv.StartTLS()
+	defer srv.Close()
+
+	serverCA := filepath.Join(dir, "server-ca.crt")
+	testutil.Ok(t, ioutil.WriteFile(serverCA, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600))
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	def, err := exttls.NewClientTLS(exttls.ClientConfig{})
+	testutil.Ok(t, err)
+
+	for _, tcase := range []struct {
+		name   string
+		labels Labels
+
+		expectedErr       bool
+		expectedHandshake float64
+	}{
+		{
+			name: "per-target CA and client certificate",
+			labels: Labels{
+				TLSCAFileLabel:     serverCA,
+				TLSCertFileLabel:   clientCert,
+				TLSKeyFileLabel:    clientKey,
+				TLSServerNameLabel: "example.com",
+				TLSMinVersionLabel: "1.2",
+			},
+		},
+		{
+			name:              "default config with system roots",
+			expectedErr:       true,
+			expectedHandshake: 1,
+		},
+	} {
+		if ok := t.Run(tcase.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			metrics := NewMetrics(reg)
+			lb := NewLoadBalancingTransportWithContext(
+				ctx,
+				NewStaticDiscoveryFromTargets([]*Target{{DialAddr: *u, Labels: tcase.labels}}, nil),
+				NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+				metrics,
+				WithTLSConfigFunc(NewLabelsTLSConfigFunc(def)),
+			)
+
+			resp, err := lb.RoundTrip(httptest.NewRequest("GET", "http://whatever", nil))
+			if tcase.expectedErr {
+				testutil.NotOk(t, err)
+			} else {
+				testutil.Ok(t, err)
+				testutil.Equals(t, http.StatusOK, resp.StatusCode)
+				testutil.Ok(t, resp.Body.Close())
+			}
+			testutil.Equals(t, tcase.expectedHandshake, gatheredCounter(t, reg, "conntrack_dialer_conn_failed_total", "reason", "tls_handshake"))
+		}); !ok {
+			return
+		}
+	}
+}
+
+func TestTransport_TLSConnectionPools(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lbtransport-tls")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, os.RemoveAll(dir)) }()
+
+	var conns int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	serverCA := filepath.Join(dir, "server-ca.crt")
+	testutil.Ok(t, ioutil.WriteFile(serverCA, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600))
+
+	u, err := url.Parse(srv.URL)
+	testutil.Ok(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	def, err := exttls.NewClientTLS(exttls.ClientConfig{})
+	testutil.Ok(t, err)
+
+	discovery := NewMutableStaticDiscoveryFromTargets([]*Target{{DialAddr: *u, Labels: Labels{TLSCAFileLabel: serverCA}}}, nil)
+	lb := NewLoadBalancingTransportWithContext(
+		ctx,
+		discovery,
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		NewMetrics(nil),
+		WithTLSConfigFunc(NewLabelsTLSConfigFunc(def)),
+	)
+
+	roundTripOK(t, lb)
+	roundTripOK(t, lb)
+	testutil.Equals(t, int64(1), atomic.LoadInt64(&conns))
+
+	// Connections made with different TLS configuration are not reused.
+	testutil.Assert(t, discovery.RemoveTarget(*u), "target should be removed")
+	testutil.Assert(t, discovery.AddTarget(&Target{DialAddr: *u, Labels: Labels{TLSCAFileLabel: serverCA, TLSServerNameLabel: "example.com"}}), "target should be added")
+	roundTripOK(t, lb)
+	testutil.Equals(t, int64(2), atomic.LoadInt64(&conns))
+}
@@ -1,23 +1,32 @@
 package lbtransport
 
 import (
+	"context"
+	"crypto/tls"
 	stderrors "errors"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/observatorium/observable-demo/pkg/conntrack"
 	"github.com/observatorium/observable-demo/pkg/exthttp"
+	"github.com/observatorium/observable-demo/pkg/extprom"
 	"github.com/observatorium/observable-demo/pkg/runutil"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// Failure reasons, apart from the ones of conntrack.ErrorReason used for errors of target round trips.
 const (
 	failedNoTargetAvailable = "no_target_available"
 	failedNoTargetResolved  = "no_target_resolved"
-	failedTimeout           = "timeout"
-	failedUnknown           = "unknown"
+	// failedUpgrade is used when target switched protocols, but the upgraded connection cannot be proxied.
+	failedUpgrade = "upgrade"
+	// failedGRPCReplayLimit is used when gRPC call has to be retried, but more than the replay limit was read from its
+	// request stream already.
+	failedGRPCReplayLimit = "grpc_replay_limit"
 )
 
 type Metrics struct {
@@ -25,11 +34,73 @@ type Metrics struct {
 	failures  *prometheus.CounterVec
 	duration  prometheus.Histogram
 
+	drainingInFlight         *prometheus.GaugeVec
+	drainedTotal             *prometheus.CounterVec
+	staleTargetsCleanedTotal prometheus.Counter
+	grpcRetriesTotal         *prometheus.CounterVec
+
+	upgradedConnsActive  prometheus.Gauge
+	upgradedConnDuration prometheus.Histogram
+	upgradedConnBytes    *prometheus.CounterVec
+
+	warmConns          prometheus.Gauge
+	warmConnsUsedTotal prometheus.Counter
+	maxAgeClosedTotal  prometheus.Counter
+
 	dialerMetrics *conntrack.DialerMetrics
 	httpMetrics   *exthttp.ClientMetrics
 }
 
-func NewMetrics(reg prometheus.Registerer) *Metrics {
+type metricsOptions struct {
+	dialerTargetLabel bool
+	maxTargets        int
+}
+
+// MetricsOption configures Metrics.
+type MetricsOption func(*metricsOptions)
+
+// WithDialerTargetLabel adds `target` label with the dialed address to dialer metrics, so failures of single target
+// are visible.
+func WithDialerTargetLabel() MetricsOption {
+	return func(o *metricsOptions) { o.dialerTargetLabel = true }
+}
+
+// WithMaxTargetLabelValues limits number of distinct values of `target` label of HTTP client and dialer metrics to n.
+// Targets over the limit are observed as `other`. Zero means no limit.
+func WithMaxTargetLabelValues(n int) MetricsOption {
+	return func(o *metricsOptions) { o.maxTargets = n }
+}
+
+// targetLabelKey returns dialed address of the given target label value, which is either target URL or the address.
+func targetLabelKey(v string) string {
+	u, err := url.Parse(v)
+	if err != nil || u.Host == "" {
+		return v
+	}
+	return dialAddress(*u)
+}
+
+func NewMetrics(reg prometheus.Registerer, opts ...MetricsOption) *Metrics {
+	o := metricsOptions{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var (
+		dialerOpts []conntrack.DialerMetricsOption
+		httpOpts   []exthttp.ClientMetricsOption
+	)
+	// HTTP client metrics are labelled with target URL, whereas dialer ones with dialed address, so the shared limiter
+	// counts both as a single target.
+	var limiter *extprom.LabelLimiter
+	if o.maxTargets > 0 {
+		limiter = extprom.NewLabelLimiter(reg, "target", o.maxTargets, extprom.WithValueKey(targetLabelKey))
+		httpOpts = append(httpOpts, exthttp.WithTargetLimiter(limiter))
+	}
+	if o.dialerTargetLabel {
+		dialerOpts = append(dialerOpts, conntrack.WithTargetLabel(limiter))
+	}
+
 	m := &Metrics{
 		successes: prometheus.NewCounter(prometheus.CounterOpts{
 			Subsystem: "lbtransport",
@@ -48,8 +119,59 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 				Help:      "Duration of proxy logic.",
 				Buckets:   []float64{0.001, 0.01, 0.1, 0.3, 0.6, 1, 3, 10},
 			}),
-		dialerMetrics: conntrack.NewDialerMetrics(reg),
-		httpMetrics:   exthttp.NewClientMetrics(reg),
+		drainingInFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: "lbtransport",
+			Name:      "draining_target_in_flight_requests",
+			Help:      "Number of in-flight requests to the draining target.",
+		}, []string{"target"}),
+		drainedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "lbtransport",
+			Name:      "drained_targets_total",
+			Help:      "Total number of drained targets by result. Result is timeout if in-flight requests did not finish on time.",
+		}, []string{"result"}),
+		staleTargetsCleanedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Subsystem: "lbtransport",
+			Name:      "stale_targets_cleaned_total",
+			Help:      "Total number of targets that disappeared from discovery and had their connections and metric series cleaned.",
+		}),
+		grpcRetriesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "lbtransport",
+			Name:      "grpc_retries_total",
+			Help:      "Total number of gRPC calls retried on another target due to retryable gRPC status code.",
+		}, []string{"code"}),
+		upgradedConnsActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Subsystem: "lbtransport",
+			Name:      "upgraded_connections_active",
+			Help:      "Number of active connections to targets upgraded to other protocol e.g WebSocket.",
+		}),
+		upgradedConnDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Subsystem: "lbtransport",
+			Name:      "upgraded_connection_duration_seconds",
+			Help:      "Duration of connections to targets upgraded to other protocol e.g WebSocket.",
+			Buckets:   []float64{1, 10, 60, 300, 900, 1800, 3600, 3 * 3600, 12 * 3600},
+		}),
+		upgradedConnBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Subsystem: "lbtransport",
+			Name:      "upgraded_connection_bytes_total",
+			Help:      "Total number of bytes sent to (direction=sent) or received from (direction=received) targets over upgraded connections.",
+		}, []string{"direction"}),
+		warmConns: prometheus.NewGauge(prometheus.GaugeOpts{
+			Subsystem: "lbtransport",
+			Name:      "warm_connections",
+			Help:      "Number of pre-dialed connections to targets waiting to be used.",
+		}),
+		warmConnsUsedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Subsystem: "lbtransport",
+			Name:      "warm_connections_used_total",
+			Help:      "Total number of pre-dialed connections used instead of dialing a target.",
+		}),
+		maxAgeClosedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Subsystem: "lbtransport",
+			Name:      "max_age_closed_connections_total",
+			Help:      "Total number of connections to targets closed because they reached maximum age.",
+		}),
+		dialerMetrics: conntrack.NewDialerMetrics(reg, dialerOpts...),
+		httpMetrics:   exthttp.NewClientMetrics(reg, httpOpts...),
 	}
 
 	if reg != nil {
@@ -57,16 +179,45 @@ func NewMetrics(reg prometheus.Registerer) *Metrics {
 			m.successes,
 			m.failures,
 			m.duration,
+			m.drainingInFlight,
+			m.drainedTotal,
+			m.staleTargetsCleanedTotal,
+			m.grpcRetriesTotal,
+			m.upgradedConnsActive,
+			m.upgradedConnDuration,
+			m.upgradedConnBytes,
+			m.warmConns,
+			m.warmConnsUsedTotal,
+			m.maxAgeClosedTotal,
 		)
 	}
 
-	m.failures.WithLabelValues(failedUnknown)
+	m.upgradedConnBytes.WithLabelValues(directionSent)
+	m.upgradedConnBytes.WithLabelValues(directionReceived)
+
+	m.drainedTotal.WithLabelValues(drainedIdle)
+	m.drainedTotal.WithLabelValues(drainedTimeout)
+
 	m.failures.WithLabelValues(failedNoTargetAvailable)
-	m.failures.WithLabelValues(failedTimeout)
 	m.failures.WithLabelValues(failedNoTargetResolved)
+	m.failures.WithLabelValues(failedUpgrade)
+	m.failures.WithLabelValues(failedGRPCReplayLimit)
+	for _, reason := range conntrack.ErrorReasons {
+		m.failures.WithLabelValues(reason)
+	}
 	return m
 }
 
+type targetCtxKey struct{}
+
+// TargetFromContext returns the target picked for the request with the given context, if any.
+// Requests passed to parent round tripper (and thus `http.Response.Request`) have it set.
+// Useful e.g. for access logging.
+func TargetFromContext(ctx context.Context) (*Target, bool) {
+	t, ok := ctx.Value(targetCtxKey{}).(*Target)
+	return t, ok
+}
+
 type Transport struct {
 	discovery Discovery
 	picker    TargetPicker
@@ -74,34 +225,139 @@ type Transport struct {
 	metrics *Metrics
 
 	parent http.RoundTripper
+	conns  connRegistry
+	warm   *warmPool
+
+	// h2cParent is used instead of parent for targets that speak cleartext HTTP/2 (see ProtocolLabel).
+	h2cParent http.RoundTripper
+	h2cAll    bool
+	// tlsParents are used instead of parent for HTTPS targets.
+	tlsParents *tlsParents
+	// grpcTLSParents speak only HTTP/2 and are used for gRPC calls to HTTPS targets, if HTTP/2 is not enabled for them.
+	grpcTLSParents *tlsParents
+
+	grpcRetryableCodes map[string]bool
+	grpcReplayLimit    int
+
+	inFlight     inFlightTracker
+	drainTimeout time.Duration
+
+	seen seenTargets
+}
+
+// NewLoadBalancingTransport returns Transport that load balances requests between discovered targets.
+//
+// Deprecated: Use NewLoadBalancingTransportWithContext. The returned Transport runs no background work, so it neither
+// cleans up targets that disappeared from discovery nor keeps warm connections (see WithWarmConnsPerTarget).
+func NewLoadBalancingTransport(discovery Discovery, picker TargetPicker, metrics *Metrics, opts ...Option) *Transport {
+	return newLoadBalancingTransport(discovery, picker, metrics, opts...)
 }
 
-func NewLoadBalancingTransport(discovery Discovery, picker TargetPicker, metrics *Metrics) *Transport {
-	return &Transport{
-		discovery: discovery,
-		picker:    picker,
-		metrics:   metrics,
-		parent: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: conntrack.NewInstrumentedDialContextFunc(
-				(&net.Dialer{
-					Timeout:   10 * time.Second,
-					KeepAlive: 30 * time.Second,
-					DualStack: false,
-				}).DialContext,
-				metrics.dialerMetrics),
-			MaxIdleConns:          4,
-			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   10 * time.Second,
+// NewLoadBalancingTransportWithContext returns Transport that load balances requests between discovered targets.
+// Until context is done, it periodically cleans up connections and metrics of targets that disappeared from discovery.
+func NewLoadBalancingTransportWithContext(ctx context.Context, discovery Discovery, picker TargetPicker, metrics *Metrics, opts ...Option) *Transport {
+	t := newLoadBalancingTransport(discovery, picker, metrics, opts...)
+	go t.runStaleTargetsCleanup(ctx, 1*time.Minute)
+	if t.warm != nil {
+		go t.runWarmUp(ctx, warmUpInterval)
+	}
+	return t
+}
+
+func newLoadBalancingTransport(discovery Discovery, picker TargetPicker, metrics *Metrics, opts ...Option) *Transport {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	t := &Transport{
+		discovery:    discovery,
+		picker:       picker,
+		metrics:      metrics,
+		drainTimeout: o.drainTimeout,
+		parent:       o.parent,
+
+		grpcRetryableCodes: map[string]bool{},
+		grpcReplayLimit:    o.grpcReplayLimit,
+	}
+	for _, c := range o.grpcRetryableCodes {
+		t.grpcRetryableCodes[c] = true
+	}
+	if t.parent == nil {
+		dialer := &net.Dialer{
+			Timeout:   o.dialTimeout,
+			KeepAlive: o.keepAlive,
+			DualStack: false,
+		}
+		dial := dialer.DialContext
+		if o.dialContext != nil {
+			dial = dialContextWithTimeout(o.dialContext, o.dialTimeout)
+		}
+		if o.resolver != nil {
+			dial = o.resolver.DialContextFunc(dial)
+		}
+		// Connections are registered below TLS, so parent transport gets *tls.Conn it needs e.g for HTTP/2 negotiation.
+		t.conns.maxAge = o.maxConnAge
+		t.conns.maxAgeClosedTotal = metrics.maxAgeClosedTotal
+		t.conns.closeIdle = t.closeIdleConnections
+		dialContext := t.conns.wrapDialContext(dial)
+		instrumentedDialContext := conntrack.NewInstrumentedDialContextFunc(dialContext, metrics.dialerMetrics, o.dialerOpts...)
+		// We do TLS handshake on our own, so we can use per-target TLS configuration and track handshake failures.
+		instrumentedDialTLSContext := conntrack.NewInstrumentedTLSDialContextFunc(
+			dialContext,
+			func(ctx context.Context, addr string) (*tls.Config, error) {
+				host, _, err := net.SplitHostPort(addr)
+				if err != nil {
+					host = addr
+				}
+				target, _ := TargetFromContext(ctx)
+				cfg, err := o.tlsConfigFunc(target, host)
+				if err != nil || !(o.http2 || http2FromContext(ctx)) || upgradeFromContext(ctx) {
+					// Upgrade requests (e.g WebSocket) require HTTP/1.1.
+					return cfg, err
+				}
+				return withHTTP2NextProtos(cfg), nil
+			},
+			o.tlsHandshakeTimeout,
+			metrics.dialerMetrics,
+			o.dialerOpts...,
+		)
+		// Warm connections are pre-dialed through the instrumented dialers, so they are tracked (and their dial
+		// failures counted) from the moment they are dialed, not from the moment they are used.
+		if o.warmConnsPerTarget > 0 {
+			t.warm = newWarmPool(o.warmConnsPerTarget, o.idleConnTimeout, instrumentedDialContext, instrumentedDialTLSContext, metrics)
+			// Warm connections are dialed for an address, so they are assigned to the target once used.
+			instrumentedDialContext = t.conns.wrapAssignDialContext(t.warm.dialContext)
+			instrumentedDialTLSContext = t.conns.wrapAssignDialContext(t.warm.dialTLSContext)
+		}
+
+		parent := &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           instrumentedDialContext,
+			DialTLSContext:        instrumentedDialTLSContext,
+			ForceAttemptHTTP2:     o.http2,
+			MaxIdleConns:          o.maxIdleConns,
+			MaxIdleConnsPerHost:   o.maxIdleConnsPerHost,
+			MaxConnsPerHost:       o.maxConnsPerHost,
+			IdleConnTimeout:       o.idleConnTimeout,
+			ResponseHeaderTimeout: o.responseHeaderTimeout,
 			ExpectContinueTimeout: 1 * time.Second,
-		},
+		}
+		t.parent = parent
+		t.h2cParent = newH2CTransport(parent)
+		t.tlsParents = newTLSParents(parent)
+		if !o.http2 {
+			t.grpcTLSParents = newTLSParents(newHTTP2Transport(parent))
+		}
+		t.h2cAll = o.h2c
 	}
+	return t
 }
 
 func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
 	start := time.Now()
 	durationRT := 0 * time.Second
-	defer t.metrics.duration.Observe((time.Since(start) - durationRT).Seconds())
+	defer func() { t.metrics.duration.Observe((time.Since(start) - durationRT).Seconds()) }()
 
 	targets := t.discovery.Targets()
 	if len(targets) == 0 {
@@ -110,6 +366,10 @@ func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
 		return nil, errors.Errorf("lb: no target was resolved")
 	}
 
+	if exthttp.IsGRPCRequest(r) {
+		return t.roundTripGRPC(r, targets, &durationRT)
+	}
+
 	if r.Body != nil {
 		// We have to own the body for the request because we cannot reuse same reader closer
 		// in multiple calls to http.Transport.
@@ -118,6 +378,9 @@ func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
 		r.Body = newReplayableReader(body)
 	}
 
+	// Draining targets never receive new requests.
+	targets = t.nonDraining(targets)
+
 	for r.Context().Err() == nil {
 		target := t.picker.Pick(targets)
 		if target == nil {
@@ -125,30 +388,39 @@ func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
 			return nil, errors.Errorf("lb: no target is available")
 		}
 
-		// Override the host for downstream Tripper, usually http.DefaultTransport.
-		// http.Default Transport uses `URL.Host` for Dial(<host>) and relevant connection pooling.
-		// We override it to make sure it enters the appropriate dial method and the appropriate connection pool.
-		// See http.connectMethodKey.
-		addr := target.DialAddr
-		r.URL = &addr
 		if r.Body != nil {
 			r.Body.(*replayableReader).rewind()
 		}
 
 		startRT := time.Now()
-		// Wrap parent round tripper with our dynamic metric tripperware.
-		// NOTE: This has huge risk of being high cardinality for addresses that change frequently.
-		// For demo purposes our targets are static, so the cardinality is stable.
-		resp, err := exthttp.NewMetricTripperware(t.metrics.httpMetrics, target.DialAddr.String(), t.parent).RoundTrip(r)
+		resp, done, err := t.roundTripTarget(r, target)
+		if err == nil && resp.StatusCode == http.StatusSwitchingProtocols {
+			rwc, ok := resp.Body.(io.ReadWriteCloser)
+			if !ok {
+				// Proxy needs writable body to use upgraded connection, e.g parent transport does not support upgrades.
+				_ = resp.Body.Close()
+				done()
+				t.metrics.failures.WithLabelValues(failedUpgrade).Inc()
+				return nil, errors.Errorf("lb: target %v switched protocols, but upgraded connection is not writable", target.DialAddr.String())
+			}
+			// Success. Upgraded connection (e.g WebSocket) is in flight until closed.
+			durationRT = time.Since(startRT)
+			t.metrics.successes.Inc()
+			resp.Body = newUpgradedConn(rwc, t.metrics, done)
+			return resp, nil
+		}
 		if err == nil {
 			// Success.
 			durationRT = time.Since(startRT)
 			t.metrics.successes.Inc()
+			// Request is in flight until the response body is closed.
+			resp.Body = &doneOnCloseBody{ReadCloser: resp.Body, done: done}
 			return resp, nil
 		}
+		done()
 
 		if !isDialError(err) {
-			t.metrics.failures.WithLabelValues(failedUnknown).Inc()
+			t.metrics.failures.WithLabelValues(conntrack.ErrorReason(err)).Inc()
 			return resp, err
 		}
 
@@ -157,10 +429,65 @@ func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
 		t.picker.ExcludeTarget(target)
 	}
 
-	t.metrics.failures.WithLabelValues(failedTimeout).Inc()
+	t.metrics.failures.WithLabelValues(conntrack.ErrorReason(r.Context().Err())).Inc()
 	return nil, r.Context().Err()
 }
 
+// roundTripTarget sends the request to the given target. The returned function has to be called once the request is
+// done.
+func (t *Transport) roundTripTarget(r *http.Request, target *Target) (*http.Response, func(), error) {
+	// Override the scheme and host for downstream Tripper, usually http.DefaultTransport.
+	// http.Default Transport uses `URL.Host` for Dial(<host>) and relevant connection pooling.
+	// We override it to make sure it enters the appropriate dial method and the appropriate connection pool.
+	// See http.connectMethodKey. The rest of URL (e.g path of gRPC method) is kept.
+	u := *r.URL
+	u.Scheme = target.DialAddr.Scheme
+	u.Host = target.DialAddr.Host
+	r.URL = &u
+
+	// Wrap parent round tripper with our dynamic metric tripperware.
+	// NOTE: This has huge risk of being high cardinality for addresses that change frequently.
+	// To keep it bounded, series of targets that disappear from discovery are deleted (see cleanUpStaleTargets).
+	t.seen.add(target)
+	ctx := context.WithValue(r.Context(), targetCtxKey{}, target)
+	if exthttp.IsUpgradeRequest(r) {
+		ctx = context.WithValue(ctx, upgradeCtxKey{}, true)
+	}
+	if t.requiresHTTP2Parent(target, r) {
+		ctx = context.WithValue(ctx, http2CtxKey{}, true)
+	}
+	done := t.inFlight.start(target, t.metrics)
+	if t.conns.maxAge > 0 {
+		ctx, done = withConnUse(ctx, done)
+	}
+	resp, err := exthttp.NewMetricTripperware(t.metrics.httpMetrics, target.DialAddr.String(), t.parentFor(target, r)).RoundTrip(
+		r.WithContext(ctx),
+	)
+	return resp, done, err
+}
+
+type doneOnCloseBody struct {
+	io.ReadCloser
+	done func()
+}
+
+func (b *doneOnCloseBody) Close() error {
+	defer b.done()
+	return b.ReadCloser.Close()
+}
+
+// dialContextWithTimeout limits time of dials with the given function to the given timeout, like net.Dialer.Timeout.
+func dialContextWithTimeout(dial dialContextFunc, timeout time.Duration) dialContextFunc {
+	if timeout <= 0 {
+		return dial
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return dial(ctx, network, addr)
+	}
+}
+
 func isDialError(err error) bool {
 	var e *net.OpError
 	if stderrors.As(err, &e) {
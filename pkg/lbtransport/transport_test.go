@@ -2,14 +2,26 @@ package lbtransport
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
 	"net/url"
+	"strings"
 	"syscall"
 	"testing"
-
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	"github.com/observatorium/observable-demo/pkg/conntrack"
+	"github.com/observatorium/observable-demo/pkg/exthttp"
+	"github.com/observatorium/observable-demo/pkg/memnet"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/util/testutil"
 )
@@ -99,7 +111,7 @@ func TestLoadBalancingTranport(t *testing.T) {
 		parent:    transport,
 	}
 	// All reasons are initialised.
-	testutil.Equals(t, 4, promtestutil.CollectAndCount(lb.metrics.failures))
+	testutil.Equals(t, 4+len(conntrack.ErrorReasons), promtestutil.CollectAndCount(lb.metrics.failures))
 
 	for _, tcase := range []struct {
 		targets   []string
@@ -189,9 +201,9 @@ func TestLoadBalancingTranport(t *testing.T) {
 			testutil.Equals(t, tcase.successes, promtestutil.ToFloat64(metrics.successes))
 			testutil.Equals(t, tcase.failedNoTargetAvailable, promtestutil.ToFloat64(metrics.failures.WithLabelValues(failedNoTargetAvailable)))
 			testutil.Equals(t, tcase.failedNoTargetResolved, promtestutil.ToFloat64(metrics.failures.WithLabelValues(failedNoTargetResolved)))
-			testutil.Equals(t, tcase.failedUnknown, promtestutil.ToFloat64(metrics.failures.WithLabelValues(failedUnknown)))
-			testutil.Equals(t, float64(0), promtestutil.ToFloat64(metrics.failures.WithLabelValues(failedTimeout)))
-			testutil.Equals(t, 4, promtestutil.CollectAndCount(lb.metrics.failures))
+			testutil.Equals(t, tcase.failedUnknown, promtestutil.ToFloat64(metrics.failures.WithLabelValues("unknown")))
+			testutil.Equals(t, float64(0), promtestutil.ToFloat64(metrics.failures.WithLabelValues("timeout")))
+			testutil.Equals(t, 4+len(conntrack.ErrorReasons), promtestutil.CollectAndCount(lb.metrics.failures))
 		}); !ok {
 			return
 		}
@@ -213,10 +225,185 @@ func TestLoadBalancingTransport_Timeout(t *testing.T) {
 	testutil.NotOk(t, err)
 	testutil.Equals(t, cancelled.Err().Error(), err.Error())
 
+	expired, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	_, err = lb.RoundTrip(httptest.NewRequest("GET", "http://whatever", nil).WithContext(expired))
+	testutil.NotOk(t, err)
+	testutil.Equals(t, expired.Err().Error(), err.Error())
+
 	testutil.Equals(t, float64(0), promtestutil.ToFloat64(metrics.successes))
 	testutil.Equals(t, float64(0), promtestutil.ToFloat64(metrics.failures.WithLabelValues(failedNoTargetAvailable)))
 	testutil.Equals(t, float64(0), promtestutil.ToFloat64(metrics.failures.WithLabelValues(failedNoTargetResolved)))
-	testutil.Equals(t, float64(0), promtestutil.ToFloat64(metrics.failures.WithLabelValues(failedUnknown)))
-	testutil.Equals(t, float64(1), promtestutil.ToFloat64(metrics.failures.WithLabelValues(failedTimeout)))
-	testutil.Equals(t, 4, promtestutil.CollectAndCount(lb.metrics.failures))
+	testutil.Equals(t, float64(0), promtestutil.ToFloat64(metrics.failures.WithLabelValues("unknown")))
+	testutil.Equals(t, float64(1), promtestutil.ToFloat64(metrics.failures.WithLabelValues("timeout")))
+	// Cancellation is not a timeout.
+	testutil.Equals(t, float64(1), promtestutil.ToFloat64(metrics.failures.WithLabelValues("canceled")))
+	testutil.Equals(t, 4+len(conntrack.ErrorReasons), promtestutil.CollectAndCount(lb.metrics.failures))
+}
+
+func TestLoadBalancingTransport_DialErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	n := memnet.New()
+	l, err := n.Listen("tcp", "ok:80")
+	testutil.Ok(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})}
+	go func() { _ = srv.Serve(l) }()
+	defer func() { testutil.Ok(t, srv.Close()) }()
+	n.Blackhole("blackholed:80")
+
+	var targets []*Target
+	for _, host := range []string{"refused", "blackholed", "ok"} {
+		targets = append(targets, &Target{DialAddr: url.URL{Scheme: "http", Host: host}})
+	}
+	reg := prometheus.NewRegistry()
+	lb := NewLoadBalancingTransportWithContext(
+		ctx,
+		NewStaticDiscoveryFromTargets(targets, nil),
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		NewMetrics(reg),
+		WithDialContext(n.DialContext),
+		WithDialTimeout(50*time.Millisecond),
+	)
+
+	// Each target is picked first once. Dial errors make requests retried on other targets.
+	for i := 0; i < len(targets); i++ {
+		roundTripOK(t, lb)
+	}
+	testutil.Equals(t, 3.0, gatheredCounter(t, reg, "lbtransport_proxied_requests_total", "", ""))
+	testutil.Equals(t, 1.0, gatheredCounter(t, reg, "conntrack_dialer_conn_failed_total", "reason", "refused"))
+	testutil.Equals(t, 1.0, gatheredCounter(t, reg, "conntrack_dialer_conn_failed_total", "reason", "timeout"))
+}
+
+func TestNewLoadBalancingTransport_Options(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lb := NewLoadBalancingTransportWithContext(ctx, &mockedDiscovery{}, &mockedPicker{}, NewMetrics(nil))
+	parent := lb.parent.(*http.Transport)
+	testutil.Equals(t, 4, parent.MaxIdleConns)
+	testutil.Equals(t, 90*time.Second, parent.IdleConnTimeout)
+	testutil.Equals(t, 30*time.Second, lb.drainTimeout)
+
+	lb = NewLoadBalancingTransportWithContext(ctx, &mockedDiscovery{}, &mockedPicker{}, NewMetrics(nil),
+		WithMaxIdleConns(100),
+		WithMaxIdleConnsPerHost(10),
+		WithMaxConnsPerHost(20),
+		WithIdleConnTimeout(1*time.Minute),
+		WithResponseHeaderTimeout(5*time.Second),
+		WithTLSHandshakeTimeout(3*time.Second),
+		WithTLSConfig(&tls.Config{ServerName: "test"}),
+		WithDrainTimeout(1*time.Second),
+	)
+	parent = lb.parent.(*http.Transport)
+	testutil.Equals(t, 100, parent.MaxIdleConns)
+	testutil.Equals(t, 10, parent.MaxIdleConnsPerHost)
+	testutil.Equals(t, 20, parent.MaxConnsPerHost)
+	testutil.Equals(t, 1*time.Minute, parent.IdleConnTimeout)
+	testutil.Equals(t, 5*time.Second, parent.ResponseHeaderTimeout)
+	testutil.Assert(t, parent.DialTLSContext != nil, "TLS handshake should be done by instrumented dialer")
+	testutil.Equals(t, 1*time.Second, lb.drainTimeout)
+
+	custom := &mockedTransport{t: t}
+	lb = NewLoadBalancingTransportWithContext(ctx, &mockedDiscovery{}, &mockedPicker{}, NewMetrics(nil), WithParent(custom))
+	testutil.Equals(t, http.RoundTripper(custom), lb.parent)
+}
+
+func TestNewLoadBalancingTransport_NoBackgroundWork(t *testing.T) {
+	defer leaktest.Check(t)()
+
+	// Deprecated constructor has no context to stop background work with, so it starts none.
+	lb := NewLoadBalancingTransport(&mockedDiscovery{}, &mockedPicker{}, NewMetrics(nil), WithWarmConnsPerTarget(1))
+	testutil.Assert(t, lb.warm != nil, "warm pool should be configured")
+}
+
+func TestTransport_ChunkedResponseFlushing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Response of unknown length is chunked.
+		_, _ = w.Write([]byte("1"))
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write([]byte("2"))
+	}))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	testutil.Ok(t, err)
+
+	lb := NewLoadBalancingTransportWithContext(
+		ctx,
+		NewStaticDiscoveryFromTargets([]*Target{{DialAddr: *u}}, nil),
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		NewMetrics(nil),
+	)
+	proxy := httptest.NewServer(&httputil.ReverseProxy{Director: func(*http.Request) {}, Transport: lb, FlushInterval: -1})
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, resp.Body.Close()) }()
+	testutil.Equals(t, []string{"chunked"}, resp.TransferEncoding)
+
+	// First chunk is proxied before target finishes the response.
+	read := make(chan string, 1)
+	go func() {
+		b := make([]byte, 1)
+		_, _ = io.ReadFull(resp.Body, b)
+		read <- string(b)
+	}()
+	select {
+	case b := <-read:
+		testutil.Equals(t, "1", b)
+	case <-time.After(5 * time.Second):
+		t.Error("first chunk was not flushed")
+	}
+	close(release)
+
+	rest, err := ioutil.ReadAll(resp.Body)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "2", string(rest))
+}
+
+func TestNewMetrics_SharedTargetLimiter(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg, WithDialerTargetLabel(), WithMaxTargetLabelValues(1))
+
+	n := memnet.New()
+	l, err := n.Listen("tcp", "a:8080")
+	testutil.Ok(t, err)
+	defer func() { _ = l.Close() }()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	ok := promhttp.RoundTripperFunc(func(*http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	})
+	roundTrip := func(target string) {
+		resp, err := exthttp.NewMetricTripperware(metrics.httpMetrics, target, ok).RoundTrip(httptest.NewRequest("GET", target, nil))
+		testutil.Ok(t, err)
+		testutil.Ok(t, resp.Body.Close())
+	}
+
+	// URL and dialed address of the same target take a single slot.
+	roundTrip("http://a:8080")
+	conn, err := conntrack.NewInstrumentedDialContextFunc(n.DialContext, metrics.dialerMetrics)(context.Background(), "tcp", "a:8080")
+	testutil.Ok(t, err)
+	testutil.Ok(t, conn.Close())
+	testutil.Equals(t, 0.0, gatheredCounter(t, reg, "label_value_overflow_observations_total", "limiter", "target"))
+	testutil.Assert(t, countSeriesWithLabel(t, reg, "target", "http://a:8080") > 0, "HTTP client series should be labelled with target URL")
+	testutil.Assert(t, countSeriesWithLabel(t, reg, "target", "a:8080") > 0, "dialer series should be labelled with target address")
+
+	roundTrip("http://b:8080")
+	testutil.Equals(t, 1.0, gatheredCounter(t, reg, "label_value_overflow_observations_total", "limiter", "target"))
 }
@@ -0,0 +1,58 @@
+package lbtransport
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+type upgradeCtxKey struct{}
+
+// upgradeFromContext returns true if context is of the upgrade request (e.g WebSocket handshake).
+func upgradeFromContext(ctx context.Context) bool {
+	u, _ := ctx.Value(upgradeCtxKey{}).(bool)
+	return u
+}
+
+// upgradedConn is a body of `101 Switching Protocols` response, i.e bidirectional connection to the target that was
+// upgraded to other protocol (e.g WebSocket). It tracks connection metrics and marks request as done once closed.
+type upgradedConn struct {
+	io.ReadWriteCloser
+
+	metrics *Metrics
+	start   time.Time
+	done    func()
+	once    sync.Once
+}
+
+func newUpgradedConn(rwc io.ReadWriteCloser, metrics *Metrics, done func()) *upgradedConn {
+	metrics.upgradedConnsActive.Inc()
+	return &upgradedConn{ReadWriteCloser: rwc, metrics: metrics, start: time.Now(), done: done}
+}
+
+func (c *upgradedConn) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.metrics.upgradedConnBytes.WithLabelValues(directionReceived).Add(float64(n))
+	return n, err
+}
+
+func (c *upgradedConn) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.metrics.upgradedConnBytes.WithLabelValues(directionSent).Add(float64(n))
+	return n, err
+}
+
+func (c *upgradedConn) Close() error {
+	c.once.Do(func() {
+		c.metrics.upgradedConnsActive.Dec()
+		c.metrics.upgradedConnDuration.Observe(time.Since(c.start).Seconds())
+		c.done()
+	})
+	return c.ReadWriteCloser.Close()
+}
+
+const (
+	directionSent     = "sent"
+	directionReceived = "received"
+)
@@ -0,0 +1,121 @@
+package lbtransport
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+// echoUpgradeHandler switches to "echo" protocol and echoes everything back.
+func echoUpgradeHandler(w http.ResponseWriter, r *http.Request) {
+	conn, brw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	_ = brw.Flush()
+	_, _ = io.Copy(conn, brw)
+}
+
+func TestTransport_Upgrade(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := httptest.NewServer(http.HandlerFunc(echoUpgradeHandler))
+	defer backend.Close()
+	u, err := url.Parse(backend.URL)
+	testutil.Ok(t, err)
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+	lb := NewLoadBalancingTransportWithContext(
+		ctx,
+		NewStaticDiscoveryFromTargets([]*Target{{DialAddr: *u}}, nil),
+		NewRoundRobinPicker(ctx, nil, 1*time.Minute),
+		metrics,
+	)
+	proxy := httptest.NewServer(&httputil.ReverseProxy{Director: func(*http.Request) {}, Transport: lb})
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	testutil.Ok(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("GET /lb HTTP/1.1\r\nHost: lb\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	testutil.Ok(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.upgradedConnsActive))
+
+	_, err = conn.Write([]byte("hello"))
+	testutil.Ok(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(br, buf)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "hello", string(buf))
+
+	testutil.Ok(t, conn.Close())
+	// Proxy closes upgraded connection to target asynchronously.
+	for i := 0; promtestutil.ToFloat64(metrics.upgradedConnsActive) != 0; i++ {
+		testutil.Assert(t, i < 100, "upgraded connection was not closed")
+		time.Sleep(10 * time.Millisecond)
+	}
+	testutil.Equals(t, 5.0, promtestutil.ToFloat64(metrics.upgradedConnBytes.WithLabelValues(directionSent)))
+	testutil.Equals(t, 5.0, promtestutil.ToFloat64(metrics.upgradedConnBytes.WithLabelValues(directionReceived)))
+	var m dto.Metric
+	testutil.Ok(t, metrics.upgradedConnDuration.Write(&m))
+	testutil.Equals(t, uint64(1), m.GetHistogram().GetSampleCount())
+}
+
+func TestTransport_UpgradeNotWritable(t *testing.T) {
+	metrics := NewMetrics(nil)
+	transport := &mockedTransport{t: t}
+	lb := &Transport{
+		discovery: &mockedDiscovery{targets: []string{"a"}},
+		picker:    &mockedPicker{toPick: []response{{host: "a"}}},
+		metrics:   metrics,
+		parent:    transport,
+	}
+
+	// Parent transport that does not support upgrades returns read-only body.
+	body := &closeCountingBody{}
+	transport.Reset([]response{{host: "a", Response: &http.Response{StatusCode: http.StatusSwitchingProtocols, Body: body}}})
+
+	r := httptest.NewRequest("GET", "http://whatever", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "echo")
+	_, err := lb.RoundTrip(r)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, 1, body.closed)
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(metrics.failures.WithLabelValues(failedUpgrade)))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.successes))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(metrics.upgradedConnsActive))
+	// Request is not in flight anymore.
+	testutil.Equals(t, 0, len(lb.inFlight.inFlight))
+}
+
+type closeCountingBody struct {
+	closed int
+}
+
+func (b *closeCountingBody) Read([]byte) (int, error) { return 0, io.EOF }
+
+func (b *closeCountingBody) Close() error {
+	b.closed++
+	return nil
+}
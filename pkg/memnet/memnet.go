@@ -0,0 +1,205 @@
+// Package memnet contains in-memory network for hermetic tests, so listeners and dialers can be used without binding
+// real ports. Connections are buffered pipes, so they behave like TCP connections on loopback. Dials to addresses
+// nobody listens on are refused, and dials to blackholed addresses time out, deterministically.
+package memnet
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// Network is the name of the network of memnet addresses.
+const Network = "memnet"
+
+// backlog is the number of dialed connections waiting for Accept, after which dials block.
+const backlog = 128
+
+// Addr is address of memnet endpoint, in `host:port` form.
+type Addr string
+
+func (a Addr) Network() string { return Network }
+func (a Addr) String() string  { return string(a) }
+
+// Net is in-memory network of addressable listeners. Zero value is ready to use.
+type Net struct {
+	mu         sync.Mutex
+	listeners  map[string]*Listener
+	blackholed map[string]struct{}
+	nextPort   int
+}
+
+// New returns empty Net.
+func New() *Net {
+	return &Net{}
+}
+
+// port returns the next free ephemeral port. It has to be called with mu locked.
+func (n *Net) port() string {
+	if n.nextPort == 0 {
+		n.nextPort = 32768
+	}
+	n.nextPort++
+	return strconv.Itoa(n.nextPort - 1)
+}
+
+// Listen listens on the given address in `host:port` form. Zero port picks a free one, see Listener.Addr. Network is
+// ignored, so Listen can replace net.Listen.
+func (n *Net) Listen(network, address string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: err}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if port == "0" {
+		port = n.port()
+	}
+	addr := net.JoinHostPort(host, port)
+	if _, ok := n.listeners[addr]; ok {
+		return nil, &net.OpError{Op: "listen", Net: network, Addr: Addr(addr), Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}
+	}
+	if n.listeners == nil {
+		n.listeners = map[string]*Listener{}
+	}
+	l := &Listener{net: n, addr: Addr(addr), conns: make(chan net.Conn, backlog), done: make(chan struct{})}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+// Blackhole makes dials to the given address hang until their context is done, as if packets were dropped. Such dials
+// fail with timeout error once context deadline passes.
+func (n *Net) Blackhole(address string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.blackholed == nil {
+		n.blackholed = map[string]struct{}{}
+	}
+	n.blackholed[address] = struct{}{}
+}
+
+// DialContext connects to the listener on the given address. It fails with ECONNREFUSED error if nothing listens on
+// the address. Network is ignored, so DialContext can replace net.Dialer.DialContext.
+func (n *Net) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	n.mu.Lock()
+	_, blackholed := n.blackholed[address]
+	l := n.listeners[address]
+	local := Addr(net.JoinHostPort(Network, n.port()))
+	n.mu.Unlock()
+
+	opErr := func(err error) error {
+		return &net.OpError{Op: "dial", Net: network, Source: local, Addr: Addr(address), Err: err}
+	}
+	if blackholed {
+		<-ctx.Done()
+		return nil, opErr(contextError(ctx.Err()))
+	}
+	if l == nil {
+		return nil, opErr(os.NewSyscallError("connect", syscall.ECONNREFUSED))
+	}
+
+	client, server := newPipe(local, l.addr)
+	switch l.enqueue(server) {
+	case enqueued:
+		return client, nil
+	case listenerClosed:
+		return nil, opErr(os.NewSyscallError("connect", syscall.ECONNREFUSED))
+	default:
+		// Full backlog drops connection attempts, like the kernel does.
+		<-ctx.Done()
+		return nil, opErr(contextError(ctx.Err()))
+	}
+}
+
+// contextError maps context error to the error net.Dialer returns, so deadline is reported as timeout.
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return os.ErrDeadlineExceeded
+	}
+	return err
+}
+
+// Dial connects to the listener on the given address, see DialContext.
+func (n *Net) Dial(network, address string) (net.Conn, error) {
+	return n.DialContext(context.Background(), network, address)
+}
+
+// Listener is memnet listener.
+type Listener struct {
+	net   *Net
+	addr  Addr
+	conns chan net.Conn
+
+	mu     sync.Mutex
+	closed bool
+	done   chan struct{}
+}
+
+const (
+	enqueued = iota
+	listenerClosed
+	backlogFull
+)
+
+// enqueue adds dialed connection to the backlog.
+func (l *Listener) enqueue(c net.Conn) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return listenerClosed
+	}
+	select {
+	case l.conns <- c:
+		return enqueued
+	default:
+		return backlogFull
+	}
+}
+
+// Accept waits for and returns the next connection to the listener.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: Network, Addr: l.addr, Err: net.ErrClosed}
+	}
+}
+
+// Close stops listening. Connections not accepted yet are closed and new dials are refused.
+func (l *Listener) Close() error {
+	l.net.mu.Lock()
+	if l.net.listeners[string(l.addr)] == l {
+		delete(l.net.listeners, string(l.addr))
+	}
+	l.net.mu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.done)
+	for {
+		select {
+		case c := <-l.conns:
+			_ = c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// Addr returns the listener's address.
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,129 @@
+package memnet
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestNet_DialListen(t *testing.T) {
+	n := New()
+	l, err := n.Listen("tcp", "a:0")
+	testutil.Ok(t, err)
+	testutil.Equals(t, "a:32768", l.Addr().String())
+	defer func() { testutil.Ok(t, l.Close()) }()
+
+	_, err = n.Listen("tcp", "a:32768")
+	testutil.Assert(t, errors.Is(err, syscall.EADDRINUSE), "unexpected error %v", err)
+
+	client, err := n.Dial("tcp", l.Addr().String())
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, client.Close()) }()
+	server, err := l.Accept()
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, server.Close()) }()
+
+	testutil.Equals(t, l.Addr(), client.RemoteAddr())
+	testutil.Equals(t, client.LocalAddr(), server.RemoteAddr())
+
+	go func() { _, _ = client.Write([]byte("hello")) }()
+	b := make([]byte, 5)
+	_, err = io.ReadFull(server, b)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "hello", string(b))
+}
+
+func TestNet_DialErrors(t *testing.T) {
+	n := New()
+
+	_, err := n.Dial("tcp", "a:80")
+	testutil.Assert(t, errors.Is(err, syscall.ECONNREFUSED), "unexpected error %v", err)
+	var opErr *net.OpError
+	testutil.Assert(t, errors.As(err, &opErr) && opErr.Op == "dial", "error should be dial error, got %v", err)
+
+	n.Blackhole("b:80")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = n.DialContext(ctx, "tcp", "b:80")
+	var netErr net.Error
+	testutil.Assert(t, errors.As(err, &netErr) && netErr.Timeout(), "dial should time out, got %v", err)
+
+	// Connections not accepted before listener is closed are closed, new ones are refused.
+	l, err := n.Listen("tcp", "c:80")
+	testutil.Ok(t, err)
+	pending, err := n.Dial("tcp", "c:80")
+	testutil.Ok(t, err)
+	testutil.Ok(t, l.Close())
+	_, err = pending.Read(make([]byte, 1))
+	testutil.Equals(t, io.EOF, err)
+	_, err = n.Dial("tcp", "c:80")
+	testutil.Assert(t, errors.Is(err, syscall.ECONNREFUSED), "unexpected error %v", err)
+	_, err = l.Accept()
+	testutil.Assert(t, errors.Is(err, net.ErrClosed), "unexpected error %v", err)
+}
+
+func TestNet_HTTP(t *testing.T) {
+	n := New()
+	l, err := n.Listen("tcp", "server:80")
+	testutil.Ok(t, err)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.RemoteAddr))
+	})}
+	go func() { _ = srv.Serve(l) }()
+	defer func() { testutil.Ok(t, srv.Close()) }()
+
+	client := &http.Client{Transport: &http.Transport{DialContext: n.DialContext}}
+	resp, err := client.Get("http://server/")
+	testutil.Ok(t, err)
+	b, err := ioutil.ReadAll(resp.Body)
+	testutil.Ok(t, err)
+	testutil.Ok(t, resp.Body.Close())
+	testutil.Equals(t, "memnet:32768", string(b))
+}
+
+func TestNet_BufferAndDeadlines(t *testing.T) {
+	n := New()
+	l, err := n.Listen("tcp", "a:80")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, l.Close()) }()
+
+	client, err := n.Dial("tcp", "a:80")
+	testutil.Ok(t, err)
+	defer func() { testutil.Ok(t, client.Close()) }()
+
+	// Writes do not wait for the peer until the buffer is full.
+	_, err = client.Write(make([]byte, bufferSize))
+	testutil.Ok(t, err)
+	testutil.Ok(t, client.SetWriteDeadline(time.Now().Add(10*time.Millisecond)))
+	n1, err := client.Write([]byte("x"))
+	testutil.Equals(t, 0, n1)
+	var netErr net.Error
+	testutil.Assert(t, errors.As(err, &netErr) && netErr.Timeout(), "write should time out, got %v", err)
+
+	testutil.Ok(t, client.SetReadDeadline(time.Now().Add(10*time.Millisecond)))
+	_, err = client.Read(make([]byte, 1))
+	testutil.Assert(t, errors.As(err, &netErr) && netErr.Timeout(), "read should time out, got %v", err)
+
+	// Deadline can be extended.
+	testutil.Ok(t, client.SetReadDeadline(time.Time{}))
+	server, err := l.Accept()
+	testutil.Ok(t, err)
+	go func() { _, _ = server.Write([]byte("x")) }()
+	_, err = client.Read(make([]byte, 1))
+	testutil.Ok(t, err)
+
+	// Closed peer is seen once remaining data is read.
+	_, err = io.ReadFull(server, make([]byte, bufferSize))
+	testutil.Ok(t, err)
+	testutil.Ok(t, server.Close())
+	_, err = client.Read(make([]byte, 1))
+	testutil.Equals(t, io.EOF, err)
+}
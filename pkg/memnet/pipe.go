@@ -0,0 +1,225 @@
+package memnet
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// bufferSize is the number of bytes written to the connection that can wait to be read, like socket buffers.
+const bufferSize = 64 * 1024
+
+// buffer is one direction of the pipe.
+type buffer struct {
+	mu   sync.Mutex
+	data []byte
+	// writerClosed makes reads return EOF once data is read. readerClosed makes writes fail.
+	writerClosed bool
+	readerClosed bool
+	// changed is closed and replaced on every change, waking up all waiters.
+	changed chan struct{}
+}
+
+func newBuffer() *buffer {
+	return &buffer{changed: make(chan struct{})}
+}
+
+// notify has to be called with mu locked.
+func (b *buffer) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// pipeConn is one end of buffered in-memory connection.
+type pipeConn struct {
+	local, remote Addr
+	rx, tx        *buffer
+
+	closeOnce     sync.Once
+	done          chan struct{}
+	readDeadline  *deadline
+	writeDeadline *deadline
+}
+
+// newPipe returns both ends of buffered in-memory connection between the given addresses. Unlike net.Pipe, writes do
+// not wait for reads, as long as there is space in the buffer.
+func newPipe(a, b Addr) (*pipeConn, *pipeConn) {
+	ab, ba := newBuffer(), newBuffer()
+	return &pipeConn{local: a, remote: b, rx: ba, tx: ab, done: make(chan struct{}), readDeadline: newDeadline(), writeDeadline: newDeadline()},
+		&pipeConn{local: b, remote: a, rx: ab, tx: ba, done: make(chan struct{}), readDeadline: newDeadline(), writeDeadline: newDeadline()}
+}
+
+func (c *pipeConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: Network, Source: c.local, Addr: c.remote, Err: err}
+}
+
+func (c *pipeConn) Read(b []byte) (int, error) {
+	for {
+		select {
+		case <-c.done:
+			return 0, c.opError("read", net.ErrClosed)
+		case <-c.readDeadline.wait():
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		default:
+		}
+
+		c.rx.mu.Lock()
+		if len(c.rx.data) > 0 || len(b) == 0 {
+			n := copy(b, c.rx.data)
+			c.rx.data = c.rx.data[n:]
+			c.rx.notify()
+			c.rx.mu.Unlock()
+			return n, nil
+		}
+		if c.rx.writerClosed {
+			c.rx.mu.Unlock()
+			return 0, io.EOF
+		}
+		changed := c.rx.changed
+		c.rx.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-c.done:
+		case <-c.readDeadline.wait():
+		}
+	}
+}
+
+func (c *pipeConn) Write(b []byte) (int, error) {
+	written := 0
+	for {
+		select {
+		case <-c.done:
+			return written, c.opError("write", net.ErrClosed)
+		case <-c.writeDeadline.wait():
+			return written, c.opError("write", os.ErrDeadlineExceeded)
+		default:
+		}
+
+		c.tx.mu.Lock()
+		if c.tx.readerClosed {
+			c.tx.mu.Unlock()
+			return written, c.opError("write", io.ErrClosedPipe)
+		}
+		if space := bufferSize - len(c.tx.data); space > 0 {
+			n := len(b) - written
+			if n > space {
+				n = space
+			}
+			c.tx.data = append(c.tx.data, b[written:written+n]...)
+			written += n
+			c.tx.notify()
+		}
+		if written == len(b) {
+			c.tx.mu.Unlock()
+			return written, nil
+		}
+		changed := c.tx.changed
+		c.tx.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-c.done:
+		case <-c.writeDeadline.wait():
+		}
+	}
+}
+
+// Close closes the connection. The peer reads remaining data and then EOF, its writes fail.
+func (c *pipeConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+
+		c.tx.mu.Lock()
+		c.tx.writerClosed = true
+		c.tx.notify()
+		c.tx.mu.Unlock()
+
+		c.rx.mu.Lock()
+		c.rx.readerClosed = true
+		c.rx.data = nil
+		c.rx.notify()
+		c.rx.mu.Unlock()
+	})
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return c.local }
+func (c *pipeConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// deadline is a channel closed once the deadline passes.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline. Zero time means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// Timer already fired, wait until it closes the channel.
+		<-d.cancel
+	}
+	d.timer = nil
+
+	closed := isClosed(d.cancel)
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns channel closed once the deadline passes.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}